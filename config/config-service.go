@@ -2,6 +2,8 @@ package main
 
 import (
 	// "database/sql"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 
@@ -9,10 +11,16 @@ import (
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	_ "time/tzdata" //the alpine image has no zoneinfo
 
-	//"strings"
 	"github.com/google/uuid"
 	//"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
@@ -24,6 +32,7 @@ type stream_json struct {
 	Active                  *bool                  `db:"active" json:"active,omitempty"`
 	MessageType             string                 `db:"message_type" json:"message_type,omitempty"`
 	FileStoreTypeID         int                    `db:"file_store_type_id" json:"file_store_type_id,omitempty"`
+	TableFormatID           int                    `db:"table_format_id" json:"table_format_id,omitempty"`
 	Region                  string                 `db:"region" json:"region,omitempty"`
 	BucketName              string                 `db:"bucket_name" json:"bucket_name,omitempty"`
 	FolderName              string                 `db:"folder_name" json:"folder_name,omitempty"`
@@ -39,12 +48,94 @@ type stream_json struct {
 	GlueEnabled             *bool                  `db:"glue_enabled" json:"glue_enabled, omitempty"`
 	GlueRole                string                 `db:"glue_role" json:"glue_role, omitempty"`
 	GlueScheduleCron        string                 `db:"glue_schedule_cron" json:"glue_schedule_chron, omitempty"`
+	GlueMode                string                 `db:"glue_mode" json:"glue_mode,omitempty"`
+	GlueEndpoint            string                 `db:"glue_endpoint" json:"glue_endpoint,omitempty"`
 	SnowflakeEnabled        *bool                  `db:"snowflake_enabled" json:"snowflake_enabled, omitempty"`
 	SnowflakeAccount        string                 `db:"snowflake_account" json:"snowflake_account, omitempty"`
 	SnowflakeUsername       string                 `db:"snowflake_username" json:"snowflake_username, omitempty"`
 	SnowflakePassword       string                 `db:"snowflake_password" json:"snowflake_password, omitempty"`
 	SnowflakeDatabase       string                 `db:"snowflake_database" json:"snowflake_database, omitempty"`
+	SnowflakeWarehouse      string                 `db:"snowflake_warehouse" json:"snowflake_warehouse,omitempty"`
+	SnowflakeRole           string                 `db:"snowflake_role" json:"snowflake_role,omitempty"`
+	SnowflakePrivateKey     string                 `db:"snowflake_private_key" json:"snowflake_private_key,omitempty"`
+	SnowflakeMode           string                 `db:"snowflake_mode" json:"snowflake_mode,omitempty"`
+	SnowflakeIntegration    string                 `db:"snowflake_storage_integration" json:"snowflake_storage_integration,omitempty"`
 	Functions               string                 `db:"functions" json:"functions, omitempty"`
+	WriteKeys               []write_key            `db:"write_keys" json:"write_keys,omitempty"`
+	RequireSignature        *bool                  `db:"require_signature" json:"require_signature,omitempty"`
+	BatchMaxRows            int                    `db:"batch_max_rows" json:"batch_max_rows,omitempty"`
+	BatchMaxBytes           int                    `db:"batch_max_bytes" json:"batch_max_bytes,omitempty"`
+	BatchMaxAgeSeconds      int                    `db:"batch_max_age_seconds" json:"batch_max_age_seconds,omitempty"`
+	SchemaCompatibility     string                 `db:"schema_compatibility" json:"schema_compatibility,omitempty"`
+	TypeHints               map[string]string      `db:"type_hints" json:"type_hints,omitempty"`
+	PartitionSpec           *partition_spec        `db:"partition_spec" json:"partition_spec,omitempty"`
+	AllowedLatenessSeconds  *int                   `db:"allowed_lateness_seconds" json:"allowed_lateness_seconds,omitempty"`
+	LateDataPolicy          string                 `db:"late_data_policy" json:"late_data_policy,omitempty"`
+	S3Endpoint              string                 `db:"s3_endpoint" json:"s3_endpoint,omitempty"`
+	S3ForcePathStyle        *bool                  `db:"s3_force_path_style" json:"s3_force_path_style,omitempty"`
+	S3TLSVerify             *bool                  `db:"s3_tls_verify" json:"s3_tls_verify,omitempty"`
+	S3CACert                string                 `db:"s3_ca_cert" json:"s3_ca_cert,omitempty"`
+	Compaction              *compaction_spec       `db:"compaction" json:"compaction,omitempty"`
+	Catalogs                []string               `db:"catalogs" json:"catalogs,omitempty"`
+	DremioMetadataPolicy    map[string]interface{} `db:"dremio_metadata_policy" json:"dremio_metadata_policy,omitempty"`
+}
+
+// partitioning of a stream's files, `fields` default to the `partition_time_id` granularity of the event time
+// `transform` is one of identity (default), year, quarter, month, week, day, hour, truncate[n] or bucket[n]
+type partition_spec struct {
+	EventTimeField string            `json:"event_time_field,omitempty"`
+	Timezone       string            `json:"timezone,omitempty"`
+	HiveStyle      bool              `json:"hive_style,omitempty"`
+	Fields         []partition_field `json:"fields,omitempty"`
+}
+
+type partition_field struct {
+	Name      string `json:"name,omitempty"`
+	Source    string `json:"source,omitempty"`
+	Transform string `json:"transform,omitempty"`
+}
+
+// small-file compaction of a stream's partitions, streams without one are not compacted
+type compaction_spec struct {
+	MinAgeMinutes    *int   `json:"min_age_minutes,omitempty"`
+	TargetFileSizeMB *int   `json:"target_file_size_mb,omitempty"`
+	SortColumn       string `json:"sort_column,omitempty"`
+}
+
+// write key used by producers to authenticate against the `ingest` service
+// `secret` signs requests (HMAC-SHA256), a key past `expires_at` is no longer accepted
+type write_key struct {
+	Key       string `json:"key"`
+	Secret    string `json:"secret"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+type write_key_request struct {
+	StreamID       string `json:"stream_id,omitempty"`
+	Key            string `json:"key,omitempty"`
+	OverlapSeconds int    `json:"overlap_seconds,omitempty"`
+}
+
+// schema versions the `ingester` registered for a stream and message type
+// see ingester/registry.go, the ingester owns these files and the config service only reads them
+type schema_version struct {
+	Version     int             `json:"version"`
+	Fingerprint string          `json:"fingerprint"`
+	CreatedAt   string          `json:"created_at"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+}
+
+type schema_history struct {
+	StreamID    string           `json:"stream_id"`
+	MessageType string           `json:"message_type"`
+	Versions    []schema_version `json:"versions"`
+}
+
+type schema_request struct {
+	StreamID    string `json:"stream_id,omitempty"`
+	MessageType string `json:"message_type,omitempty"`
+	Version     int    `json:"version,omitempty"`
 }
 
 //	FUNCTION
@@ -70,6 +161,11 @@ func main() {
 	http.HandleFunc("/getAllFileStoreTypes", getAllFileStoreTypesHandler())     // GET
 	http.HandleFunc("/getAllPartitionTimes", getAllPartitionTimesHandler())     // GET
 	http.HandleFunc("/getAllCompressionTypes", getAllCompressionTypesHandler()) // GET
+	http.HandleFunc("/createWriteKey", createWriteKeyHandler())                 // POST; `stream_id` required
+	http.HandleFunc("/rotateWriteKey", rotateWriteKeyHandler())                 // PUT; `stream_id` required, `overlap_seconds` optional
+	http.HandleFunc("/revokeWriteKey", revokeWriteKeyHandler())                 // DELETE; `stream_id` and `key` required
+	http.HandleFunc("/getSchemas", getSchemasHandler())                         // POST; `stream_id` required
+	http.HandleFunc("/getSchema", getSchemaHandler())                           // POST; `stream_id` and `message_type` required, `version` optional
 
 	// Run the web server
 	log.Fatal(http.ListenAndServe(":80", nil))
@@ -308,12 +404,13 @@ func updateStreamHandler() func(http.ResponseWriter, *http.Request) {
 			}
 
 			if reqStream.StreamID != "" {
-				_, err := ioutil.ReadFile("configs/" + reqStream.StreamID + ".json")
+				existingConfig, err := loadStreamConfig(reqStream.StreamID)
 				if err != nil {
 					wrt.WriteHeader(http.StatusBadRequest)
 					http.Error(wrt, "Invalid `stream_id`", http.StatusBadRequest)
 					CheckError(err)
 				}
+				existingWriteKeys := getWriteKeys(existingConfig)
 
 				//validate the stream before persisting
 				streamValid, validateError := validateStream(reqStream)
@@ -327,6 +424,11 @@ func updateStreamHandler() func(http.ResponseWriter, *http.Request) {
 					CheckError(validateError)
 				}
 
+				// write keys are managed through their own endpoints, keep them if the update does not list any
+				if reqStream.WriteKeys == nil {
+					reqStream.WriteKeys = existingWriteKeys
+				}
+
 				log.Println(reqStream.Active)
 				resp, errRet := json.MarshalIndent(reqStream, "", "    ")
 				if errRet == nil {
@@ -640,8 +742,277 @@ func getAllCompressionTypesHandler() func(http.ResponseWriter, *http.Request) {
 	})
 }
 
+func createWriteKeyHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			var keyRequest write_key_request
+			if err := readWriteKeyRequest(req, &keyRequest); err != nil {
+				http.Error(wrt, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			configObject, err := loadStreamConfig(keyRequest.StreamID)
+			if err != nil {
+				http.Error(wrt, "Invalid `stream_id`", http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			writeKey, err := newWriteKey()
+			if err != nil {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			configObject["write_keys"] = append(getWriteKeys(configObject), writeKey)
+
+			if _, err = saveStreamConfig(keyRequest.StreamID, configObject); err != nil {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			jsonData, _ := json.MarshalIndent(writeKey, "", "    ")
+			wrt.WriteHeader(http.StatusOK)
+			wrt.Write(jsonData)
+
+			// Refresh the cache on the `ingest` service
+			refreshIngestCache()
+		case http.MethodGet:
+		case http.MethodPut:
+		case http.MethodDelete:
+		default:
+			wrt.WriteHeader(http.StatusMethodNotAllowed)
+			http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func rotateWriteKeyHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPut:
+			var keyRequest write_key_request
+			if err := readWriteKeyRequest(req, &keyRequest); err != nil {
+				http.Error(wrt, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			configObject, err := loadStreamConfig(keyRequest.StreamID)
+			if err != nil {
+				http.Error(wrt, "Invalid `stream_id`", http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			writeKey, err := newWriteKey()
+			if err != nil {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			// existing keys stay valid for the overlap period (default 1 day) so producers can switch over
+			overlap := time.Duration(keyRequest.OverlapSeconds) * time.Second
+			if keyRequest.OverlapSeconds <= 0 {
+				overlap = 24 * time.Hour
+			}
+			expiresAt := time.Now().UTC().Add(overlap)
+
+			writeKeys := getWriteKeys(configObject)
+			for index := range writeKeys {
+				currentExpiry, err := time.Parse(time.RFC3339, writeKeys[index].ExpiresAt)
+				if err != nil || currentExpiry.After(expiresAt) {
+					writeKeys[index].ExpiresAt = expiresAt.Format(time.RFC3339)
+				}
+			}
+			configObject["write_keys"] = append(writeKeys, writeKey)
+
+			if _, err = saveStreamConfig(keyRequest.StreamID, configObject); err != nil {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			jsonData, _ := json.MarshalIndent(writeKey, "", "    ")
+			wrt.WriteHeader(http.StatusOK)
+			wrt.Write(jsonData)
+
+			// Refresh the cache on the `ingest` service
+			refreshIngestCache()
+		case http.MethodGet:
+		case http.MethodPost:
+		case http.MethodDelete:
+		default:
+			wrt.WriteHeader(http.StatusMethodNotAllowed)
+			http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func revokeWriteKeyHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodDelete:
+			var keyRequest write_key_request
+			if err := readWriteKeyRequest(req, &keyRequest); err != nil {
+				http.Error(wrt, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+			if keyRequest.Key == "" {
+				http.Error(wrt, "`key` is required", http.StatusUnprocessableEntity)
+				return
+			}
+
+			configObject, err := loadStreamConfig(keyRequest.StreamID)
+			if err != nil {
+				http.Error(wrt, "Invalid `stream_id`", http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			writeKeys := make([]write_key, 0)
+			for _, writeKey := range getWriteKeys(configObject) {
+				if writeKey.Key != keyRequest.Key {
+					writeKeys = append(writeKeys, writeKey)
+				}
+			}
+			configObject["write_keys"] = writeKeys
+
+			jsonData, err := saveStreamConfig(keyRequest.StreamID, configObject)
+			if err != nil {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			wrt.WriteHeader(http.StatusOK)
+			wrt.Write(jsonData)
+
+			// Refresh the cache on the `ingest` service
+			refreshIngestCache()
+		case http.MethodGet:
+		case http.MethodPost:
+		case http.MethodPut:
+		default:
+			wrt.WriteHeader(http.StatusMethodNotAllowed)
+			http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func getSchemasHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			var schemaRequest schema_request
+			if err := readSchemaRequest(req, &schemaRequest); err != nil {
+				http.Error(wrt, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			schemaFiles, err := ioutil.ReadDir(filepath.Join(schemaRegistryDir(), url.PathEscape(schemaRequest.StreamID)))
+			if err != nil && !os.IsNotExist(err) {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			// Latest version per message type, without the schema itself
+			schemas := make([]schema_history, 0)
+			for _, schemaFile := range schemaFiles {
+				if !strings.HasSuffix(schemaFile.Name(), ".json") {
+					continue
+				}
+				messageType, err := url.PathUnescape(strings.TrimSuffix(schemaFile.Name(), ".json"))
+				if err != nil {
+					continue
+				}
+				history, err := loadSchemaHistory(schemaRequest.StreamID, messageType)
+				if err != nil {
+					log.Println(err)
+					continue
+				}
+				if len(history.Versions) > 0 {
+					latest := history.Versions[len(history.Versions)-1]
+					latest.Schema = nil
+					history.Versions = []schema_version{latest}
+				}
+				schemas = append(schemas, history)
+			}
+			sort.Slice(schemas, func(i, j int) bool { return schemas[i].MessageType < schemas[j].MessageType })
+
+			jsonData, _ := json.MarshalIndent(schemas, "", "    ")
+			wrt.WriteHeader(http.StatusOK)
+			wrt.Write(jsonData)
+		case http.MethodGet:
+		case http.MethodPut:
+		case http.MethodDelete:
+		default:
+			wrt.WriteHeader(http.StatusMethodNotAllowed)
+			http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func getSchemaHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodPost:
+			var schemaRequest schema_request
+			err := readSchemaRequest(req, &schemaRequest)
+			if err == nil && schemaRequest.MessageType == "" {
+				err = errors.New("No `message_type`")
+			}
+			if err != nil {
+				http.Error(wrt, err.Error(), http.StatusBadRequest)
+				log.Println(err)
+				return
+			}
+
+			history, err := loadSchemaHistory(schemaRequest.StreamID, schemaRequest.MessageType)
+			if os.IsNotExist(err) {
+				http.Error(wrt, "No schema registered for `stream_id` and `message_type`", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+
+			// Full history unless a specific version is requested
+			var jsonData []byte
+			if schemaRequest.Version > 0 {
+				if schemaRequest.Version > len(history.Versions) {
+					http.Error(wrt, "Invalid `version`", http.StatusNotFound)
+					return
+				}
+				jsonData, _ = json.MarshalIndent(history.Versions[schemaRequest.Version-1], "", "    ")
+			} else {
+				jsonData, _ = json.MarshalIndent(history, "", "    ")
+			}
+
+			wrt.WriteHeader(http.StatusOK)
+			wrt.Write(jsonData)
+		case http.MethodGet:
+		case http.MethodPut:
+		case http.MethodDelete:
+		default:
+			wrt.WriteHeader(http.StatusMethodNotAllowed)
+			http.Error(wrt, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
 ////////// HANDLER FUNCTIONS - End //////////
 
+
 ////////// HELPER FUNCTIONS - Start //////////
 //	FUNCTION
 // 	refreshIngestCacher
@@ -692,10 +1063,339 @@ func validateStream(stream stream_json) (streamValid bool, err error) {
 			err = errors.New("Invalid `file_store_type_id` value")
 		}
 	}
+	if streamValid {
+		switch stream.TableFormatID {
+		// Parquet
+		case 0, 1:
+		// Delta Lake
+		case 2:
+		// Iceberg
+		case 3:
+		// Invalid
+		default:
+			streamValid = false
+			err = errors.New("Invalid `table_format_id` value")
+		}
+	}
+	if streamValid {
+		switch stream.SchemaCompatibility {
+		case "", "backward", "forward", "full", "none":
+		default:
+			streamValid = false
+			err = errors.New("Invalid `schema_compatibility` value, must be one of backward, forward, full or none")
+		}
+	}
+	if streamValid {
+		for path, hint := range stream.TypeHints {
+			if !validTypeHint(hint) {
+				streamValid = false
+				err = errors.New("Invalid `type_hints` value `" + hint + "` for `" + path + "`, must be one of boolean, int64, double, string, timestamp_millis, timestamp_micros or decimal(precision,scale) with a precision up to 18")
+				break
+			}
+		}
+	}
+	if streamValid && stream.PartitionSpec != nil {
+		err = validatePartitionSpec(*stream.PartitionSpec)
+		streamValid = err == nil
+	}
+	if streamValid {
+		switch stream.LateDataPolicy {
+		case "", "notify", "late_table", "drop":
+		default:
+			streamValid = false
+			err = errors.New("Invalid `late_data_policy` value, must be one of notify, late_table or drop")
+		}
+	}
+	if streamValid && stream.AllowedLatenessSeconds != nil && *stream.AllowedLatenessSeconds < 0 {
+		streamValid = false
+		err = errors.New("Invalid `allowed_lateness_seconds` value, must not be negative")
+	}
+	if streamValid && stream.Compaction != nil {
+		err = validateCompaction(*stream.Compaction, stream.TableFormatID)
+		streamValid = err == nil
+	}
+	if streamValid {
+		err = validateCatalogs(stream)
+		streamValid = err == nil
+	}
+	if streamValid {
+		switch stream.GlueMode {
+		case "", "crawler", "direct":
+		default:
+			streamValid = false
+			err = errors.New("Invalid `glue_mode` value, must be one of crawler or direct")
+		}
+	}
+	if streamValid {
+		err = validateSnowflake(stream)
+		streamValid = err == nil
+	}
+	if streamValid && stream.DremioMetadataPolicy != nil {
+		err = validateDremioMetadataPolicy(stream.DremioMetadataPolicy)
+		streamValid = err == nil
+	}
+	if streamValid && stream.S3Endpoint != "" {
+		endpoint, parseErr := url.Parse(strings.TrimSpace(stream.S3Endpoint))
+		if parseErr != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+			streamValid = false
+			err = errors.New("Invalid `s3_endpoint` value, must be an http or https URL")
+		}
+	}
 
 	return streamValid, err
 }
 
+var decimalTypeHintPattern = regexp.MustCompile(`^decimal\(\s*(\d+)\s*,\s*(\d+)\s*\)$`)
+
+//	FUNCTION
+// 	validTypeHint
+//	Description:	Checks a type hint against the types the `ingester` can write, the same aliases are accepted
+func validTypeHint(hint string) bool {
+	hint = strings.ToLower(strings.TrimSpace(hint))
+	switch hint {
+	case "boolean", "bool", "int64", "int", "integer", "long", "double", "float64", "float", "number",
+		"string", "utf8", "timestamp", "timestamp_millis", "timestamp_micros":
+		return true
+	}
+	match := decimalTypeHintPattern.FindStringSubmatch(hint)
+	if match == nil {
+		return false
+	}
+	precision, _ := strconv.Atoi(match[1])
+	scale, _ := strconv.Atoi(match[2])
+	return precision >= 1 && precision <= 18 && scale <= precision
+}
+
+var partitionTransformPattern = regexp.MustCompile(`^(identity|year|quarter|month|week|day|hour|truncate\[[1-9]\d*\]|bucket\[[1-9]\d*\])$`)
+
+//	FUNCTION
+// 	validatePartitionSpec
+//	Description:	Checks the timezone and fields of a partition spec, every field needs a name or a source
+func validatePartitionSpec(spec partition_spec) error {
+	if spec.Timezone != "" {
+		if _, err := time.LoadLocation(spec.Timezone); err != nil {
+			return errors.New("Invalid `partition_spec` timezone `" + spec.Timezone + "`")
+		}
+	}
+	names := make(map[string]bool)
+	for _, field := range spec.Fields {
+		name := field.Name
+		if name == "" {
+			name = field.Source
+		}
+		if name == "" {
+			return errors.New("Invalid `partition_spec`, every field needs a `name` or a `source`")
+		}
+		if names[name] {
+			return errors.New("Invalid `partition_spec`, field `" + name + "` is defined twice")
+		}
+		names[name] = true
+		if field.Transform != "" && !partitionTransformPattern.MatchString(field.Transform) {
+			return errors.New("Invalid `partition_spec` transform `" + field.Transform + "` for `" + name + "`")
+		}
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	validateCompaction
+//	Description:	Checks the settings of a stream's compaction, Iceberg tables cannot be compacted
+func validateCompaction(compaction compaction_spec, tableFormatID int) error {
+	if tableFormatID == 3 {
+		return errors.New("Invalid `compaction`, Iceberg tables cannot be compacted")
+	}
+	if compaction.MinAgeMinutes != nil && *compaction.MinAgeMinutes < 0 {
+		return errors.New("Invalid `compaction` min_age_minutes, must not be negative")
+	}
+	if compaction.TargetFileSizeMB != nil && *compaction.TargetFileSizeMB <= 0 {
+		return errors.New("Invalid `compaction` target_file_size_mb, must be positive")
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	validateCatalogs
+//	Description:	Checks the catalogs a stream is kept in sync with, Glue only reaches AWS S3
+func validateCatalogs(stream stream_json) error {
+	for _, catalog := range stream.Catalogs {
+		switch catalog {
+		case "dremio", "snowflake":
+		case "glue":
+			if stream.FileStoreTypeID != 2 || (stream.S3Endpoint != "" && stream.GlueEndpoint == "") {
+				return errors.New("Invalid `catalogs`, Glue requires an AWS S3 file store")
+			}
+		default:
+			return errors.New("Invalid `catalogs` value `" + catalog + "`, must be one of dremio, glue or snowflake")
+		}
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	validateSnowflake
+//	Description:	Checks the Snowflake options of a stream, files loaded with COPY INTO must not be compacted
+//	and GCS and Azure stores are only reached through a storage integration
+func validateSnowflake(stream stream_json) error {
+	switch stream.SnowflakeMode {
+	case "", "external", "external_refresh":
+	case "copy":
+		if stream.Compaction != nil {
+			return errors.New("Invalid `snowflake_mode`, copy cannot be combined with `compaction`")
+		}
+	default:
+		return errors.New("Invalid `snowflake_mode` value, must be one of external, external_refresh or copy")
+	}
+
+	enabled := stream.SnowflakeEnabled != nil && *stream.SnowflakeEnabled
+	for _, catalog := range stream.Catalogs {
+		enabled = enabled || catalog == "snowflake"
+	}
+	if enabled && (stream.FileStoreTypeID == 3 || stream.FileStoreTypeID == 4) && stream.SnowflakeIntegration == "" {
+		return errors.New("Invalid Snowflake options, `snowflake_storage_integration` is required with GCS and Azure file stores")
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	validateDremioMetadataPolicy
+//	Description:	Checks the metadataPolicy of a stream's Dremio source, durations are in milliseconds
+func validateDremioMetadataPolicy(policy map[string]interface{}) error {
+	for key, value := range policy {
+		switch key {
+		case "authTTLMs", "namesRefreshMs", "datasetRefreshAfterMs", "datasetExpireAfterMs":
+			if ms, ok := value.(float64); !ok || ms <= 0 {
+				return errors.New("Invalid `dremio_metadata_policy`, `" + key + "` must be a positive number of milliseconds")
+			}
+		case "datasetUpdateMode":
+			if mode, _ := value.(string); mode != "PREFETCH" && mode != "PREFETCH_QUERIED" && mode != "INLINE" {
+				return errors.New("Invalid `dremio_metadata_policy`, `datasetUpdateMode` must be one of PREFETCH, PREFETCH_QUERIED or INLINE")
+			}
+		case "deleteUnavailableDatasets", "autoPromoteDatasets":
+			if _, ok := value.(bool); !ok {
+				return errors.New("Invalid `dremio_metadata_policy`, `" + key + "` must be true or false")
+			}
+		default:
+			return errors.New("Invalid `dremio_metadata_policy` setting `" + key + "`")
+		}
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	readWriteKeyRequest
+//	Description:	Reads the body of a write key request, `stream_id` is always required
+func readWriteKeyRequest(req *http.Request, keyRequest *write_key_request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, keyRequest); err != nil {
+		return err
+	}
+	if keyRequest.StreamID == "" {
+		return errors.New("No `stream_id`")
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	loadStreamConfig
+//	Description:	Reads a stream configuration file as a generic map so that all fields are preserved
+func loadStreamConfig(streamID string) (map[string]interface{}, error) {
+	configString, err := ioutil.ReadFile("configs/" + streamID + ".json")
+	if err != nil {
+		return nil, err
+	}
+	var configObject map[string]interface{}
+	err = json.Unmarshal(configString, &configObject)
+	return configObject, err
+}
+
+//	FUNCTION
+// 	saveStreamConfig
+//	Description:	Persists a stream configuration and returns the persisted json
+func saveStreamConfig(streamID string, configObject map[string]interface{}) ([]byte, error) {
+	jsonData, err := json.MarshalIndent(configObject, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return jsonData, ioutil.WriteFile("configs/"+streamID+".json", jsonData, 0644)
+}
+
+//	FUNCTION
+// 	getWriteKeys
+//	Description:	Extracts the write keys from a generic stream configuration
+func getWriteKeys(configObject map[string]interface{}) []write_key {
+	writeKeys := make([]write_key, 0)
+	if configObject["write_keys"] == nil {
+		return writeKeys
+	}
+	jsonData, err := json.Marshal(configObject["write_keys"])
+	if err == nil {
+		json.Unmarshal(jsonData, &writeKeys)
+	}
+	return writeKeys
+}
+
+//	FUNCTION
+// 	newWriteKey
+//	Description:	Generates a random write key along with the secret used for signing requests
+func newWriteKey() (write_key, error) {
+	key := make([]byte, 16)
+	secret := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return write_key{}, err
+	}
+	if _, err := rand.Read(secret); err != nil {
+		return write_key{}, err
+	}
+	return write_key{
+		Key:       hex.EncodeToString(key),
+		Secret:    hex.EncodeToString(secret),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}, nil
+}
+
+//	FUNCTION
+// 	readSchemaRequest
+//	Description:	Reads the body of a schema registry request, `stream_id` is always required
+func readSchemaRequest(req *http.Request, schemaRequest *schema_request) error {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(body, schemaRequest); err != nil {
+		return err
+	}
+	if schemaRequest.StreamID == "" {
+		return errors.New("No `stream_id`")
+	}
+	return nil
+}
+
+//	FUNCTION
+// 	schemaRegistryDir
+//	Description:	Root folder of the schema registry, shared with the `ingester`
+func schemaRegistryDir() string {
+	if dir := os.Getenv("SCHEMA_REGISTRY_DIR"); dir != "" {
+		return dir
+	}
+	return "schemas"
+}
+
+//	FUNCTION
+// 	loadSchemaHistory
+//	Description:	Reads the registered schema versions of a stream and message type
+func loadSchemaHistory(streamID string, messageType string) (schema_history, error) {
+	var history schema_history
+	jsonData, err := ioutil.ReadFile(filepath.Join(schemaRegistryDir(), url.PathEscape(streamID), url.PathEscape(messageType)+".json"))
+	if err != nil {
+		return history, err
+	}
+	err = json.Unmarshal(jsonData, &history)
+	return history, err
+}
+
 func CheckError(err error) {
 	if err != nil {
 		log.Println(err)
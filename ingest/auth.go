@@ -0,0 +1,167 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//credentials presented with an ingestion request
+//the write key can be sent as the username of HTTP Basic auth (the way Segment does it),
+//in the X-Write-Key header or as `writeKey` inside the event itself
+type Credentials struct {
+	WriteKey  string
+	Signature string
+	Timestamp string
+	Body      []byte //raw (decompressed) request body, needed to verify signatures
+}
+
+//extracts the credentials from the request headers
+func requestCredentials(req *http.Request, body []byte) Credentials {
+
+	credentials := Credentials{
+		WriteKey:  req.Header.Get("X-Write-Key"),
+		Signature: req.Header.Get("X-Signature"),
+		Timestamp: req.Header.Get("X-Timestamp"),
+		Body:      body,
+	}
+
+	if username, _, ok := req.BasicAuth(); ok && username != "" {
+		credentials.WriteKey = username
+	}
+
+	return credentials
+}
+
+//write key sent along with the event, if any
+func eventWriteKey(credentials Credentials, message map[string]interface{}) string {
+	if credentials.WriteKey != "" {
+		return credentials.WriteKey
+	}
+	if writeKey, ok := message["writeKey"].(string); ok {
+		return writeKey
+	}
+	return ""
+}
+
+//write keys configured for a stream, key -> signing secret
+//keys past their expiry are left out, expiry is set on the old key when keys are rotated so
+//that old and new key are both valid until producers have switched over
+func activeWriteKeys(configRecord map[string]interface{}) map[string]string {
+
+	writeKeys := make(map[string]string)
+	entries, _ := configRecord["write_keys"].([]interface{})
+	for _, entry := range entries {
+
+		writeKey, ok := entry.(map[string]interface{})
+		if !ok {
+			continue
+		}
+
+		key, _ := writeKey["key"].(string)
+		if key == "" {
+			continue
+		}
+
+		if expiresAt, _ := writeKey["expires_at"].(string); expiresAt != "" {
+			expiry, err := time.Parse(time.RFC3339, expiresAt)
+			if err != nil || time.Now().After(expiry) {
+				continue
+			}
+		}
+
+		secret, _ := writeKey["secret"].(string)
+		writeKeys[key] = secret
+	}
+
+	return writeKeys
+}
+
+//finds the stream a write key belongs to, used when an event carries neither stream_id nor stream_alt_id
+func findConfigByWriteKey(writeKey string) map[string]interface{} {
+
+	if writeKey == "" {
+		return nil
+	}
+
+	for _, configRecord := range streamConfigs {
+		if _, found := activeWriteKeys(configRecord)[writeKey]; found {
+			return configRecord
+		}
+	}
+
+	return nil
+}
+
+//checks X-Signature, which has to be the hex encoded HMAC-SHA256 of "<X-Timestamp>.<body>"
+//signed with the secret of the write key, optionally prefixed with "sha256="
+func verifySignature(credentials Credentials, secret string) bool {
+
+	if secret == "" || credentials.Signature == "" || credentials.Timestamp == "" {
+		return false
+	}
+
+	//reject stale timestamps so that captured requests cannot be replayed
+	timestamp, err := strconv.ParseInt(credentials.Timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(timestamp, 0))
+	tolerance := time.Duration(GetEnvInt("SIGNATURE_TOLERANCE_SECONDS", 300)) * time.Second
+	if skew > tolerance || skew < -tolerance {
+		return false
+	}
+
+	signature, err := hex.DecodeString(strings.TrimPrefix(credentials.Signature, "sha256="))
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(credentials.Timestamp + "."))
+	mac.Write(credentials.Body)
+
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+//validates the credentials presented for an event against its stream configuration
+//streams without write keys stay open unless REQUIRE_WRITE_KEY is set
+func authenticate(configRecord map[string]interface{}, credentials Credentials, message map[string]interface{}) error {
+
+	unauthorized := &IngestError{Status: http.StatusUnauthorized, Message: "invalid or missing write key"}
+
+	writeKeys := activeWriteKeys(configRecord)
+	if len(writeKeys) == 0 {
+		if requireWriteKey, _ := strconv.ParseBool(GetEnv("REQUIRE_WRITE_KEY", "false")); requireWriteKey {
+			return unauthorized
+		}
+		return nil
+	}
+
+	writeKey := eventWriteKey(credentials, message)
+	var secret string
+	var found bool
+	for key, keySecret := range writeKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(writeKey)) == 1 {
+			secret = keySecret
+			found = true
+		}
+	}
+	if !found {
+		return unauthorized
+	}
+
+	requireSignature, _ := configRecord["require_signature"].(bool)
+	if requireSignature || credentials.Signature != "" {
+		if !verifySignature(credentials, secret) {
+			return &IngestError{Status: http.StatusUnauthorized, Message: "invalid request signature"}
+		}
+	}
+
+	return nil
+}
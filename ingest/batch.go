@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//outcome of a single event within a batch, returned to the caller in request order
+type EventResult struct {
+	Index    int    `json:"index"`
+	EventId  string `json:"event_id,omitempty"`
+	Accepted bool   `json:"accepted"`
+	Status   int    `json:"status"`
+	Error    string `json:"error,omitempty"`
+}
+
+type BatchResponse struct {
+	Accepted int           `json:"accepted"`
+	Rejected int           `json:"rejected"`
+	Results  []EventResult `json:"results"`
+}
+
+//upper limit for the (decompressed) size of a batch request body
+func maxBatchBytes() int64 {
+	limit, err := strconv.ParseInt(GetEnv("BATCH_MAX_BYTES", "10485760"), 10, 64)
+	if err != nil || limit <= 0 {
+		return 10485760 //10 MB
+	}
+	return limit
+}
+
+//splits a batch body into raw events
+//body can either be a JSON array of events or newline-delimited JSON (one event per line)
+func splitBatch(body []byte) ([]json.RawMessage, error) {
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, errors.New("empty batch")
+	}
+
+	if trimmed[0] == '[' { //JSON array
+		var events []json.RawMessage
+		if err := json.Unmarshal(trimmed, &events); err != nil {
+			return nil, err
+		}
+		return events, nil
+	}
+
+	//NDJSON, blank lines are ignored
+	events := make([]json.RawMessage, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(trimmed))
+	scanner.Buffer(make([]byte, 64*1024), len(trimmed)+1)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		event := make(json.RawMessage, len(line))
+		copy(event, line)
+		events = append(events, event)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+//reads the request body, transparently decompressing gzip-encoded batches
+func readBatchBody(wrt http.ResponseWriter, req *http.Request) ([]byte, error) {
+
+	limit := maxBatchBytes()
+	var reader io.Reader = http.MaxBytesReader(wrt, req.Body, limit)
+
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gzipReader.Close()
+		reader = gzipReader
+	}
+
+	//guard against compressed bodies expanding beyond the limit
+	body, err := ioutil.ReadAll(io.LimitReader(reader, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errors.New("batch exceeds " + strconv.FormatInt(limit, 10) + " bytes")
+	}
+
+	return body, nil
+}
+
+//normalizes a single event before it is resolved against the stream configurations
+type eventNormalizer func(message map[string]interface{}) error
+
+//resolves and publishes a list of raw events, every event independently
+//returns a result per event and whether Kafka failed to take any of them
+func ingestEvents(events []json.RawMessage, credentials Credentials, normalize eventNormalizer) (BatchResponse, bool) {
+
+	response := BatchResponse{Results: make([]EventResult, 0, len(events))}
+
+	//valid events are written in one go so that they share producer batches
+	kafkaMessages := make([]kafka.Message, 0, len(events))
+	accepted := make([]int, 0, len(events))
+
+	for index, event := range events {
+
+		result := EventResult{Index: index}
+
+		var message map[string]interface{}
+		err := json.Unmarshal(event, &message)
+		if err == nil && message == nil {
+			err = errors.New("event must be a JSON object")
+		}
+		if err == nil && normalize != nil {
+			err = normalize(message)
+		}
+
+		if err != nil {
+			result.Status = statusForError(err)
+			result.Error = "malformed payload: " + err.Error()
+			WriteDeadLetter(event, message, result.Error)
+		} else if kafkaMessage, eventId, err := prepareMessage(message, credentials); err != nil {
+			result.Status = statusForError(err)
+			result.Error = err.Error()
+			if result.Status == http.StatusNotFound {
+				WriteDeadLetter(event, message, result.Error)
+			}
+		} else {
+			kafkaMessages = append(kafkaMessages, kafkaMessage)
+			accepted = append(accepted, len(response.Results))
+			result.EventId = eventId
+			result.Accepted = true
+			result.Status = http.StatusAccepted
+		}
+
+		if result.Accepted {
+			response.Accepted++
+		} else {
+			response.Rejected++
+		}
+		response.Results = append(response.Results, result)
+	}
+
+	kafkaUnavailable := false
+	if len(kafkaMessages) > 0 {
+		//only fails if the events could neither be written nor spooled, which affects all of them
+		if err := DeliverMessages(kafkaMessages...); err != nil {
+			kafkaUnavailable = true
+			for _, index := range accepted {
+				response.Results[index].EventId = ""
+				response.Results[index].Accepted = false
+				response.Results[index].Status = http.StatusServiceUnavailable
+				response.Results[index].Error = "unable to write event, please retry"
+				response.Accepted--
+				response.Rejected++
+			}
+		}
+	}
+
+	return response, kafkaUnavailable
+}
+
+//status for a batch: 202 if at least one event was accepted, otherwise 503 if Kafka
+//was unavailable (the whole batch can be retried) or 400 if every event was invalid
+func batchStatus(wrt http.ResponseWriter, response BatchResponse, kafkaUnavailable bool) int {
+
+	if response.Accepted > 0 {
+		return http.StatusAccepted
+	}
+	if kafkaUnavailable {
+		setRetryAfter(wrt)
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
+
+//handler function for batch ingestion
+//every event in the batch is resolved and published independently and the
+//caller gets back a result per event
+func batchHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		if req.Method != http.MethodPost {
+			writeError(wrt, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		body, err := readBatchBody(wrt, req)
+		if err != nil {
+			log.Println(err)
+			writeError(wrt, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		events, err := splitBatch(body)
+		if err != nil {
+			log.Println(err)
+			writeError(wrt, http.StatusBadRequest, "malformed batch: "+err.Error())
+			return
+		}
+
+		log.Println("Received batch of " + strconv.Itoa(len(events)) + " events")
+
+		//credentials and signature cover the whole batch
+		response, kafkaUnavailable := ingestEvents(events, requestCredentials(req, body), nil)
+
+		writeJSON(wrt, batchStatus(wrt, response, kafkaUnavailable), response)
+	})
+}
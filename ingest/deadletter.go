@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//record put on the dead-letter topic for every event that cannot be delivered
+//the original bytes are kept as received so that the event can be replayed
+type DeadLetter struct {
+	StreamId    string `json:"stream_id,omitempty"`
+	StreamAltId string `json:"stream_alt_id,omitempty"`
+	Stage       string `json:"stage"`
+	Reason      string `json:"reason"`
+	Timestamp   string `json:"timestamp"`
+	Original    []byte `json:"original"`
+}
+
+//dead-letter topic, drained into per-stream quarantine tables by the ingester
+func deadLetterTopic() string {
+	return GetEnv("DEAD_LETTER_TOPIC", "rtdl-dead-letter")
+}
+
+//utility method to put an undeliverable event on the dead-letter topic
+//stream ids are taken from the event if it could be parsed at all
+func WriteDeadLetter(original []byte, message map[string]interface{}, reason string) {
+
+	deadLetter := DeadLetter{
+		Stage:     "ingest",
+		Reason:    reason,
+		Timestamp: time.Now().UTC().Format(time.RFC3339Nano),
+		Original:  original,
+	}
+	deadLetter.StreamId, _ = message["stream_id"].(string)
+	deadLetter.StreamAltId, _ = message["stream_alt_id"].(string)
+
+	key := deadLetter.StreamId
+	if key == "" {
+		key = deadLetter.StreamAltId
+	}
+
+	body, err := json.Marshal(deadLetter)
+	if err != nil {
+		log.Println("Unable to create dead letter", err)
+		return
+	}
+
+	err = DeliverMessages(kafka.Message{Topic: deadLetterTopic(), Key: []byte(key), Value: body})
+	if err != nil {
+		log.Println("Unable to write dead letter", err)
+		return
+	}
+
+	incrementCounter("events_dead_lettered", key)
+}
@@ -2,10 +2,14 @@ module rtdl/ingest-service
 
 go 1.17
 
-require github.com/segmentio/kafka-go v0.4.25
+require (
+	github.com/creamdog/gonfig v0.0.0-20160810132730-80d86bfb5a37
+	github.com/google/uuid v1.3.0
+	github.com/segmentio/kafka-go v0.4.25
+	rtdl/spool v0.0.0-00010101000000-000000000000
+)
 
 require (
-	github.com/creamdog/gonfig v0.0.0-20160810132730-80d86bfb5a37 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
 	github.com/google/go-cmp v0.5.5 // indirect
@@ -14,3 +18,5 @@ require (
 	github.com/stretchr/testify v1.7.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 )
+
+replace rtdl/spool => ../spool
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
@@ -9,15 +8,19 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 	"github.com/creamdog/gonfig"
+	"github.com/google/uuid"
 
 	kafka "github.com/segmentio/kafka-go"
 )
 
 type OutgoingMessage struct {
+	EventId     string                 `json:"event_id,omitempty"`
 	StreamId    string                 `json:"stream_id,omitempty"`
 	StreamAltId string                 `json:"stream_alt_id,omitempty"`
 	MessageType string                 `json:"message_type,omitempty"`
@@ -113,43 +116,125 @@ func LoadConfig() error {
 
 }
 
-//utility method for Kafka message writing
-func WriteKafkaMessage(kafkaURL string, topic string,body []byte) {
-	// to produce messages
-	partition := 0
+//finds the stream configuration an incoming event belongs to
+//stream_alt_id takes precedence over stream_id, same as in the ingester
+func findMatchingConfig(message map[string]interface{}) map[string]interface{} {
 
-	if topic != "" {
-		fmt.Println("Topic: ", topic)
+	for _, configRecord := range streamConfigs {
+
+		if message["stream_alt_id"] != nil && message["stream_alt_id"] != "" { //use stream_alt_id
+
+			if configRecord["stream_alt_id"] == message["stream_alt_id"] {
+				return configRecord
+			}
 
-		conn, err := kafka.DialLeader(context.Background(), "tcp", kafkaURL, topic, partition)
-		if err != nil {
-			log.Fatal("failed to dial leader:", err)
 		}
 
-		conn.SetWriteDeadline(time.Now().Add(10 * time.Second)) //10 seconds timeout
-		_, err = conn.WriteMessages(
-			kafka.Message{
-				Key:   []byte("message"),
-				Value: body,
-			},
-		)
-		if err != nil {
-			log.Fatal("failed to write messages:", err)
+		if message["stream_id"] != nil && message["stream_id"] != "" {
+			if configRecord["stream_id"] == message["stream_id"] {
+				return configRecord
+			}
+
 		}
 
-		if err := conn.Close(); err != nil {
-			log.Fatal("failed to close writer:", err)
+	}
+
+	return nil
+}
+
+//streams are active unless explicitly deactivated through the config service
+func isStreamActive(configRecord map[string]interface{}) bool {
+	active, found := configRecord["active"].(bool)
+	return !found || active
+}
+
+//wraps a single event in an OutgoingMessage and figures out the topic it has to be written to
+//every event gets a generated event_id which is handed back to the caller as acknowledgement
+//events are only accepted if the credentials are valid for the stream they belong to
+func prepareMessage(message map[string]interface{}, credentials Credentials) (kafka.Message, string, error) {
+
+	outgoingMessage := new(OutgoingMessage)
+	outgoingMessage.EventId = uuid.New().String()
+
+	//Segment's messageId already uniquely identifies the event
+	if messageId, ok := message["messageId"].(string); ok && messageId != "" {
+		outgoingMessage.EventId = messageId
+	}
+
+	//first need to study message to check if it has stream_id or writeKey. one is necessary
+	if message["projectId"] == nil {
+		if writeKey, ok := message["writeKey"].(string); ok {
+
+			outgoingMessage.StreamAltId = writeKey //put writKey to stream_alt_id
 		}
 
-		fmt.Println("message written")
+	} else if projectId, ok := message["projectId"].(string); ok {
+
+		outgoingMessage.StreamAltId = projectId //put projectId to stream_alt_id
+
+	}
+
+	if streamId, ok := message["stream_id"].(string); ok {
+
+		outgoingMessage.StreamId = streamId
 	}
-	
+
+	if messageType, ok := message["type"].(string); ok { //use type from message
+
+		outgoingMessage.MessageType = messageType
+
+	}
+
+	//finally put the original message inside payload
+	outgoingMessage.Payload = message
+
+	//now figure out the topic
+	matchingConfig := findMatchingConfig(message)
+	if matchingConfig == nil {
+		//events identified only by their write key
+		matchingConfig = findConfigByWriteKey(eventWriteKey(credentials, message))
+		if matchingConfig == nil {
+			return kafka.Message{}, "", &IngestError{Status: http.StatusNotFound, Message: "no stream configuration found for event"}
+		}
+		if outgoingMessage.StreamId == "" {
+			outgoingMessage.StreamId, _ = matchingConfig["stream_id"].(string)
+		}
+	}
+
+	if err := authenticate(matchingConfig, credentials, message); err != nil {
+		return kafka.Message{}, "", err
+	}
+
+	if !isStreamActive(matchingConfig) {
+		streamId, _ := matchingConfig["stream_id"].(string)
+		incrementCounter("events_rejected_inactive", streamId)
+		return kafka.Message{}, "", &IngestError{Status: http.StatusForbidden, Message: "stream `" + streamId + "` is inactive"}
+	}
+
+	//and create json
+	body, err := json.Marshal(outgoingMessage)
+	if err != nil {
+		return kafka.Message{}, "", err
+	}
+
+	var topic string
+	if matchingConfig["functions"] != nil && fmt.Sprint(matchingConfig["functions"]) != "" {
+		//parse sequence into string array
+		functions := strings.Split(fmt.Sprint(matchingConfig["functions"]), ",")
+		//next need to sanitize the sequence to avoid repeats
+		functions = removeDuplicateStr(functions)
+		topic = functions[0] + "-ingress"
+	} else {
+		topic = "ingester-ingress" //default flow
+	}
+
+	return kafka.Message{Topic: topic, Key: []byte(streamKey(outgoingMessage)), Value: body}, outgoingMessage.EventId, nil
 }
 
 //handler function for incoming REST calls
 //based on processingType - either payload is passed on as-is to Kafka or
-//specific message, asking stateful function to reload configuration cache, is put on Kafka
-func producerHandler(kafkaURL string, topic string, processingType string) func(http.ResponseWriter, *http.Request) {
+//specific message, asking stateful function to reload configuration cache or write out buffered rows, is put on Kafka
+func producerHandler(processingType string) func(http.ResponseWriter, *http.Request) {
 	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
 
 		var body []byte
@@ -160,120 +245,75 @@ func producerHandler(kafkaURL string, topic string, processingType string) func(
 			body, err = ioutil.ReadAll(req.Body)
 			if err != nil {
 				log.Println(err)
+				writeError(wrt, http.StatusBadRequest, err.Error())
 				return
 			}
 
 			log.Println("Received : ", string(body))
-			outgoingMessage := new(OutgoingMessage)
 
-			//first need to study message to check if it has stream_id or writeKey. one is necessary
 			var message map[string]interface{}
 
 			err2 := json.Unmarshal(body, &message)
 
 			if err2 != nil {
 				log.Println(err2)
+				WriteDeadLetter(body, message, "malformed payload: "+err2.Error())
+				writeError(wrt, http.StatusBadRequest, "malformed payload: "+err2.Error())
 				return
 			}
 
-			if message["projectId"] == nil {
-				if message["writeKey"] != nil { //no writeKey
-
-					outgoingMessage.StreamAltId = message["writeKey"].(string) //put writKey to stream_alt_id
+			kafkaMessage, eventId, err := prepareMessage(message, requestCredentials(req, body))
+			if err != nil {
+				log.Println(err)
+				//unknown streams are kept so that the events can be replayed once the stream exists
+				if statusForError(err) == http.StatusNotFound {
+					WriteDeadLetter(body, message, err.Error())
 				}
-
-			} else {
-
-				outgoingMessage.StreamAltId = message["projectId"].(string) //put projectId to stream_alt_id
-
-			}
-
-			if message["stream_id"] != nil { //no stream_id
-
-				outgoingMessage.StreamId = message["stream_id"].(string)
-			}
-
-			if message["type"] != nil { //use type from message
-
-				outgoingMessage.MessageType = message["type"].(string)
-
+				writeError(wrt, statusForError(err), err.Error())
+				return
 			}
 
-			//finally put the original message inside payload
-			outgoingMessage.Payload = message
-
-			//and create json
-			body, err = json.Marshal(outgoingMessage)
-
+			//only acknowledge once Kafka (or the local spool) has the event
+			err = DeliverMessages(kafkaMessage)
 			if err != nil {
-
-				log.Println(err)
-
+				writeError(wrt, http.StatusServiceUnavailable, "unable to write event, please retry")
+				return
 			}
 
-			log.Println(len(streamConfigs))
-			//now figure out the topic
-			var matchingConfig map[string]interface{}
-
-			//first retrieve relevant destination information from config array
-
-			for _, configRecord := range streamConfigs {
-
-
-				if message["stream_alt_id"] != nil && message["stream_alt_id"] != "" { //use stream_alt_id
-
-					if configRecord["stream_alt_id"] == message["stream_alt_id"] {
-						matchingConfig = configRecord
-						break
+			writeJSON(wrt, http.StatusAccepted, AcceptedResponse{EventId: eventId})
 
-					}
+		} else if processingType == "flush-buffers" { //write out rows buffered by the ingester
 
-				}
-
-				if message["stream_id"] != nil && message["stream_id"] != "" {
-					if configRecord["stream_id"] == message["stream_id"] {
-						matchingConfig = configRecord
-						break
-
-					}
-
-				}
-
-			}
-
-			if matchingConfig != nil {
-				if matchingConfig["functions"] != nil && fmt.Sprint(matchingConfig["functions"]) != "" {
-					//parse sequence into string array
-					functions := strings.Split(fmt.Sprint(matchingConfig["functions"]), ",")
-					//next need to sanitize the sequence to avoid repeats
-					functions = removeDuplicateStr(functions)
-					topic = functions[0] + "-ingress"
-				} else {
-					topic = "ingester-ingress" //default flow
-				}
+			body = []byte(`{"stream_id":"","message_type":"rtdl_206","payload":{}}`)
 
-				WriteKafkaMessage(kafkaURL, topic, body)
-	
+			err := DeliverMessages(kafka.Message{Topic: "ingester-ingress", Key: []byte(controlMessageKey), Value: body})
+			if err != nil {
+				writeError(wrt, http.StatusServiceUnavailable, "unable to notify ingester, please retry")
+				return
 			}
 
-
 		} else { //cache refresh request
 
 			err := LoadConfig()
 
 			if err != nil {
-				log.Fatal("Unable to load configuration ", err)
+				log.Println("Unable to load configuration ", err)
+				writeError(wrt, http.StatusInternalServerError, "unable to load configuration")
+				return
 			}
 
 			body = []byte(`{"stream_id":"","message_type":"rtdl_205","payload":{}}`)
 
 			//cache refresh request to all functions
 			for _, function := range allFunctions {
-				WriteKafkaMessage(kafkaURL, function + "-ingress", body)
+				err = DeliverMessages(kafka.Message{Topic: function + "-ingress", Key: []byte(controlMessageKey), Value: body})
+				if err != nil {
+					writeError(wrt, http.StatusServiceUnavailable, "unable to notify "+function+", please retry")
+					return
+				}
 			}
 
 		}
-	
 
 	})
 }
@@ -308,16 +348,43 @@ func main() {
 	}
 	// get kafka writer using environment variables.
 	kafkaURL := os.Getenv("KAFKA_URL")
-	//topic := os.Getenv("KAFKA_TOPIC")
-
-	topic := ""
+	producer = NewProducer(kafkaURL)
 
-	//defer kafkaWriter.Close()
+	//events are spooled to disk while Kafka is unavailable and replayed once it is back
+	messageSpool, err = OpenSpool(GetEnv("SPOOL_DIR", "spool"), int64(GetEnvInt("SPOOL_MAX_BYTES", 1073741824)))
+	if err != nil {
+		log.Fatal("Unable to open spool ", err)
+	}
+	go messageSpool.Replay()
+
+	//flush whatever the producer still holds before going down
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		if err := producer.Close(); err != nil {
+			log.Println("failed to close writer:", err)
+		}
+		os.Exit(0)
+	}()
 
 	// Add handle func for producer.
-	http.HandleFunc("/ingest", producerHandler(kafkaURL, topic, "ingest"))
+	http.HandleFunc("/ingest", producerHandler("ingest"))
 
-	http.HandleFunc("/refreshCache", producerHandler(kafkaURL, topic, "refresh-cache"))
+	http.HandleFunc("/ingestBatch", batchHandler())
+
+	http.HandleFunc("/refreshCache", producerHandler("refresh-cache"))
+
+	http.HandleFunc("/flushBuffers", producerHandler("flush-buffers"))
+
+	http.HandleFunc("/metrics", metricsHandler())
+
+	// Segment compatible tracking API
+	for _, callType := range []string{"track", "identify", "page", "screen", "group", "alias"} {
+		http.HandleFunc("/v1/"+callType, segmentHandler(callType))
+	}
+	http.HandleFunc("/v1/batch", segmentHandler(""))
+	http.HandleFunc("/v1/import", segmentHandler(""))
 
 	// Run the web server.
 	log.Fatal(http.ListenAndServe(":"+GetEnv("LISTENER_PORT", "8080"), nil))
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+//in-process counters, per stream, exposed as JSON on /metrics
+var metrics = struct {
+	sync.Mutex
+	counters map[string]map[string]int64
+}{counters: make(map[string]map[string]int64)}
+
+//utility method to increment the counter `name` of a stream
+func incrementCounter(name string, streamId string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if metrics.counters[name] == nil {
+		metrics.counters[name] = make(map[string]int64)
+	}
+	metrics.counters[name][streamId]++
+}
+
+//handler function for the metrics view
+func metricsHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		metrics.Lock()
+		defer metrics.Unlock()
+
+		view := map[string]interface{}{"counters": metrics.counters}
+		if messageSpool != nil {
+			view["spool"] = messageSpool.Stats()
+		}
+
+		writeJSON(wrt, http.StatusOK, view)
+	})
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//key used for control messages such as cache refresh requests
+const controlMessageKey = "rtdl_control"
+
+//shared, long-lived Kafka producer
+//kafka.Writer is safe for concurrent use, messages written by concurrent requests are batched together
+var producer *kafka.Writer
+
+//GetEnvInt get key environment variable as an int if exist and valid otherwise return defaultValue
+func GetEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(GetEnv(key, ""))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+//maps KAFKA_ACKS to the kafka-go setting, defaults to waiting for all in-sync replicas
+func getRequiredAcks(acks string) kafka.RequiredAcks {
+	switch strings.ToLower(acks) {
+	case "0", "none":
+		return kafka.RequireNone
+	case "1", "one", "leader":
+		return kafka.RequireOne
+	}
+	return kafka.RequireAll
+}
+
+//maps KAFKA_COMPRESSION to the kafka-go codec, no compression if blank or unknown
+func getCompression(compression string) kafka.Compression {
+	switch strings.ToLower(compression) {
+	case "gzip":
+		return kafka.Gzip
+	case "snappy":
+		return kafka.Snappy
+	case "lz4":
+		return kafka.Lz4
+	case "zstd":
+		return kafka.Zstd
+	}
+	return 0
+}
+
+//creates the Kafka producer using environment variables
+//messages are partitioned by key with the same murmur2 hashing the Java clients use,
+//so every stream always lands on the same partition and keeps its order
+//this kafka-go version always asks the broker to create missing topics, which Redpanda only does with
+//auto_create_topics_enabled - the init compose file creates the topics of the default flow up front
+//requests wait for their write, attempts and timeout are kept short so that they are spooled soon once Kafka is down
+func NewProducer(kafkaURL string) *kafka.Writer {
+
+	return &kafka.Writer{
+		Addr:         kafka.TCP(strings.Split(kafkaURL, ",")...),
+		Balancer:     &kafka.Murmur2Balancer{},
+		BatchSize:    GetEnvInt("KAFKA_BATCH_SIZE", 100),
+		BatchBytes:   int64(GetEnvInt("KAFKA_BATCH_BYTES", 1048576)),
+		BatchTimeout: time.Duration(GetEnvInt("KAFKA_LINGER_MS", 10)) * time.Millisecond,
+		WriteTimeout: time.Duration(GetEnvInt("KAFKA_WRITE_TIMEOUT_MS", 2000)) * time.Millisecond,
+		MaxAttempts:  GetEnvInt("KAFKA_MAX_ATTEMPTS", 3),
+		RequiredAcks: getRequiredAcks(GetEnv("KAFKA_ACKS", "all")),
+		Compression:  getCompression(GetEnv("KAFKA_COMPRESSION", "")),
+	}
+}
+
+//key for partitioning, events of a stream share the key so that their order is kept
+func streamKey(outgoingMessage *OutgoingMessage) string {
+	if outgoingMessage.StreamId != "" {
+		return outgoingMessage.StreamId
+	}
+	if outgoingMessage.StreamAltId != "" {
+		return outgoingMessage.StreamAltId
+	}
+	return "message"
+}
+
+//utility method for Kafka message writing
+//blocks until the batch containing the messages has been acknowledged
+func WriteKafkaMessage(messages ...kafka.Message) error {
+
+	err := producer.WriteMessages(context.Background(), messages...)
+	if err != nil {
+		log.Println("failed to write messages:", err)
+		return err
+	}
+
+	return nil
+}
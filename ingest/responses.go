@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+//error carrying the HTTP status it should be reported with
+type IngestError struct {
+	Status  int
+	Message string
+}
+
+func (err *IngestError) Error() string {
+	return err.Message
+}
+
+//status to report for an error, anything not explicitly classified is the client's fault
+func statusForError(err error) int {
+	if ingestErr, ok := err.(*IngestError); ok {
+		return ingestErr.Status
+	}
+	return http.StatusBadRequest
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type AcceptedResponse struct {
+	EventId string `json:"event_id"`
+}
+
+//utility method to write a JSON response body with the given status
+func writeJSON(wrt http.ResponseWriter, status int, response interface{}) {
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		log.Println(err)
+		status = http.StatusInternalServerError
+		body = []byte(`{"error":"Internal Server Error"}`)
+	}
+
+	wrt.Header().Set("Content-Type", "application/json")
+	wrt.WriteHeader(status)
+	wrt.Write(body)
+}
+
+//tells clients when to try again after a 503
+func setRetryAfter(wrt http.ResponseWriter) {
+	wrt.Header().Set("Retry-After", strconv.Itoa(GetEnvInt("RETRY_AFTER_SECONDS", 5)))
+}
+
+//utility method to write a JSON error body
+func writeError(wrt http.ResponseWriter, status int, message string) {
+
+	if status == http.StatusServiceUnavailable {
+		setRetryAfter(wrt)
+	}
+
+	writeJSON(wrt, status, ErrorResponse{Error: message})
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+//Segment compatible tracking API (https://segment.com/docs/connections/sources/catalog/libraries/server/http-api/)
+//every call type is stored as its own message type, so track, identify, page etc. end up in separate tables
+
+//fields Segment requires per call type, on top of userId or anonymousId
+var segmentRequiredFields = map[string][]string{
+	"track":    {"event"},
+	"identify": {},
+	"page":     {},
+	"screen":   {},
+	"group":    {"groupId"},
+	"alias":    {"previousId"},
+}
+
+type SegmentBatch struct {
+	Batch        []json.RawMessage      `json:"batch"`
+	Context      map[string]interface{} `json:"context,omitempty"`
+	Integrations map[string]interface{} `json:"integrations,omitempty"`
+	WriteKey     string                 `json:"writeKey,omitempty"`
+}
+
+type SegmentResponse struct {
+	Success bool `json:"success"`
+}
+
+//returns a normalizer that validates an event against the Segment spec for its call type
+//callType is the type implied by the endpoint, blank for batches where each event carries its own
+func segmentNormalizer(callType string, batch *SegmentBatch) eventNormalizer {
+	return func(message map[string]interface{}) error {
+
+		if callType != "" {
+			message["type"] = callType
+		}
+
+		eventType, _ := message["type"].(string)
+		requiredFields, found := segmentRequiredFields[eventType]
+		if !found {
+			return errors.New("unsupported type `" + eventType + "`")
+		}
+
+		userId, _ := message["userId"].(string)
+		anonymousId, _ := message["anonymousId"].(string)
+		if userId == "" && anonymousId == "" && eventType != "alias" {
+			return errors.New("`userId` or `anonymousId` is required")
+		}
+		if eventType == "alias" && userId == "" {
+			return errors.New("`userId` is required")
+		}
+
+		for _, field := range requiredFields {
+			if value, _ := message[field].(string); value == "" {
+				return errors.New("`" + field + "` is required")
+			}
+		}
+
+		//batch level context and integrations apply to every event that doesn't have its own
+		if batch != nil {
+			if _, found := message["context"]; !found && batch.Context != nil {
+				message["context"] = batch.Context
+			}
+			if _, found := message["integrations"]; !found && batch.Integrations != nil {
+				message["integrations"] = batch.Integrations
+			}
+		}
+
+		now := time.Now().UTC().Format(time.RFC3339Nano)
+		message["receivedAt"] = now
+		if _, found := message["timestamp"]; !found {
+			message["timestamp"] = now
+		}
+
+		return nil
+	}
+}
+
+//handler function for the Segment endpoints
+//callType is blank for /v1/batch and /v1/import
+func segmentHandler(callType string) func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		if req.Method != http.MethodPost {
+			writeError(wrt, http.StatusMethodNotAllowed, "Method not allowed")
+			return
+		}
+
+		body, err := readBatchBody(wrt, req)
+		if err != nil {
+			log.Println(err)
+			writeError(wrt, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		credentials := requestCredentials(req, body)
+
+		var events []json.RawMessage
+		var batch *SegmentBatch
+
+		if callType == "" {
+			batch = new(SegmentBatch)
+			if err := json.Unmarshal(body, batch); err != nil {
+				writeError(wrt, http.StatusBadRequest, "malformed batch: "+err.Error())
+				return
+			}
+			if credentials.WriteKey == "" {
+				credentials.WriteKey = batch.WriteKey
+			}
+			events = batch.Batch
+		} else {
+			events = []json.RawMessage{body}
+		}
+
+		if len(events) == 0 {
+			writeError(wrt, http.StatusBadRequest, "empty batch")
+			return
+		}
+
+		response, kafkaUnavailable := ingestEvents(events, credentials, segmentNormalizer(callType, batch))
+
+		if response.Rejected == 0 {
+			writeJSON(wrt, http.StatusOK, SegmentResponse{Success: true})
+			return
+		}
+
+		//single calls are answered like /ingest, batches with the per-event results
+		if callType != "" {
+			result := response.Results[0]
+			writeError(wrt, result.Status, result.Error)
+			return
+		}
+
+		writeJSON(wrt, batchStatus(wrt, response, kafkaUnavailable), response)
+	})
+}
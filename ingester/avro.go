@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+//minimal Avro object container files, as used by the Iceberg manifests
+//schemas are kept as decoded JSON, values are
+//	records and maps - map[string]interface{}
+//	arrays           - []interface{}
+//	int and long     - int64 (int and int32 are accepted as well)
+//	float and double - float64
+//	bytes and fixed  - []byte
+//	enums            - string
+//files are written uncompressed, deflate is understood when reading
+var avroMagic = []byte{'O', 'b', 'j', 1}
+
+//named types of a schema, for references by name
+type avroNames map[string]interface{}
+
+func avroTypeName(schema interface{}) string {
+	switch typedSchema := schema.(type) {
+	case string:
+		return typedSchema
+	case map[string]interface{}:
+		typeName, _ := typedSchema["type"].(string)
+		return typeName
+	case []interface{}:
+		return "union"
+	}
+	return ""
+}
+
+//resolves references to named types, registering named types on the way
+func (names avroNames) resolve(schema interface{}) interface{} {
+
+	switch typedSchema := schema.(type) {
+	case string:
+		if named, found := names[typedSchema]; found {
+			return named
+		}
+	case map[string]interface{}:
+		if name, ok := typedSchema["name"].(string); ok {
+			switch typedSchema["type"] {
+			case "record", "enum", "fixed":
+				names[name] = typedSchema
+			}
+		}
+	}
+
+	return schema
+}
+
+func avroInt(value interface{}) (int64, error) {
+	switch typedValue := value.(type) {
+	case int64:
+		return typedValue, nil
+	case int:
+		return int64(typedValue), nil
+	case int32:
+		return int64(typedValue), nil
+	case float64:
+		return int64(typedValue), nil
+	}
+	return 0, fmt.Errorf("%v is not an Avro int or long", value)
+}
+
+func writeAvroLong(buffer *bytes.Buffer, value int64) {
+	var encoded [binary.MaxVarintLen64]byte
+	buffer.Write(encoded[:binary.PutVarint(encoded[:], value)])
+}
+
+func writeAvroBytes(buffer *bytes.Buffer, value []byte) {
+	writeAvroLong(buffer, int64(len(value)))
+	buffer.Write(value)
+}
+
+//encodes a value with its schema
+func (names avroNames) encode(buffer *bytes.Buffer, schema interface{}, value interface{}) error {
+
+	schema = names.resolve(schema)
+
+	switch avroTypeName(schema) {
+
+	case "null":
+		return nil
+
+	case "boolean":
+		if value == true {
+			buffer.WriteByte(1)
+		} else {
+			buffer.WriteByte(0)
+		}
+		return nil
+
+	case "int", "long":
+		integer, err := avroInt(value)
+		writeAvroLong(buffer, integer)
+		return err
+
+	case "float":
+		number, _ := value.(float64)
+		return binary.Write(buffer, binary.LittleEndian, math.Float32bits(float32(number)))
+
+	case "double":
+		number, _ := value.(float64)
+		return binary.Write(buffer, binary.LittleEndian, math.Float64bits(number))
+
+	case "string":
+		text, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v is not an Avro string", value)
+		}
+		writeAvroBytes(buffer, []byte(text))
+		return nil
+
+	case "bytes":
+		data, _ := value.([]byte)
+		writeAvroBytes(buffer, data)
+		return nil
+
+	case "fixed":
+		data, _ := value.([]byte)
+		buffer.Write(data)
+		return nil
+
+	case "enum":
+		symbols, _ := schema.(map[string]interface{})["symbols"].([]interface{})
+		for index, symbol := range symbols {
+			if symbol == value {
+				writeAvroLong(buffer, int64(index))
+				return nil
+			}
+		}
+		return fmt.Errorf("%v is not a symbol of the Avro enum", value)
+
+	case "union":
+		//the first branch that fits, null only for nil
+		for index, branch := range schema.([]interface{}) {
+			isNull := avroTypeName(names.resolve(branch)) == "null"
+			if isNull != (value == nil) {
+				continue
+			}
+			var encoded bytes.Buffer
+			if err := names.encode(&encoded, branch, value); err != nil {
+				continue
+			}
+			writeAvroLong(buffer, int64(index))
+			buffer.Write(encoded.Bytes())
+			return nil
+		}
+		return fmt.Errorf("%v does not fit any branch of the Avro union", value)
+
+	case "array":
+		items, _ := value.([]interface{})
+		if len(items) > 0 {
+			writeAvroLong(buffer, int64(len(items)))
+			for _, item := range items {
+				if err := names.encode(buffer, schema.(map[string]interface{})["items"], item); err != nil {
+					return err
+				}
+			}
+		}
+		writeAvroLong(buffer, 0)
+		return nil
+
+	case "map":
+		entries, _ := value.(map[string]interface{})
+		if len(entries) > 0 {
+			writeAvroLong(buffer, int64(len(entries)))
+			for key, entry := range entries {
+				writeAvroBytes(buffer, []byte(key))
+				if err := names.encode(buffer, schema.(map[string]interface{})["values"], entry); err != nil {
+					return err
+				}
+			}
+		}
+		writeAvroLong(buffer, 0)
+		return nil
+
+	case "record":
+		record, _ := value.(map[string]interface{})
+		fields, _ := schema.(map[string]interface{})["fields"].([]interface{})
+		for _, fieldEntry := range fields {
+			field, _ := fieldEntry.(map[string]interface{})
+			name, _ := field["name"].(string)
+			if err := names.encode(buffer, field["type"], record[name]); err != nil {
+				return errors.New(name + ": " + err.Error())
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported Avro schema %v", schema)
+}
+
+func readAvroBytes(reader *bufio.Reader) ([]byte, error) {
+
+	length, err := binary.ReadVarint(reader)
+	if err != nil {
+		return nil, err
+	}
+	if length < 0 {
+		return nil, errors.New("negative Avro length")
+	}
+
+	data := make([]byte, length)
+	_, err = io.ReadFull(reader, data)
+	return data, err
+}
+
+//decodes items of arrays and maps, which are written in blocks
+func (names avroNames) decodeBlocks(reader *bufio.Reader, decodeItem func() error) error {
+
+	for {
+		count, err := binary.ReadVarint(reader)
+		if err != nil || count == 0 {
+			return err
+		}
+		if count < 0 {
+			//negative counts are followed by the size of the block
+			count = -count
+			if _, err = binary.ReadVarint(reader); err != nil {
+				return err
+			}
+		}
+		for ; count > 0; count-- {
+			if err = decodeItem(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+//decodes a value written with the schema
+func (names avroNames) decode(reader *bufio.Reader, schema interface{}) (interface{}, error) {
+
+	schema = names.resolve(schema)
+
+	switch avroTypeName(schema) {
+
+	case "null":
+		return nil, nil
+
+	case "boolean":
+		value, err := reader.ReadByte()
+		return value == 1, err
+
+	case "int", "long":
+		return binary.ReadVarint(reader)
+
+	case "float":
+		var bits uint32
+		err := binary.Read(reader, binary.LittleEndian, &bits)
+		return float64(math.Float32frombits(bits)), err
+
+	case "double":
+		var bits uint64
+		err := binary.Read(reader, binary.LittleEndian, &bits)
+		return math.Float64frombits(bits), err
+
+	case "string":
+		data, err := readAvroBytes(reader)
+		return string(data), err
+
+	case "bytes":
+		return readAvroBytes(reader)
+
+	case "fixed":
+		size, _ := schema.(map[string]interface{})["size"].(float64)
+		data := make([]byte, int(size))
+		_, err := io.ReadFull(reader, data)
+		return data, err
+
+	case "enum":
+		index, err := binary.ReadVarint(reader)
+		symbols, _ := schema.(map[string]interface{})["symbols"].([]interface{})
+		if err != nil || index < 0 || int(index) >= len(symbols) {
+			return nil, errors.New("invalid Avro enum value")
+		}
+		return symbols[index], nil
+
+	case "union":
+		index, err := binary.ReadVarint(reader)
+		branches := schema.([]interface{})
+		if err != nil || index < 0 || int(index) >= len(branches) {
+			return nil, errors.New("invalid Avro union branch")
+		}
+		return names.decode(reader, branches[index])
+
+	case "array":
+		items := make([]interface{}, 0)
+		err := names.decodeBlocks(reader, func() error {
+			item, err := names.decode(reader, schema.(map[string]interface{})["items"])
+			items = append(items, item)
+			return err
+		})
+		return items, err
+
+	case "map":
+		entries := make(map[string]interface{})
+		err := names.decodeBlocks(reader, func() error {
+			key, err := readAvroBytes(reader)
+			if err != nil {
+				return err
+			}
+			entries[string(key)], err = names.decode(reader, schema.(map[string]interface{})["values"])
+			return err
+		})
+		return entries, err
+
+	case "record":
+		record := make(map[string]interface{})
+		fields, _ := schema.(map[string]interface{})["fields"].([]interface{})
+		for _, fieldEntry := range fields {
+			field, _ := fieldEntry.(map[string]interface{})
+			name, _ := field["name"].(string)
+			value, err := names.decode(reader, field["type"])
+			if err != nil {
+				return nil, err
+			}
+			record[name] = value
+		}
+		return record, nil
+	}
+
+	return nil, fmt.Errorf("unsupported Avro schema %v", schema)
+}
+
+//encodes records as an Avro object container file with the given file metadata
+func encodeAvroFile(schemaJSON string, metadata map[string]string, records []map[string]interface{}) ([]byte, error) {
+
+	var schema interface{}
+	if err := json.Unmarshal([]byte(schemaJSON), &schema); err != nil {
+		return nil, err
+	}
+
+	var file bytes.Buffer
+	file.Write(avroMagic)
+
+	header := map[string]interface{}{"avro.schema": []byte(schemaJSON), "avro.codec": []byte("null")}
+	for key, value := range metadata {
+		header[key] = []byte(value)
+	}
+	if err := make(avroNames).encode(&file, map[string]interface{}{"type": "map", "values": "bytes"}, header); err != nil {
+		return nil, err
+	}
+
+	sync := make([]byte, 16)
+	rand.Read(sync)
+	file.Write(sync)
+
+	var block bytes.Buffer
+	names := make(avroNames)
+	for _, record := range records {
+		if err := names.encode(&block, schema, record); err != nil {
+			return nil, err
+		}
+	}
+
+	writeAvroLong(&file, int64(len(records)))
+	writeAvroBytes(&file, block.Bytes())
+	file.Write(sync)
+
+	return file.Bytes(), nil
+}
+
+//decodes the records and the file metadata of an Avro object container file
+func decodeAvroFile(data []byte) ([]map[string]interface{}, map[string]string, error) {
+
+	reader := bufio.NewReader(bytes.NewReader(data))
+
+	magic := make([]byte, len(avroMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil || !bytes.Equal(magic, avroMagic) {
+		return nil, nil, errors.New("not an Avro object container file")
+	}
+
+	header, err := make(avroNames).decode(reader, map[string]interface{}{"type": "map", "values": "bytes"})
+	if err != nil {
+		return nil, nil, err
+	}
+	metadata := make(map[string]string)
+	for key, value := range header.(map[string]interface{}) {
+		metadata[key] = string(value.([]byte))
+	}
+
+	var schema interface{}
+	if err = json.Unmarshal([]byte(metadata["avro.schema"]), &schema); err != nil {
+		return nil, nil, err
+	}
+
+	sync := make([]byte, 16)
+	if _, err = io.ReadFull(reader, sync); err != nil {
+		return nil, nil, err
+	}
+
+	records := make([]map[string]interface{}, 0)
+	names := make(avroNames)
+	for {
+		count, err := binary.ReadVarint(reader)
+		if err == io.EOF {
+			return records, metadata, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		block, err := readAvroBytes(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		switch metadata["avro.codec"] {
+		case "", "null":
+		case "deflate":
+			if block, err = ioutil.ReadAll(flate.NewReader(bytes.NewReader(block))); err != nil {
+				return nil, nil, err
+			}
+		default:
+			return nil, nil, errors.New("unsupported Avro codec " + metadata["avro.codec"])
+		}
+
+		blockReader := bufio.NewReader(bytes.NewReader(block))
+		for ; count > 0; count-- {
+			record, err := names.decode(blockReader, schema)
+			if err != nil {
+				return nil, nil, err
+			}
+			recordMap, _ := record.(map[string]interface{})
+			records = append(records, recordMap)
+		}
+
+		blockSync := make([]byte, 16)
+		if _, err = io.ReadFull(reader, blockSync); err != nil || !bytes.Equal(blockSync, sync) {
+			return nil, nil, errors.New("invalid Avro sync marker")
+		}
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/flink-statefun/statefun-sdk-go/v3/pkg/statefun"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//rows are buffered per stream, message type and partition and written to a single Parquet file
+//once the buffer reaches batch_max_rows, batch_max_bytes or batch_max_age_seconds of its stream
+//the schema of the file is inferred from all rows of the buffer and checked against the schema registry
+//buffers are kept in the StateFun state of their stream key, Flink checkpoints them together with the offsets of
+//the ingress so that no buffered row is lost when the ingester goes down, and an invocation that fails leaves them
+//as they were - the state only points to the rows, which are kept in a spill file (see spill.go)
+//buffers past their age are noticed on a delayed message the function sends itself (rtdl_207), which writes a flush
+//marker (rtdl_206) for the stream key to the ingress topic, a buffer only ever ends on a message of the ingress so
+//that a replay after a failure cuts the same files again
+//a buffer that ends is sealed and written by a background job, the delayed message follows up on the job and
+//removes the buffer once it is written
+//the rtdl_206 control message without a stream writes out the buffers of all streams
+type rowBuffer struct {
+	MessageType    string                 `json:"message_type"`
+	SubFolderName  string                 `json:"sub_folder_name"`
+	ConfigRecord   map[string]interface{} `json:"config_record"` //configuration the rows were buffered under
+	Key            string                 `json:"key"`           //key of the buffer while rows are added to it
+	Spill          string                 `json:"spill"`         //spill file of the rows, kept as received to dead-letter them should the write fail
+	SpillBytes     int64                  `json:"spill_bytes"`
+	Sealed         bool                   `json:"sealed"` //no more rows are added, the buffer is being written
+	Rows           int                    `json:"rows"`
+	Bytes          int                    `json:"bytes"`
+	LateRows       int                    `json:"late_rows"`  //rows past the watermark, written to their partition under the notify policy
+	CreatedAt      int64                  `json:"created_at"` //unix milliseconds
+	StreamKey      string                 `json:"stream_key"`
+	SequenceEpoch  int64                  `json:"sequence_epoch"`
+	KafkaPartition int64                  `json:"kafka_partition"`
+	Writer         string                 `json:"writer"`
+	FirstSequence  int64                  `json:"first_sequence"` //lowest and highest number of the rows, 0 if they are not numbered
+	LastSequence   int64                  `json:"last_sequence"`
+}
+
+//buffers of a stream key by stream, epoch, message type, partition and configuration
+type rowBuffers map[string]*rowBuffer
+
+var (
+	RowBuffersType = statefun.MakeJsonType(statefun.TypeNameFrom("com.rtdl.sf/RowBuffers"))
+	RowBuffersSpec = statefun.ValueSpec{
+		Name:      "row_buffers",
+		ValueType: RowBuffersType,
+	}
+	//unix milliseconds the pending delayed flush message of the stream key is due at
+	FlushDueSpec = statefun.ValueSpec{
+		Name:      "flush_due",
+		ValueType: statefun.Int64Type,
+	}
+)
+
+//message type of the delayed message asking for the buffers of a stream key that reached their maximum age to be written
+const flushTimerMessageType = "rtdl_207"
+
+//a flush marker of a stream key is written again after this many milliseconds if Kafka did not take it
+const flushMarkerRetryMs = 10000
+
+//milliseconds between looks at the background write of a sealed buffer
+func bufferPollMs() int64 {
+	return int64(GetEnvInt("BUFFER_POLL_MS", 1000))
+}
+
+//batch threshold of a stream, falls back to the environment variable and then to defaultValue
+func batchThreshold(configRecord map[string]interface{}, field string, envKey string, defaultValue int) int {
+	if value, ok := configRecord[field].(float64); ok && value > 0 {
+		return int(value)
+	}
+	return GetEnvInt(envKey, defaultValue)
+}
+
+func batchMaxRows(configRecord map[string]interface{}) int {
+	return batchThreshold(configRecord, "batch_max_rows", "BATCH_MAX_ROWS", 10000)
+}
+
+func batchMaxBytes(configRecord map[string]interface{}) int {
+	return batchThreshold(configRecord, "batch_max_bytes", "BATCH_MAX_BYTES", 33554432) //32 MB
+}
+
+func batchMaxAge(configRecord map[string]interface{}) time.Duration {
+	return time.Duration(batchThreshold(configRecord, "batch_max_age_seconds", "BATCH_MAX_AGE_SECONDS", 60)) * time.Second
+}
+
+//buffers of the stream key of the function
+func loadRowBuffers(storage statefun.AddressScopedStorage) rowBuffers {
+
+	buffers := make(rowBuffers)
+	storage.Get(RowBuffersSpec, &buffers)
+
+	return buffers
+}
+
+//size of a row as it is counted against batch_max_bytes
+func rowSize(request IncomingMessage) int {
+
+	payload, _ := json.Marshal(request.Payload)
+
+	return len(payload)
+}
+
+//adds a row to its buffer, the buffer is sealed once it is full
+//an error means the row could not be spilled, the invocation has to fail so that it is retried
+func bufferRow(ctx statefun.Context, request IncomingMessage, sequence messageSequence, messageType string, subFolderName string, size int, late bool, configRecord map[string]interface{}) error {
+
+	//rows buffered under an earlier configuration are written with it once their buffer is due
+	config, _ := json.Marshal(configRecord)
+	configHash := fnv.New32a()
+	configHash.Write(config)
+
+	//the rows of a buffer are numbered by a single stream key, so that the numbers name the file
+	key := fmt.Sprintf("%v|%d|%s|%s|%08x", configRecord["stream_id"], sequence.epoch, messageType, subFolderName, configHash.Sum32())
+
+	buffers := loadRowBuffers(ctx.Storage())
+
+	buffer := buffers[key]
+	if buffer == nil {
+		buffer = &rowBuffer{
+			MessageType:    messageType,
+			SubFolderName:  subFolderName,
+			ConfigRecord:   configRecord,
+			Key:            key,
+			Spill:          spillName(streamKey(request), key, sequence),
+			CreatedAt:      time.Now().UnixNano() / int64(time.Millisecond),
+			StreamKey:      streamKey(request),
+			SequenceEpoch:  sequence.epoch,
+			KafkaPartition: sequence.partition,
+			Writer:         sequence.writer,
+			FirstSequence:  sequence.number,
+		}
+		buffers[key] = buffer
+		scheduleFlush(ctx, buffer.dueAt())
+	}
+
+	if err := appendSpill(buffer, request); err != nil {
+		return err
+	}
+	buffer.Rows++
+	buffer.LastSequence = sequence.number
+	buffer.Bytes += size
+	if late {
+		buffer.LateRows++
+	}
+
+	if buffer.Rows >= batchMaxRows(configRecord) || buffer.Bytes >= batchMaxBytes(configRecord) {
+		buffers.seal(ctx, key)
+	}
+
+	ctx.Storage().Set(RowBuffersSpec, buffers)
+	return nil
+}
+
+//moves a buffer out of the way of new rows, its write is started by the delayed message scheduled for it, once the
+//state that seals it is saved
+func (buffers rowBuffers) seal(ctx statefun.Context, key string) {
+
+	buffer := buffers[key]
+	delete(buffers, key)
+
+	buffer.Sealed = true
+	buffers["sealed|"+buffer.Spill] = buffer
+
+	scheduleFlush(ctx, time.Now().UnixNano()/int64(time.Millisecond))
+}
+
+//unix milliseconds the buffer reaches its maximum age at
+func (buffer *rowBuffer) dueAt() int64 {
+	return buffer.CreatedAt + int64(batchMaxAge(buffer.ConfigRecord)/time.Millisecond)
+}
+
+//name of the file of a buffer, the same rows always end up in a file of the same name
+func (buffer *rowBuffer) fileName() string {
+
+	if buffer.FirstSequence == 0 {
+		return generateLeafLevelFileName()
+	}
+
+	sequence := messageSequence{epoch: buffer.SequenceEpoch, partition: buffer.KafkaPartition, writer: buffer.Writer}
+
+	return sequencedFileName(buffer.StreamKey, sequence, buffer.FirstSequence, buffer.LastSequence)
+}
+
+//keeps the rows of a written buffer that could neither be written nor dead-lettered, they are tried again once
+//the buffer they are moved to is due - that buffer is named by time, as its rows are no longer numbered in a row
+func (buffers rowBuffers) keepPending(ctx statefun.Context, buffer *rowBuffer, pending []IncomingMessage) error {
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	retryKey := strings.TrimSuffix(buffer.Key, "|retry") + "|retry"
+	retry := buffers[retryKey]
+	if retry == nil {
+		retry = &rowBuffer{
+			MessageType:   buffer.MessageType,
+			SubFolderName: buffer.SubFolderName,
+			ConfigRecord:  buffer.ConfigRecord,
+			Key:           retryKey,
+			Spill:         spillName(buffer.StreamKey, retryKey, messageSequence{}),
+			CreatedAt:     time.Now().UnixNano() / int64(time.Millisecond),
+			StreamKey:     buffer.StreamKey,
+		}
+		buffers[retryKey] = retry
+		scheduleFlush(ctx, retry.dueAt())
+	}
+
+	if err := appendSpill(retry, pending...); err != nil {
+		return err
+	}
+	for _, request := range pending {
+		retry.Rows++
+		retry.Bytes += rowSize(request)
+	}
+
+	return nil
+}
+
+//conforms rows to the schema they are written with
+func encodeRows(schemaNode *schemaNode, requests []IncomingMessage) ([][]byte, error) {
+
+	var err error
+	rows := make([][]byte, len(requests))
+	for index, request := range requests {
+		if rows[index], err = schemaNode.ConformRow(request.Payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return rows, nil
+}
+
+//dead-letters a row that could not be written
+func deadLetterRow(request IncomingMessage, streamId string, stage string, reason string) error {
+
+	//quarantine rows come from the dead-letter topic, they go back there as they were
+	if request.MessageType == quarantineMessageType {
+		if stage == "schema" {
+			//the quarantine schema does not change, a rejected row would be rejected again
+			incrementCounter("events_quarantine_failed", streamId)
+			return nil
+		}
+		incrementCounter("events_quarantine_requeued", streamId)
+		return requeueQuarantineRow(request)
+	}
+
+	return deadLetterRequest(request, stage, reason)
+}
+
+//writes the rows of a buffer to a single file, called by the background job of the buffer
+//rows are checked against the schema registry first, rows that are rejected or cannot be written
+//are dead-lettered - rows for which that fails as well are returned, so that they stay buffered
+func flushBuffer(buffer *rowBuffer, requests []IncomingMessage) []IncomingMessage {
+
+	streamId := fmt.Sprint(buffer.ConfigRecord["stream_id"])
+	pending := make([]IncomingMessage, 0)
+
+	schemaNode, accepted, rejected, err := RegisterSchema(buffer.ConfigRecord, buffer.MessageType, requests)
+	if err != nil {
+		log.Println("error updating schema registry", err)
+	}
+
+	for _, rejection := range rejected {
+		incrementCounter("events_schema_rejected", streamId)
+		if err := deadLetterRow(rejection.Request, streamId, "schema", rejection.Reason); err != nil {
+			pending = append(pending, rejection.Request)
+		}
+	}
+
+	if len(accepted) == 0 {
+		return pending
+	}
+
+	rows, err := encodeRows(schemaNode, accepted)
+	if err == nil {
+		err = writeRows(buffer.MessageType, buffer.SubFolderName, buffer.fileName(), schemaNode, rows, buffer.ConfigRecord)
+	}
+	if err == nil {
+		addToCounter("rows_written", streamId, int64(len(rows)))
+		incrementCounter("files_written", streamId)
+		if buffer.LateRows > 0 {
+			notifyLateData(streamId, buffer.MessageType, buffer.SubFolderName, buffer.LateRows)
+		}
+		return pending
+	}
+
+	log.Println("error writing Parquet", err)
+	for _, request := range accepted {
+		if err := deadLetterRow(request, streamId, "ingester", "error writing Parquet: "+err.Error()); err != nil {
+			pending = append(pending, request)
+		}
+	}
+
+	if len(pending) > 0 {
+		log.Println("Unable to dead-letter " + strconv.Itoa(len(pending)) + " rows of stream " + streamId + ", they stay buffered")
+	}
+
+	return pending
+}
+
+//seals the buffers of the stream key of the function that hold messages up to through, and buffers of rows that
+//are not numbered, and asks for a delayed flush message for the buffers that are left
+//only called for messages read from the ingress, so that the buffers end at the same message when it is replayed
+func FlushBuffers(ctx statefun.Context, through int64) {
+
+	buffers := loadRowBuffers(ctx.Storage())
+
+	for key, buffer := range buffers {
+		if !buffer.Sealed && buffer.FirstSequence <= through {
+			buffers.seal(ctx, key)
+		}
+	}
+
+	if len(buffers) == 0 {
+		ctx.Storage().Remove(RowBuffersSpec)
+		return
+	}
+
+	due := int64(math.MaxInt64)
+	for _, buffer := range buffers {
+		if !buffer.Sealed && buffer.dueAt() < due {
+			due = buffer.dueAt()
+		}
+	}
+	if due < math.MaxInt64 {
+		scheduleFlush(ctx, due)
+	}
+
+	ctx.Storage().Set(RowBuffersSpec, buffers)
+}
+
+//asks for a delayed flush message at due (unix milliseconds), unless one is pending that is due before
+func scheduleFlush(ctx statefun.Context, due int64) {
+
+	var pending int64
+	if ctx.Storage().Get(FlushDueSpec, &pending) && pending <= due {
+		return
+	}
+	ctx.Storage().Set(FlushDueSpec, due)
+
+	delay := time.Duration(due)*time.Millisecond - time.Duration(time.Now().UnixNano())
+	if delay < 0 {
+		delay = 0
+	}
+
+	ctx.SendAfter(delay, statefun.MessageBuilder{
+		Target:    ctx.Self(),
+		Value:     IncomingMessage{MessageType: flushTimerMessageType, Payload: map[string]interface{}{"due": float64(due)}},
+		ValueType: IncomingMessageType,
+	})
+}
+
+//writes a flush marker for a stream key to the ingress topic, the marker is read in order with the messages of the
+//stream key - through is the highest message number whose buffer is written, all buffers if it is left out
+func writeFlushMarker(streamKey string, through int64) error {
+
+	payload := map[string]interface{}{}
+	if through < math.MaxInt64 {
+		payload["through"] = float64(through)
+	}
+
+	body, err := json.Marshal(IncomingMessage{StreamId: streamKey, MessageType: "rtdl_206", Payload: payload})
+	if err != nil {
+		return err
+	}
+
+	return WriteKafkaMessage(kafka.Message{Topic: ingressTopic(), Key: []byte(streamKey), Value: body})
+}
+
+//handles a delayed flush message, the flush the message was sent for is no longer pending
+//sealed buffers are removed once they are written, the rows that are left move to a retry buffer
+//buffers that reached their maximum age are not sealed here but once the flush marker is read from the ingress
+func flushOnTimer(ctx statefun.Context, request IncomingMessage) error {
+
+	var pending int64
+	if due, ok := request.Payload["due"].(float64); ok && ctx.Storage().Get(FlushDueSpec, &pending) && int64(due) == pending {
+		ctx.Storage().Remove(FlushDueSpec)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	buffers := loadRowBuffers(ctx.Storage())
+
+	//buffers are collected in the order they were created, rows kept for a retry are moved to new buffers
+	keys := make([]string, 0, len(buffers))
+	for key := range buffers {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return buffers[keys[i]].CreatedAt < buffers[keys[j]].CreatedAt })
+
+	through := int64(-1)
+	next := int64(math.MaxInt64)
+	for _, key := range keys {
+		buffer := buffers[key]
+
+		if buffer.Sealed {
+			rows, done, err := collectBuffer(buffer)
+			if err != nil {
+				log.Println("Unable to collect the result of "+buffer.Spill, err)
+			}
+			if !done {
+				if now+bufferPollMs() < next {
+					next = now + bufferPollMs()
+				}
+				continue
+			}
+			delete(buffers, key)
+			if err = buffers.keepPending(ctx, buffer, rows); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if buffer.dueAt() > now {
+			if buffer.dueAt() < next {
+				next = buffer.dueAt()
+			}
+			continue
+		}
+		if buffer.FirstSequence > through {
+			through = buffer.FirstSequence
+		}
+	}
+
+	if through >= 0 {
+		if err := writeFlushMarker(ctx.Self().Id, through); err != nil {
+			log.Println("Unable to write flush marker for "+ctx.Self().Id, err)
+			if now+flushMarkerRetryMs < next {
+				next = now + flushMarkerRetryMs
+			}
+		}
+	}
+
+	if next < math.MaxInt64 {
+		scheduleFlush(ctx, next)
+	}
+
+	if len(buffers) == 0 {
+		ctx.Storage().Remove(RowBuffersSpec)
+	} else {
+		ctx.Storage().Set(RowBuffersSpec, buffers)
+	}
+
+	return nil
+}
+
+//writes out the buffers of the stream key of the function, the rtdl_206 control message without a stream is
+//passed on to the stream keys of all streams as flush markers on the ingress topic
+//a flush marker with through only writes out the buffers holding messages up to that number
+func flushAllBuffers(ctx statefun.Context, request IncomingMessage) error {
+
+	if request.StreamId == "" && request.StreamAltId == "" {
+		keys := make(map[string]bool)
+		for _, configRecord := range streamConfigs {
+			for _, field := range []string{"stream_id", "stream_alt_id"} {
+				if key, _ := configRecord[field].(string); key != "" && key != ctx.Self().Id && !keys[key] {
+					keys[key] = true
+					if err := writeFlushMarker(key, math.MaxInt64); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	through := int64(math.MaxInt64)
+	if value, ok := request.Payload["through"].(float64); ok {
+		through = int64(value)
+	}
+	FlushBuffers(ctx, through)
+
+	return nil
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+//catalogs a stream keeps in sync with the tables of its message types
+//`catalogs` of a stream lists them (dremio by default), glue_enabled and snowflake_enabled add Glue and Snowflake
+//tables and partitions are registered when their first file is written, failed registrations are kept pending and
+//retried every CATALOG_PENDING_RETRY_SECONDS (60) until they succeed or their file is gone
+//adding a catalog means implementing catalogRegistrar and registering it under a new name in catalogRegistrars
+type catalogRegistrar interface {
+	//name of the catalog in logs and metrics, e.g. "Dremio"
+	Name() string
+	//an error if the catalog cannot reach tables of the stream's store
+	Supports(store ObjectStore, configRecord map[string]interface{}) error
+	//registers the table of the file's message type
+	RegisterTable(store ObjectStore, file tableFile) error
+	//registers the partition of the file, called once the table is registered
+	RegisterPartition(store ObjectStore, file tableFile) error
+	//called after every file, for catalogs that do not see new files of a registered table on their own
+	Refresh(store ObjectStore, file tableFile) error
+}
+
+var catalogRegistrars = map[string]catalogRegistrar{
+	"dremio":    dremioRegistrar{},
+	"glue":      glueRegistrar{},
+	"snowflake": snowflakeRegistrar{},
+}
+
+//tables and partitions registered per catalog, forgotten when the configuration is reloaded
+var catalogRegistrations = struct {
+	sync.Mutex
+	entries map[string]bool
+}{entries: make(map[string]bool)}
+
+//files whose registration failed per catalog and file key, retried by retryPendingRegistrations
+type pendingRegistration struct {
+	catalog string
+	store   ObjectStore
+	file    tableFile
+}
+
+var pendingRegistrations = struct {
+	sync.Mutex
+	entries map[string]pendingRegistration
+}{entries: make(map[string]pendingRegistration)}
+
+//last failure per stream and catalog, for the metrics view
+var catalogFailures = struct {
+	sync.Mutex
+	entries map[string]map[string]string
+}{entries: make(map[string]map[string]string)}
+
+//catalogs of a stream
+func streamCatalogs(configRecord map[string]interface{}) []string {
+
+	names := []string{"dremio"}
+	if list, ok := configRecord["catalogs"].([]interface{}); ok {
+		names = make([]string, 0, len(list))
+		for _, name := range list {
+			if name, ok := name.(string); ok {
+				names = append(names, name)
+			}
+		}
+	}
+
+	enabled := make(map[string]bool)
+	for _, name := range names {
+		enabled[name] = true
+	}
+	for _, name := range []string{"glue", "snowflake"} {
+		if flag, _ := configRecord[name+"_enabled"].(bool); flag && !enabled[name] {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+func registered(key string) bool {
+	catalogRegistrations.Lock()
+	defer catalogRegistrations.Unlock()
+
+	return catalogRegistrations.entries[key]
+}
+
+func markRegistered(key string) {
+	catalogRegistrations.Lock()
+	defer catalogRegistrations.Unlock()
+
+	catalogRegistrations.entries[key] = true
+}
+
+//registrations are made again with the next file, e.g. after the configuration of a stream changed
+func resetCatalogRegistrations() {
+	catalogRegistrations.Lock()
+	defer catalogRegistrations.Unlock()
+
+	catalogRegistrations.entries = make(map[string]bool)
+}
+
+//records the outcome of an update of a catalog for a stream
+func reportCatalog(streamId string, catalog string, err error) {
+
+	catalogFailures.Lock()
+	defer catalogFailures.Unlock()
+
+	if err == nil {
+		delete(catalogFailures.entries[streamId], catalog)
+		return
+	}
+
+	log.Println("Error updating "+catalog+" for stream "+streamId, err)
+	incrementCounter("catalog_updates_failed", streamId)
+	incrementCounter("catalog_updates_failed_"+catalog, streamId)
+
+	if catalogFailures.entries[streamId] == nil {
+		catalogFailures.entries[streamId] = make(map[string]string)
+	}
+	catalogFailures.entries[streamId][catalog] = time.Now().UTC().Format(time.RFC3339) + " " + err.Error()
+}
+
+//last failures of the catalogs that are failing per stream
+func failingCatalogs() map[string]map[string]string {
+
+	catalogFailures.Lock()
+	defer catalogFailures.Unlock()
+
+	failing := make(map[string]map[string]string)
+	for streamId, catalogs := range catalogFailures.entries {
+		if len(catalogs) == 0 {
+			continue
+		}
+		failing[streamId] = make(map[string]string)
+		for catalog, failure := range catalogs {
+			failing[streamId][catalog] = failure
+		}
+	}
+
+	return failing
+}
+
+//makes a newly written file known to the catalogs of its stream
+//every catalog is retried and circuit-broken on its own, a catalog that is down does not hold up the others
+func registerFile(store ObjectStore, file tableFile) {
+
+	for _, name := range streamCatalogs(file.configRecord) {
+		registerWithCatalog(store, file, name)
+	}
+}
+
+//registers a file with one catalog, a failed registration is kept pending
+func registerWithCatalog(store ObjectStore, file tableFile, name string) {
+
+	streamId := configString(file.configRecord, "stream_id")
+	tableKey := name + "|" + file.tableKey()
+	partitionKey := tableKey + "|" + file.subFolderName
+
+	registrar := catalogRegistrars[name]
+	var err error
+	if registrar == nil {
+		err = errors.New("unknown catalog")
+	} else {
+		err = registrar.Supports(store, file.configRecord)
+	}
+
+	//reported once per table, it will not change until the configuration does
+	if err != nil {
+		if !registered(tableKey) {
+			reportCatalog(streamId, name, err)
+			markRegistered(tableKey)
+		}
+		pendingRegistrations.Lock()
+		delete(pendingRegistrations.entries, name+"|"+file.key)
+		pendingRegistrations.Unlock()
+		return
+	}
+
+	//broken credentials of one stream must not open the circuit breaker for the others
+	destination := registrar.Name() + " (" + streamId + ")"
+
+	err = withRetry(destination, catalogRetryPolicy(registrar.Name()), func() error {
+
+		if !registered(tableKey) {
+			if err := registrar.RegisterTable(store, file); err != nil {
+				return err
+			}
+			markRegistered(tableKey)
+		}
+
+		if !registered(partitionKey) {
+			if err := registrar.RegisterPartition(store, file); err != nil {
+				return err
+			}
+			markRegistered(partitionKey)
+		}
+
+		return registrar.Refresh(store, file)
+	})
+	reportCatalog(streamId, name, err)
+
+	pendingRegistrations.Lock()
+	defer pendingRegistrations.Unlock()
+
+	if err != nil {
+		pendingRegistrations.entries[name+"|"+file.key] = pendingRegistration{catalog: name, store: store, file: file}
+	} else {
+		delete(pendingRegistrations.entries, name+"|"+file.key)
+	}
+}
+
+//retries the pending registrations every CATALOG_PENDING_RETRY_SECONDS
+//files that are gone in the meantime, e.g. merged by compaction, are dropped, the merged file is registered itself
+func retryPendingRegistrations() {
+
+	ticker := time.NewTicker(time.Duration(GetEnvInt("CATALOG_PENDING_RETRY_SECONDS", 60)) * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+
+		pendingRegistrations.Lock()
+		pending := make([]pendingRegistration, 0, len(pendingRegistrations.entries))
+		for _, registration := range pendingRegistrations.entries {
+			pending = append(pending, registration)
+		}
+		pendingRegistrations.Unlock()
+
+		for _, registration := range pending {
+
+			objects, err := registration.store.List(context.Background(), registration.file.key)
+			if err != nil {
+				log.Println("Error looking up "+registration.file.key+" to register it with "+registration.catalog, err)
+				continue
+			}
+			if len(objects) == 0 {
+				pendingRegistrations.Lock()
+				delete(pendingRegistrations.entries, registration.catalog+"|"+registration.file.key)
+				pendingRegistrations.Unlock()
+				continue
+			}
+
+			registerWithCatalog(registration.store, registration.file, registration.catalog)
+		}
+	}
+}
+
+//Dremio reads the folder (or table metadata) of a message type as a dataset and discovers partitions itself
+type dremioRegistrar struct{}
+
+func (dremioRegistrar) Name() string {
+	return "Dremio"
+}
+
+func (dremioRegistrar) Supports(store ObjectStore, configRecord map[string]interface{}) error {
+	return nil
+}
+
+func (dremioRegistrar) RegisterTable(store ObjectStore, file tableFile) error {
+
+	err := UpdateDremio(file.messageType, store.SourceType(), store.Location(), file.configRecord)
+	if err != nil {
+		return err
+	}
+
+	//HDFS datasets are not created by UpdateDremio
+	if _, ok := store.(*hdfsStore); ok {
+		return CreateHDFSDataset(file.messageType, file.configRecord)
+	}
+
+	return nil
+}
+
+//Dremio would only see the new partition with the next metadata refresh of the source
+func (dremioRegistrar) RegisterPartition(store ObjectStore, file tableFile) error {
+	return refreshDremioPartition(file)
+}
+
+func (dremioRegistrar) Refresh(store ObjectStore, file tableFile) error {
+	return nil
+}
+
+//Glue tables are created by a crawler per message type, which also picks up new partitions, or by the
+//ingester itself with glue_mode "direct" (see glue.go)
+type glueRegistrar struct{}
+
+func (glueRegistrar) Name() string {
+	return "Glue"
+}
+
+//Glue only reaches AWS S3, S3-compatible stores only work with a Glue-compatible stand-in
+func (glueRegistrar) Supports(store ObjectStore, configRecord map[string]interface{}) error {
+	if s3, ok := store.(*s3Store); !ok || (s3.endpoint.url != "" && configString(configRecord, "glue_endpoint") == "") {
+		return errors.New("Glue requires an AWS S3 file store")
+	}
+	return nil
+}
+
+func (glueRegistrar) RegisterTable(store ObjectStore, file tableFile) error {
+	if glueMode(file.configRecord) == glueModeDirect {
+		return syncGlueTable(store.(*s3Store), file, true)
+	}
+	return UpdateGlue(file.messageType, file.configRecord, store.(*s3Store).session)
+}
+
+func (glueRegistrar) RegisterPartition(store ObjectStore, file tableFile) error {
+	if glueMode(file.configRecord) == glueModeDirect {
+		return createGluePartition(store.(*s3Store), file)
+	}
+	return nil
+}
+
+func (glueRegistrar) Refresh(store ObjectStore, file tableFile) error {
+	if glueMode(file.configRecord) == glueModeDirect {
+		return syncGlueTable(store.(*s3Store), file, false)
+	}
+	return nil
+}
+
+//Snowflake reads the files of a message type as an external table on a stage, or loads them into a native
+//table with snowflake_mode "copy" (see snowflake.go)
+type snowflakeRegistrar struct{}
+
+func (snowflakeRegistrar) Name() string {
+	return "Snowflake"
+}
+
+//GCS and Azure stores are only reached through a storage integration
+func (snowflakeRegistrar) Supports(store ObjectStore, configRecord map[string]interface{}) error {
+	_, err := snowflakeStage(store, "", configRecord)
+	return err
+}
+
+func (snowflakeRegistrar) RegisterTable(store ObjectStore, file tableFile) error {
+	return UpdateSnowflake(store, file)
+}
+
+func (snowflakeRegistrar) RegisterPartition(store ObjectStore, file tableFile) error {
+	return nil
+}
+
+//external tables that are not refreshed by Snowflake are refreshed, native tables load the file
+func (snowflakeRegistrar) Refresh(store ObjectStore, file tableFile) error {
+	return RefreshSnowflake(store, file)
+}
@@ -0,0 +1,942 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/schema"
+)
+
+//small-file compaction of a stream (`compaction`), e.g.
+//	{"min_age_minutes": 120, "target_file_size_mb": 256, "sort_column": "created_at"}
+//every COMPACTION_INTERVAL_MINUTES (60) the files of each partition directory are merged into files of about
+//target_file_size_mb (default 128), once none of them has been written for min_age_minutes (default 60)
+//merged rows are sorted by sort_column if the stream has one, the schema of a merged file is that of its originals
+//the originals are read one at a time and their rows spilled to a temporary file in COMPACTION_TEMP_DIR (the system's
+//default), so that only one original and one of its row groups are in memory at a time
+//a merge writes the merged file first, commits it to the table format in place of the originals and then deletes them
+//streams without a table format are read as folders, there the merged file is written under a hidden name (`_` prefix)
+//and only renamed once the originals are deleted, so that readers never see the rows twice
+//a journal in `<folder_name>/_compaction` records the running merge of a partition, it keeps other ingester instances
+//from compacting the partition and lets a merge that was cut short be completed or rolled back
+//after COMPACTION_JOURNAL_TIMEOUT_MINUTES (30) - Iceberg tables are not compacted
+type compactionSettings struct {
+	minAge     time.Duration
+	targetSize int64
+	sortColumn string
+}
+
+//merge of files of a partition, as recorded in its journal
+type compactionJournal struct {
+	SubFolderName string   `json:"sub_folder_name"`
+	Merged        string   `json:"merged"`
+	Originals     []string `json:"originals"`
+}
+
+//compaction settings of a stream, nil if the stream is not compacted
+func streamCompaction(configRecord map[string]interface{}) *compactionSettings {
+
+	entries, _ := configRecord["compaction"].(map[string]interface{})
+	if entries == nil {
+		return nil
+	}
+
+	//files loaded into native Snowflake tables would be loaded again once merged
+	for _, catalog := range streamCatalogs(configRecord) {
+		if catalog == "snowflake" && snowflakeMode(configRecord) == snowflakeModeCopy {
+			return nil
+		}
+	}
+
+	settings := &compactionSettings{minAge: 60 * time.Minute, targetSize: 128 << 20}
+	if minAge, ok := entries["min_age_minutes"].(float64); ok && minAge >= 0 {
+		settings.minAge = time.Duration(minAge) * time.Minute
+	}
+	if targetSize, ok := entries["target_file_size_mb"].(float64); ok && targetSize > 0 {
+		settings.targetSize = int64(targetSize) << 20
+	}
+	settings.sortColumn, _ = entries["sort_column"].(string)
+
+	return settings
+}
+
+//key of the journal of a partition
+func compactionJournalKey(configRecord map[string]interface{}, subFolderName string) string {
+
+	hash := fnv.New64a()
+	hash.Write([]byte(subFolderName))
+
+	return objectKey(configRecord, "_compaction", fmt.Sprintf("%016x.json", hash.Sum64()))
+}
+
+//partition directory (message type and partition directories) of a data file of the stream, blank for other objects
+//hidden folders such as _delta_log and _compaction are skipped
+func compactionPartition(configRecord map[string]interface{}, key string) string {
+
+	relativeKey := strings.TrimPrefix(key, folderPrefix(configString(configRecord, "folder_name")))
+	if !strings.HasSuffix(relativeKey, ".parquet") {
+		return ""
+	}
+
+	directories := strings.Split(relativeKey, "/")
+	if len(directories) < 2 {
+		return ""
+	}
+	for _, directory := range directories {
+		if strings.HasPrefix(directory, "_") || strings.HasPrefix(directory, ".") {
+			return ""
+		}
+	}
+
+	return strings.Join(directories[:len(directories)-1], "/")
+}
+
+//a column of a Parquet file together with its nested columns
+type parquetColumn struct {
+	name     string
+	element  *parquet.SchemaElement
+	children []*parquetColumn
+}
+
+//columns of a file in the order of its schema, starting with the column at next
+func parquetColumns(handler *schema.SchemaHandler, next *int) *parquetColumn {
+
+	index := *next
+	*next++
+
+	column := &parquetColumn{name: handler.Infos[index].ExName, element: handler.SchemaElements[index]}
+	for child := int32(0); child < column.element.GetNumChildren(); child++ {
+		column.children = append(column.children, parquetColumns(handler, next))
+	}
+
+	return column
+}
+
+//element of LIST columns, nil for other columns
+func (column *parquetColumn) listElement() *parquetColumn {
+
+	if column.element.GetConvertedType() != parquet.ConvertedType_LIST || len(column.children) != 1 || len(column.children[0].children) != 1 {
+		return nil
+	}
+
+	return column.children[0].children[0]
+}
+
+//schema node of a column, as the ingester infers it for the values of the column
+func (column *parquetColumn) schemaNode() (*schemaNode, error) {
+
+	node := &schemaNode{optional: column.element.GetRepetitionType() == parquet.FieldRepetitionType_OPTIONAL}
+
+	if element := column.listElement(); element != nil {
+		elementNode, err := element.schemaNode()
+		node.dataType = "list"
+		node.element = elementNode
+		return node, err
+	}
+
+	if len(column.children) > 0 {
+		node.dataType = "object"
+		node.fields = make(map[string]*schemaNode)
+		node.objects = 1
+		for _, child := range column.children {
+			field, err := child.schemaNode()
+			if err != nil {
+				return nil, err
+			}
+			node.fields[child.name] = field
+		}
+		return node, nil
+	}
+
+	switch column.element.GetType() {
+	case parquet.Type_BOOLEAN:
+		node.dataType = "boolean"
+	case parquet.Type_INT32, parquet.Type_INT64:
+		switch column.element.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			node.dataType = "timestamp_millis"
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			node.dataType = "timestamp_micros"
+		default:
+			node.dataType = "int64"
+		}
+	case parquet.Type_FLOAT, parquet.Type_DOUBLE:
+		node.dataType = "double"
+	case parquet.Type_BYTE_ARRAY:
+		node.dataType = "string"
+	case parquet.Type_FIXED_LEN_BYTE_ARRAY:
+		if column.element.GetConvertedType() == parquet.ConvertedType_DECIMAL {
+			node.dataType = fmt.Sprintf("decimal(%d,%d)", column.element.GetPrecision(), column.element.GetScale())
+		}
+	}
+
+	if node.dataType == "" {
+		return nil, errors.New("column `" + column.name + "` has a type the ingester does not write")
+	}
+
+	return node, nil
+}
+
+//value of a column as the ingester receives it in a payload, integers and timestamps as strings so that they
+//convert exactly
+func (column *parquetColumn) value(value reflect.Value) interface{} {
+
+	if value.Kind() == reflect.Ptr {
+		if value.IsNil() {
+			return nil
+		}
+		value = value.Elem()
+	}
+
+	if element := column.listElement(); element != nil {
+		if value.IsNil() && column.element.GetRepetitionType() == parquet.FieldRepetitionType_OPTIONAL {
+			return nil
+		}
+		list := make([]interface{}, value.Len())
+		for index := range list {
+			list[index] = element.value(value.Index(index))
+		}
+		return list
+	}
+
+	if len(column.children) > 0 {
+		object := make(map[string]interface{}, len(column.children))
+		for index, child := range column.children {
+			if fieldValue := child.value(value.Field(index)); fieldValue != nil {
+				object[child.name] = fieldValue
+			}
+		}
+		return object
+	}
+
+	switch value.Kind() {
+
+	case reflect.Bool:
+		return value.Bool()
+
+	case reflect.Int32, reflect.Int64:
+		switch column.element.GetConvertedType() {
+		case parquet.ConvertedType_TIMESTAMP_MILLIS:
+			return time.Unix(0, value.Int()*int64(time.Millisecond)).UTC().Format(time.RFC3339Nano)
+		case parquet.ConvertedType_TIMESTAMP_MICROS:
+			return time.Unix(0, value.Int()*int64(time.Microsecond)).UTC().Format(time.RFC3339Nano)
+		}
+		return strconv.FormatInt(value.Int(), 10)
+
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+
+	case reflect.String:
+		if column.element.GetConvertedType() != parquet.ConvertedType_DECIMAL {
+			return value.String()
+		}
+		//unscaled value as big-endian two's complement
+		data := []byte(value.String())
+		unscaled := new(big.Int).SetBytes(data)
+		if len(data) > 0 && data[0]&0x80 != 0 {
+			unscaled.Sub(unscaled, new(big.Int).Lsh(big.NewInt(1), uint(8*len(data))))
+		}
+		scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(column.element.GetScale())), nil)
+		return new(big.Rat).SetFrac(unscaled, scale).FloatString(int(column.element.GetScale()))
+	}
+
+	return nil
+}
+
+//reads a Parquet file written by the ingester together with its schema, the rows are passed to rowGroup
+//one row group at a time and the number of rows is returned
+func readParquetRowGroups(data []byte, rowGroup func(node *schemaNode, rows []map[string]interface{}) error) (*schemaNode, int, error) {
+
+	parquetReader, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(data), nil, 4)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer parquetReader.ReadStop()
+
+	next := 0
+	root := parquetColumns(parquetReader.SchemaHandler, &next)
+	node, err := root.schemaNode()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := 0
+	for _, group := range parquetReader.Footer.RowGroups {
+		values, err := parquetReader.ReadByNumber(int(group.GetNumRows()))
+		if err != nil {
+			return nil, 0, err
+		}
+
+		rows := make([]map[string]interface{}, len(values))
+		for index, value := range values {
+			rows[index], _ = root.value(reflect.ValueOf(value)).(map[string]interface{})
+		}
+		if err = rowGroup(node, rows); err != nil {
+			return nil, 0, err
+		}
+		count += len(rows)
+	}
+
+	return node, count, nil
+}
+
+//orders two conformed values of a column, nulls last
+func compareColumnValues(dataType string, value interface{}, other interface{}) int {
+
+	switch {
+	case value == nil && other == nil:
+		return 0
+	case value == nil:
+		return 1
+	case other == nil:
+		return -1
+	}
+
+	switch typedValue := value.(type) {
+	case bool:
+		otherValue, _ := other.(bool)
+		if typedValue == otherValue {
+			return 0
+		}
+		if otherValue {
+			return -1
+		}
+		return 1
+	case int64:
+		otherValue, _ := other.(int64)
+		switch {
+		case typedValue < otherValue:
+			return -1
+		case typedValue > otherValue:
+			return 1
+		}
+		return 0
+	case float64:
+		otherValue, _ := other.(float64)
+		switch {
+		case typedValue < otherValue:
+			return -1
+		case typedValue > otherValue:
+			return 1
+		}
+		return 0
+	case string:
+		otherValue, _ := other.(string)
+		if _, _, ok := decimalPrecisionScale(dataType); ok {
+			number, _ := new(big.Rat).SetString(typedValue)
+			otherNumber, _ := new(big.Rat).SetString(otherValue)
+			if number != nil && otherNumber != nil {
+				return number.Cmp(otherNumber)
+			}
+		}
+		return strings.Compare(typedValue, otherValue)
+	}
+
+	return 0
+}
+
+//node of a scalar sort column of a schema, nil if the schema has no such column
+func sortColumnNode(node *schemaNode, sortColumn string) *schemaNode {
+
+	column := node
+	for _, name := range strings.Split(sortColumn, ".") {
+		if column.dataType != "object" {
+			return nil
+		}
+		if column = column.fields[name]; column == nil {
+			return nil
+		}
+	}
+	if column.dataType == "object" || column.dataType == "list" {
+		return nil
+	}
+
+	return column
+}
+
+//value of the sort column of a row, conformed to the column
+func sortKey(column *schemaNode, row map[string]interface{}, sortColumn string) interface{} {
+	return column.conform(lookupPath(row, sortColumn))
+}
+
+//sorts rows by a scalar column of the schema they were read with, rows keep their order otherwise
+func sortRows(node *schemaNode, rows []map[string]interface{}, sortColumn string) {
+
+	column := sortColumnNode(node, sortColumn)
+	if column == nil {
+		return
+	}
+
+	keys := make([]interface{}, len(rows))
+	for index, row := range rows {
+		keys[index] = sortKey(column, row, sortColumn)
+	}
+	order := make([]int, len(rows))
+	for index := range order {
+		order[index] = index
+	}
+	sort.SliceStable(order, func(index int, otherIndex int) bool {
+		return compareColumnValues(column.dataType, keys[order[index]], keys[order[otherIndex]]) < 0
+	})
+
+	sorted := make([]map[string]interface{}, len(rows))
+	for index, rowIndex := range order {
+		sorted[index] = rows[rowIndex]
+	}
+	copy(rows, sorted)
+}
+
+//rows of the originals of a merge, spilled to a temporary file as JSON lines so that only a row group is held in
+//memory at a time - every row group is a run, sorted by the sort column if the stream has one
+type compactionSpill struct {
+	file *os.File
+	size int64
+	runs []compactionRun
+}
+
+type compactionRun struct {
+	offset int64
+	size   int64
+}
+
+//next row of every run that has rows left, ordered by the sort column
+type compactionHeads struct {
+	column *schemaNode
+	heads  []*compactionHead
+}
+
+type compactionHead struct {
+	run       int
+	reader    *bufio.Reader
+	row       map[string]interface{}
+	conformed map[string]interface{}
+	key       interface{}
+}
+
+func newCompactionSpill() (*compactionSpill, error) {
+
+	file, err := ioutil.TempFile(GetEnv("COMPACTION_TEMP_DIR", ""), "rtdl-compaction-")
+	if err != nil {
+		return nil, err
+	}
+
+	return &compactionSpill{file: file}, nil
+}
+
+//closes and deletes the file of the spill
+func (spill *compactionSpill) remove() {
+	spill.file.Close()
+	os.Remove(spill.file.Name())
+}
+
+//appends a run of rows
+func (spill *compactionSpill) writeRun(rows []map[string]interface{}) error {
+
+	writer := bufio.NewWriter(spill.file)
+	run := compactionRun{offset: spill.size}
+	for _, row := range rows {
+		line, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(append(line, '\n')); err != nil {
+			return err
+		}
+		run.size += int64(len(line) + 1)
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+
+	spill.runs = append(spill.runs, run)
+	spill.size += run.size
+	return nil
+}
+
+//reads the next row of a head, false at the end of its run
+func (head *compactionHead) next(node *schemaNode, column *schemaNode, sortColumn string) (bool, error) {
+
+	line, err := head.reader.ReadBytes('\n')
+	if err == io.EOF && len(line) == 0 {
+		return false, nil
+	}
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+
+	head.row = nil
+	if err = json.Unmarshal(line, &head.row); err != nil {
+		return false, err
+	}
+	head.conformed, _ = node.conform(head.row).(map[string]interface{})
+	if column != nil {
+		head.key = lookupPath(head.conformed, sortColumn)
+	}
+
+	return true, nil
+}
+
+func (heads *compactionHeads) Len() int {
+	return len(heads.heads)
+}
+
+//heads of earlier runs go first among equal keys, which keeps the order of rows otherwise
+func (heads *compactionHeads) Less(index int, otherIndex int) bool {
+	head, other := heads.heads[index], heads.heads[otherIndex]
+	if heads.column != nil {
+		if order := compareColumnValues(heads.column.dataType, head.key, other.key); order != 0 {
+			return order < 0
+		}
+	}
+	return head.run < other.run
+}
+
+func (heads *compactionHeads) Swap(index int, otherIndex int) {
+	heads.heads[index], heads.heads[otherIndex] = heads.heads[otherIndex], heads.heads[index]
+}
+
+func (heads *compactionHeads) Push(head interface{}) {
+	heads.heads = append(heads.heads, head.(*compactionHead))
+}
+
+func (heads *compactionHeads) Pop() interface{} {
+	head := heads.heads[len(heads.heads)-1]
+	heads.heads = heads.heads[:len(heads.heads)-1]
+	return head
+}
+
+//rows of the spill conformed to node, the runs are merged by the sort column if node has it and else follow each other
+func (spill *compactionSpill) rows(node *schemaNode, sortColumn string) parquetRows {
+	return func(write func(row []byte) error) error {
+
+		var column *schemaNode
+		if sortColumn != "" {
+			if column = sortColumnNode(node, sortColumn); column == nil {
+				log.Println("Not sorting by `" + sortColumn + "`, it is not a column of the merged files")
+			}
+		}
+
+		for start := 0; start < len(spill.runs); {
+
+			//without a sort column a single run is read at a time
+			end := len(spill.runs)
+			if column == nil {
+				end = start + 1
+			}
+
+			heads := &compactionHeads{column: column}
+			for index, run := range spill.runs[start:end] {
+				head := &compactionHead{run: index, reader: bufio.NewReader(io.NewSectionReader(spill.file, run.offset, run.size))}
+				found, err := head.next(node, column, sortColumn)
+				if err != nil {
+					return err
+				}
+				if found {
+					heads.heads = append(heads.heads, head)
+				}
+			}
+			heap.Init(heads)
+
+			for heads.Len() > 0 {
+				head := heads.heads[0]
+				line, err := json.Marshal(head.conformed)
+				if err != nil {
+					return err
+				}
+				if err = write(line); err != nil {
+					return err
+				}
+
+				found, err := head.next(node, column, sortColumn)
+				if err != nil {
+					return err
+				}
+				if found {
+					heap.Fix(heads, 0)
+				} else {
+					heap.Pop(heads)
+				}
+			}
+
+			start = end
+		}
+
+		return nil
+	}
+}
+
+//merges files of a partition into a new file of the partition and commits it in their place
+//the originals stay where they are if the merge fails
+func mergeFiles(ctx context.Context, store ObjectStore, journal compactionJournal, settings *compactionSettings, configRecord map[string]interface{}) error {
+
+	messageType := strings.Split(journal.SubFolderName, "/")[0]
+
+	merged := tableFile{
+		messageType:   messageType,
+		subFolderName: journal.SubFolderName,
+		key:           journal.Merged,
+		schema:        new(schemaNode),
+		configRecord:  configRecord,
+	}
+
+	spill, err := newCompactionSpill()
+	if err != nil {
+		return err
+	}
+	defer spill.remove()
+
+	//originals are read one at a time, their row groups are spilled
+	originals := make([]tableFile, len(journal.Originals))
+	for index, key := range journal.Originals {
+		data, err := store.Read(ctx, key)
+		if err != nil {
+			return errors.New("reading " + key + " failed: " + err.Error())
+		}
+		node, count, err := readParquetRowGroups(data, func(node *schemaNode, rows []map[string]interface{}) error {
+			if settings.sortColumn != "" {
+				sortRows(node, rows, settings.sortColumn)
+			}
+			return spill.writeRun(rows)
+		})
+		if err != nil {
+			return errors.New("reading " + key + " failed: " + err.Error())
+		}
+		merged.schema.mergeNode(node)
+		merged.rows += count
+		originals[index] = tableFile{messageType: messageType, subFolderName: journal.SubFolderName, key: key, size: int64(len(data)), rows: count, schema: node, configRecord: configRecord}
+	}
+
+	if merged.fieldIds, err = tableFieldIds(store, merged); err != nil {
+		return errors.New("reading the table of " + merged.key + " failed: " + err.Error())
+	}
+	parquetSchema, err := merged.schema.ParquetSchema(messageType, merged.fieldIds)
+	if err != nil {
+		return err
+	}
+
+	//readers of plain Parquet folders only see the merged file once the originals are gone
+	if streamTableFormat(configRecord) == "" {
+		stagingKey := compactionStagingKey(merged.key)
+		if _, err = writeObject(store, stagingKey, parquetSchema, spill.rows(merged.schema, settings.sortColumn), configRecord); err != nil {
+			return errors.New("writing " + stagingKey + " failed: " + err.Error())
+		}
+		return publishMerged(ctx, store, journal)
+	}
+
+	if merged.size, err = writeObject(store, merged.key, parquetSchema, spill.rows(merged.schema, settings.sortColumn), configRecord); err != nil {
+		return errors.New("writing " + merged.key + " failed: " + err.Error())
+	}
+
+	if err = replaceTableFiles(store, merged, originals); err != nil {
+		if deleteErr := store.Delete(ctx, merged.key); deleteErr != nil {
+			log.Println("Unable to delete "+merged.key, deleteErr)
+		}
+		return errors.New("committing " + merged.key + " failed: " + err.Error())
+	}
+
+	return deleteOriginals(ctx, store, journal)
+}
+
+//deletes the originals of a committed merge
+func deleteOriginals(ctx context.Context, store ObjectStore, journal compactionJournal) error {
+
+	for _, key := range journal.Originals {
+		err := withRetry(store.URI(""), storeRetryPolicy(store), func() error {
+			return store.Delete(ctx, key)
+		})
+		if err != nil {
+			return errors.New("deleting " + key + " failed: " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+//hidden key the merged file of a plain Parquet partition is written under until the originals are deleted
+//folder readers (Dremio, Glue and Athena, Snowflake external tables) skip files starting with _
+func compactionStagingKey(merged string) string {
+
+	index := strings.LastIndex(merged, "/")
+
+	return merged[:index+1] + "_" + merged[index+1:]
+}
+
+//deletes the originals of a merge of a plain Parquet partition and renames the merged file to its visible name
+func publishMerged(ctx context.Context, store ObjectStore, journal compactionJournal) error {
+
+	if err := deleteOriginals(ctx, store, journal); err != nil {
+		return err
+	}
+
+	stagingKey := compactionStagingKey(journal.Merged)
+	err := withRetry(store.URI(""), storeRetryPolicy(store), func() error {
+		return store.Rename(ctx, stagingKey, journal.Merged)
+	})
+	if err != nil {
+		return errors.New("renaming " + stagingKey + " failed: " + err.Error())
+	}
+
+	return nil
+}
+
+//completes the merge of a journal that was cut short, the merge is rolled back unless the merged file was committed
+func recoverCompaction(ctx context.Context, store ObjectStore, journalKey string, configRecord map[string]interface{}) error {
+
+	data, err := store.Read(ctx, journalKey)
+	if err == errObjectNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var journal compactionJournal
+	if err = json.Unmarshal(data, &journal); err != nil {
+		return errors.New("invalid compaction journal " + journalKey + ": " + err.Error())
+	}
+
+	objects, err := store.List(ctx, objectKey(configRecord, journal.SubFolderName, ""))
+	if err != nil {
+		return err
+	}
+	committed, staged := false, false
+	for _, object := range objects {
+		committed = committed || object.key == journal.Merged
+		staged = staged || object.key == compactionStagingKey(journal.Merged)
+	}
+
+	//the merged file of a plain Parquet partition is complete once it was staged, the originals may be partly deleted
+	if streamTableFormat(configRecord) == "" {
+		if committed {
+			err = store.Delete(ctx, compactionStagingKey(journal.Merged))
+			log.Println("Completed the compaction of " + journal.SubFolderName + " into " + journal.Merged)
+		} else if staged {
+			err = publishMerged(ctx, store, journal)
+			log.Println("Completed the compaction of " + journal.SubFolderName + " into " + journal.Merged)
+		} else {
+			log.Println("Rolled back the compaction of " + journal.SubFolderName + " into " + journal.Merged)
+		}
+		if err != nil {
+			return err
+		}
+		return store.Delete(ctx, journalKey)
+	}
+
+	if committed {
+		merged := tableFile{messageType: strings.Split(journal.SubFolderName, "/")[0], subFolderName: journal.SubFolderName, key: journal.Merged, configRecord: configRecord}
+		files, err := tableFiles(store, merged)
+		if err != nil {
+			return err
+		}
+		if files != nil {
+			committed = files[journal.Merged]
+		}
+	}
+
+	if committed {
+		err = deleteOriginals(ctx, store, journal)
+		log.Println("Completed the compaction of " + journal.SubFolderName + " into " + journal.Merged)
+	} else {
+		err = store.Delete(ctx, journal.Merged)
+		log.Println("Rolled back the compaction of " + journal.SubFolderName + " into " + journal.Merged)
+	}
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, journalKey)
+}
+
+//groups the files of a partition into merges of up to the target size, files that reach it on their own are left out
+func planMerges(objects []objectInfo, targetSize int64) [][]objectInfo {
+
+	sort.Slice(objects, func(index int, otherIndex int) bool { return objects[index].key < objects[otherIndex].key })
+
+	merges := make([][]objectInfo, 0)
+	merge, size := make([]objectInfo, 0), int64(0)
+	for _, object := range objects {
+		if object.size >= targetSize {
+			continue
+		}
+		if size+object.size > targetSize {
+			if len(merge) > 1 {
+				merges = append(merges, merge)
+			}
+			merge, size = make([]objectInfo, 0), int64(0)
+		}
+		merge = append(merge, object)
+		size += object.size
+	}
+	if len(merge) > 1 {
+		merges = append(merges, merge)
+	}
+
+	return merges
+}
+
+//merges the small files of a partition, the journal of the partition is held until all merges are done
+func compactPartition(ctx context.Context, store ObjectStore, subFolderName string, objects []objectInfo, settings *compactionSettings, configRecord map[string]interface{}) error {
+
+	streamId := configString(configRecord, "stream_id")
+	journalKey := compactionJournalKey(configRecord, subFolderName)
+
+	//the journal is only created for merges, one that exists belongs to another instance
+	merges := planMerges(objects, settings.targetSize)
+	if len(merges) == 0 {
+		return nil
+	}
+
+	for index, merge := range merges {
+
+		journal := compactionJournal{
+			SubFolderName: subFolderName,
+			Merged:        objectKey(configRecord, subFolderName, generateLeafLevelFileName()),
+			Originals:     make([]string, len(merge)),
+		}
+		for originalIndex, object := range merge {
+			journal.Originals[originalIndex] = object.key
+		}
+		data, err := json.Marshal(journal)
+		if err != nil {
+			return err
+		}
+
+		if index == 0 {
+			//another instance is compacting the partition or its last compaction still has to be recovered
+			if err = store.PutIfAbsent(ctx, journalKey, data); err == errObjectExists {
+				return nil
+			}
+		} else {
+			err = putObject(ctx, store, journalKey, data)
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = mergeFiles(ctx, store, journal, settings, configRecord); err != nil {
+			//the journal stays behind, its recovery completes the merge or rolls it back
+			return err
+		}
+
+		incrementCounter("compactions", streamId)
+		addToCounter("files_compacted", streamId, int64(len(merge)))
+		log.Println("Compacted " + strconv.Itoa(len(merge)) + " files of " + subFolderName + " into " + journal.Merged)
+	}
+
+	return store.Delete(ctx, journalKey)
+}
+
+//compacts the partitions of a stream that are old enough, after recovering merges that were cut short
+func compactStream(configRecord map[string]interface{}, settings *compactionSettings) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("COMPACTION_TIMEOUT_MINUTES", 30))*time.Minute)
+	defer cancel()
+
+	store, err := openObjectStore(configRecord)
+	if err != nil {
+		return err
+	}
+
+	journals, err := store.List(ctx, objectKey(configRecord, "_compaction", ""))
+	if err != nil {
+		return err
+	}
+	journalTimeout := time.Duration(GetEnvInt("COMPACTION_JOURNAL_TIMEOUT_MINUTES", 30)) * time.Minute
+	for _, journal := range journals {
+		if time.Since(journal.modified) >= journalTimeout {
+			if err = recoverCompaction(ctx, store, journal.key, configRecord); err != nil {
+				return errors.New("recovering compaction " + journal.key + " failed: " + err.Error())
+			}
+		}
+	}
+
+	objects, err := store.List(ctx, configString(configRecord, "folder_name"))
+	if err != nil {
+		return err
+	}
+
+	partitions := make(map[string][]objectInfo)
+	latest := make(map[string]time.Time)
+	for _, object := range objects {
+		if partition := compactionPartition(configRecord, object.key); partition != "" {
+			partitions[partition] = append(partitions[partition], object)
+			if object.modified.After(latest[partition]) {
+				latest[partition] = object.modified
+			}
+		}
+	}
+
+	//files that failed to commit to a table format are not part of the table and are left alone
+	tables := make(map[string]map[string]bool)
+	for partition, partitionObjects := range partitions {
+
+		if time.Since(latest[partition]) < settings.minAge {
+			continue
+		}
+
+		messageType := strings.Split(partition, "/")[0]
+		files, found := tables[messageType]
+		if !found {
+			if files, err = tableFiles(store, tableFile{messageType: messageType, configRecord: configRecord}); err != nil {
+				return err
+			}
+			tables[messageType] = files
+		}
+		if files != nil {
+			committed := make([]objectInfo, 0, len(partitionObjects))
+			for _, object := range partitionObjects {
+				if files[object.key] {
+					committed = append(committed, object)
+				}
+			}
+			partitionObjects = committed
+		}
+
+		if err = compactPartition(ctx, store, partition, partitionObjects, settings, configRecord); err != nil {
+			log.Println("Error compacting "+partition, err)
+			incrementCounter("compactions_failed", configString(configRecord, "stream_id"))
+		}
+	}
+
+	return nil
+}
+
+//compacts the partitions of all streams with compaction settings every COMPACTION_INTERVAL_MINUTES
+func compactPartitionsOnInterval() {
+
+	ticker := time.NewTicker(time.Duration(GetEnvInt("COMPACTION_INTERVAL_MINUTES", 60)) * time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, configRecord := range streamConfigs {
+			settings := streamCompaction(configRecord)
+			if settings == nil {
+				continue
+			}
+			if !tableFormatCompactable(configRecord) {
+				log.Println("Not compacting stream " + configString(configRecord, "stream_id") + ", its table format cannot replace files")
+				continue
+			}
+			if err := compactStream(configRecord, settings); err != nil {
+				log.Println("Error compacting stream "+configString(configRecord, "stream_id"), err)
+			}
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/apache/flink-statefun/statefun-sdk-go/v3/pkg/statefun"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//message type of the per-stream quarantine tables
+const quarantineMessageType = "rtdl_quarantine"
+
+//record put on the dead-letter topic for every event that cannot be delivered
+//the original bytes are kept as received so that the event can be replayed
+type DeadLetter struct {
+	StreamId    string `json:"stream_id,omitempty"`
+	StreamAltId string `json:"stream_alt_id,omitempty"`
+	Stage       string `json:"stage"`
+	Reason      string `json:"reason"`
+	Timestamp   string `json:"timestamp"`
+	Original    []byte `json:"original"`
+	RetryAt     string `json:"retry_at,omitempty"`
+}
+
+var (
+	QuarantineTypeName = statefun.TypeNameFrom("com.rtdl.sf/quarantine")
+	DeadLetterType     = statefun.MakeJsonType(statefun.TypeNameFrom("com.rtdl.sf/DeadLetter"))
+)
+
+//dead-letter topic, drained into the quarantine tables by the Quarantine function
+func deadLetterTopic() string {
+	return GetEnv("DEAD_LETTER_TOPIC", "rtdl-dead-letter")
+}
+
+//utility method to put an undeliverable event on the dead-letter topic
+//stage tells where the event was rejected, e.g. "ingester" or "schema"
+func WriteDeadLetter(original []byte, request IncomingMessage, stage string, reason string) error {
+
+	deadLetter := DeadLetter{
+		StreamId:    request.StreamId,
+		StreamAltId: request.StreamAltId,
+		Stage:       stage,
+		Reason:      reason,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Original:    original,
+	}
+
+	err := deliverDeadLetter(deadLetter, streamKey(request))
+	if err != nil {
+		return err
+	}
+
+	incrementCounter("events_dead_lettered", streamKey(request))
+	return nil
+}
+
+//puts a dead letter on the dead-letter topic, or in the spool while Kafka is unavailable
+func deliverDeadLetter(deadLetter DeadLetter, key string) error {
+
+	body, err := json.Marshal(deadLetter)
+	if err != nil {
+		return err
+	}
+
+	err = DeliverMessages(kafka.Message{Topic: deadLetterTopic(), Key: []byte(key), Value: body})
+	if err != nil {
+		log.Println("Unable to write dead letter", err)
+		return err
+	}
+
+	return nil
+}
+
+//puts the dead letter of a quarantine row that could not be written back on the dead-letter topic
+//the row is written once its store is back, the dead letter is passed on unchanged to keep the original event
+//it is held back for QUARANTINE_REQUEUE_DELAY_MS so that an unavailable store doesn't loop it through Kafka
+func requeueQuarantineRow(request IncomingMessage) error {
+
+	original, _ := request.Payload["original"].(string)
+	deadLetter := DeadLetter{
+		StreamId:    request.StreamId,
+		StreamAltId: request.StreamAltId,
+		Original:    []byte(original),
+	}
+	deadLetter.Stage, _ = request.Payload["stage"].(string)
+	deadLetter.Reason, _ = request.Payload["reason"].(string)
+	deadLetter.Timestamp, _ = request.Payload["dead_lettered_at"].(string)
+	deadLetter.RetryAt = time.Now().UTC().Add(quarantineRequeueDelay()).Format(time.RFC3339Nano)
+
+	return deliverDeadLetter(deadLetter, streamKey(request))
+}
+
+//delay before a requeued quarantine row is written again
+func quarantineRequeueDelay() time.Duration {
+	return time.Duration(GetEnvInt("QUARANTINE_REQUEUE_DELAY_MS", 30000)) * time.Millisecond
+}
+
+//dead-letters an incoming message, the envelope is kept so it can be replayed on ingester-ingress
+func deadLetterRequest(request IncomingMessage, stage string, reason string) error {
+
+	original, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	return WriteDeadLetter(original, request, stage, reason)
+}
+
+//configuration for dead letters of streams that don't exist (anymore)
+//these end up in a quarantine folder of the local data store
+func quarantineFallbackConfig() map[string]interface{} {
+	return map[string]interface{}{
+		"stream_id":           quarantineMessageType,
+		"message_type":        quarantineMessageType,
+		"file_store_type_id":  GetStorageTypeId("file_store_local"),
+		"folder_name":         quarantineMessageType,
+		"partition_time_id":   GetPartitionTimeId("partition_time_daily"),
+		"compression_type_id": GetCompressionTypeId("compression_type_snappy"),
+	}
+}
+
+//stateful function draining the dead-letter topic into a quarantine table per stream
+//the rows are buffered by the ingester function of their stream key, which keeps the buffers of the stream
+func Quarantine(ctx statefun.Context, message statefun.Message) error {
+	var deadLetter DeadLetter
+	if err := message.As(DeadLetterType, &deadLetter); err != nil {
+		return fmt.Errorf("failed to deserialize dead letter: %w", err)
+	}
+
+	//requeued rows wait in a delayed message to the function itself, StateFun keeps these across restarts
+	if retryAt, err := time.Parse(time.RFC3339Nano, deadLetter.RetryAt); err == nil && time.Now().Before(retryAt) {
+		ctx.SendAfter(time.Until(retryAt), statefun.MessageBuilder{
+			Target:    ctx.Self(),
+			Value:     deadLetter,
+			ValueType: DeadLetterType,
+		})
+		return nil
+	}
+
+	request := IncomingMessage{
+		StreamId:    deadLetter.StreamId,
+		StreamAltId: deadLetter.StreamAltId,
+		MessageType: quarantineMessageType,
+		Payload: map[string]interface{}{
+			"stage":            deadLetter.Stage,
+			"reason":           deadLetter.Reason,
+			"dead_lettered_at": deadLetter.Timestamp,
+			"original":         string(deadLetter.Original),
+		},
+	}
+
+	ctx.Send(statefun.MessageBuilder{
+		Target:    statefun.Address{FunctionType: IngestTypeName, Id: streamKey(request)},
+		Value:     request,
+		ValueType: IncomingMessageType,
+	})
+
+	return nil
+}
+
+//buffers a row sent by the Quarantine function in the quarantine table of its stream
+func quarantineRow(ctx statefun.Context, request IncomingMessage) error {
+
+	matchingConfig := findMatchingConfig(request)
+	if matchingConfig == nil {
+		matchingConfig = quarantineFallbackConfig()
+	}
+
+	if err := WriteParquet(ctx, request, messageSequence{}, matchingConfig, false); err != nil {
+		log.Println("Unable to buffer quarantine row", err)
+		return err
+	}
+
+	incrementCounter("events_quarantined", streamKey(request))
+	return nil
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+//Delta Lake tables (table_format_delta), committed by the ingester without Spark
+//every written file is committed to `<table>/_delta_log` as an add action, together with a metaData action
+//whenever the schema of the message type changes - partition columns are the Hive-style columns of the
+//partition spec and are strings, they cannot change once the table exists
+//a commit is created with ObjectStore.PutIfAbsent, a writer that loses the race to another writer reads the
+//commits it missed and retries with the next version
+//every DELTA_CHECKPOINT_INTERVAL (10) commits the state of the table is written to a Parquet checkpoint
+//files merged by compaction replace the originals in a single commit, as Delta's OPTIMIZE does
+type deltaAction struct {
+	CommitInfo *deltaCommitInfo `json:"commitInfo,omitempty"`
+	Protocol   *deltaProtocol   `json:"protocol,omitempty" parquet:"name=protocol"`
+	MetaData   *deltaMetaData   `json:"metaData,omitempty" parquet:"name=metaData"`
+	Add        *deltaAdd        `json:"add,omitempty" parquet:"name=add"`
+	Remove     *deltaRemove     `json:"remove,omitempty" parquet:"name=remove"`
+}
+
+type deltaCommitInfo struct {
+	Timestamp           int64             `json:"timestamp"`
+	Operation           string            `json:"operation"`
+	OperationParameters map[string]string `json:"operationParameters"`
+	IsBlindAppend       bool              `json:"isBlindAppend"`
+	EngineInfo          string            `json:"engineInfo"`
+}
+
+type deltaProtocol struct {
+	MinReaderVersion int32 `json:"minReaderVersion" parquet:"name=minReaderVersion, type=INT32"`
+	MinWriterVersion int32 `json:"minWriterVersion" parquet:"name=minWriterVersion, type=INT32"`
+}
+
+type deltaFormat struct {
+	Provider string            `json:"provider" parquet:"name=provider, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Options  map[string]string `json:"options" parquet:"name=options, type=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+}
+
+type deltaMetaData struct {
+	Id               string            `json:"id" parquet:"name=id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Format           deltaFormat       `json:"format" parquet:"name=format"`
+	SchemaString     string            `json:"schemaString" parquet:"name=schemaString, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PartitionColumns []string          `json:"partitionColumns" parquet:"name=partitionColumns, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Configuration    map[string]string `json:"configuration" parquet:"name=configuration, type=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	CreatedTime      int64             `json:"createdTime" parquet:"name=createdTime, type=INT64"`
+}
+
+type deltaAdd struct {
+	Path             string             `json:"path" parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+	PartitionValues  map[string]*string `json:"partitionValues" parquet:"name=partitionValues, type=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Size             int64              `json:"size" parquet:"name=size, type=INT64"`
+	ModificationTime int64              `json:"modificationTime" parquet:"name=modificationTime, type=INT64"`
+	DataChange       bool               `json:"dataChange" parquet:"name=dataChange, type=BOOLEAN"`
+	Stats            string             `json:"stats,omitempty" parquet:"name=stats, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+type deltaRemove struct {
+	Path              string             `json:"path" parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DeletionTimestamp int64              `json:"deletionTimestamp" parquet:"name=deletionTimestamp, type=INT64"`
+	DataChange        bool               `json:"dataChange" parquet:"name=dataChange, type=BOOLEAN"`
+	PartitionValues   map[string]*string `json:"partitionValues,omitempty" parquet:"name=partitionValues, type=MAP, keytype=BYTE_ARRAY, keyconvertedtype=UTF8, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Size              int64              `json:"size,omitempty" parquet:"name=size, type=INT64"`
+}
+
+//Delta schema, serialised into schemaString of the metaData action
+type deltaStructType struct {
+	Type   string       `json:"type"`
+	Fields []deltaField `json:"fields"`
+}
+
+type deltaField struct {
+	Name     string                 `json:"name"`
+	Type     interface{}            `json:"type"`
+	Nullable bool                   `json:"nullable"`
+	Metadata map[string]interface{} `json:"metadata"`
+}
+
+type deltaArrayType struct {
+	Type         string      `json:"type"`
+	ElementType  interface{} `json:"elementType"`
+	ContainsNull bool        `json:"containsNull"`
+}
+
+//removed files are kept as tombstones in checkpoints for as long as Delta keeps them by default
+const deltaTombstoneRetention = 7 * 24 * time.Hour
+
+var deltaLogFilePattern = regexp.MustCompile(`^(\d{20})\.(json|checkpoint\.parquet)$`)
+
+//state of a table as of version, replayed from its log and kept in memory between commits
+type deltaLog struct {
+	sync.Mutex
+	loaded     bool
+	version    int64 //-1 for a table without commits
+	protocol   *deltaProtocol
+	metaData   *deltaMetaData
+	files      map[string]*deltaAdd
+	tombstones map[string]*deltaRemove
+}
+
+var deltaLogs = struct {
+	sync.Mutex
+	entries map[string]*deltaLog
+}{entries: make(map[string]*deltaLog)}
+
+func deltaCommitKey(tableKey string, version int64) string {
+	return fmt.Sprintf("%s/_delta_log/%020d.json", tableKey, version)
+}
+
+func deltaCheckpointKey(tableKey string, version int64) string {
+	return fmt.Sprintf("%s/_delta_log/%020d.checkpoint.parquet", tableKey, version)
+}
+
+func openDeltaLog(store ObjectStore, tableKey string) *deltaLog {
+
+	key := store.SourceType() + "|" + store.Location() + "|" + tableKey
+
+	deltaLogs.Lock()
+	defer deltaLogs.Unlock()
+
+	if deltaLogs.entries[key] == nil {
+		deltaLogs.entries[key] = &deltaLog{version: -1}
+	}
+
+	return deltaLogs.entries[key]
+}
+
+func (deltaLog *deltaLog) reset() {
+	deltaLog.loaded = false
+	deltaLog.version = -1
+	deltaLog.protocol = nil
+	deltaLog.metaData = nil
+	deltaLog.files = make(map[string]*deltaAdd)
+	deltaLog.tombstones = make(map[string]*deltaRemove)
+}
+
+func (deltaLog *deltaLog) apply(action deltaAction) {
+
+	switch {
+	case action.Protocol != nil:
+		deltaLog.protocol = action.Protocol
+	case action.MetaData != nil:
+		deltaLog.metaData = action.MetaData
+	case action.Add != nil:
+		deltaLog.files[action.Add.Path] = action.Add
+		delete(deltaLog.tombstones, action.Add.Path)
+	case action.Remove != nil:
+		delete(deltaLog.files, action.Remove.Path)
+		deltaLog.tombstones[action.Remove.Path] = action.Remove
+	}
+}
+
+//loads the table from its latest checkpoint and the commits after it
+func (deltaLog *deltaLog) load(ctx context.Context, store ObjectStore, tableKey string) error {
+
+	deltaLog.reset()
+
+	objects, err := store.List(ctx, tableKey+"/_delta_log")
+	if err != nil {
+		return err
+	}
+
+	checkpoint, firstCommit := int64(-1), int64(-1)
+	for _, object := range objects {
+		match := deltaLogFilePattern.FindStringSubmatch(object.key[strings.LastIndex(object.key, "/")+1:])
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.ParseInt(match[1], 10, 64)
+		if match[2] == "json" && (firstCommit < 0 || version < firstCommit) {
+			firstCommit = version
+		}
+		if match[2] != "json" && version > checkpoint {
+			checkpoint = version
+		}
+	}
+
+	if checkpoint >= 0 {
+		if err = deltaLog.readCheckpoint(ctx, store, tableKey, checkpoint); err != nil {
+			//the commits are replayed instead if they are still there
+			log.Println("Unable to read Delta checkpoint of "+tableKey, err)
+			deltaLog.reset()
+		}
+	}
+
+	if deltaLog.version < 0 && firstCommit > 0 {
+		return errors.New("the Delta log of " + tableKey + " cannot be replayed, its first commits have been removed")
+	}
+
+	if err = deltaLog.catchUp(ctx, store, tableKey); err != nil {
+		return err
+	}
+	deltaLog.loaded = true
+
+	return nil
+}
+
+func (deltaLog *deltaLog) readCheckpoint(ctx context.Context, store ObjectStore, tableKey string, version int64) error {
+
+	data, err := store.Read(ctx, deltaCheckpointKey(tableKey, version))
+	if err != nil {
+		return err
+	}
+
+	parquetReader, err := reader.NewParquetReader(buffer.NewBufferFileFromBytes(data), new(deltaAction), 4)
+	if err != nil {
+		return err
+	}
+	defer parquetReader.ReadStop()
+
+	actions := make([]deltaAction, parquetReader.GetNumRows())
+	if err = parquetReader.Read(&actions); err != nil {
+		return err
+	}
+
+	for _, action := range actions {
+		deltaLog.apply(action)
+	}
+	deltaLog.version = version
+
+	return nil
+}
+
+//applies the commits after the current version
+func (deltaLog *deltaLog) catchUp(ctx context.Context, store ObjectStore, tableKey string) error {
+
+	for {
+		data, err := store.Read(ctx, deltaCommitKey(tableKey, deltaLog.version+1))
+		if err == errObjectNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, line := range bytes.Split(data, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var action deltaAction
+			if err = json.Unmarshal(line, &action); err != nil {
+				return errors.New("invalid Delta commit " + deltaCommitKey(tableKey, deltaLog.version+1) + ": " + err.Error())
+			}
+			deltaLog.apply(action)
+		}
+		deltaLog.version++
+	}
+}
+
+//Delta type of a schema node
+func deltaType(node *schemaNode) interface{} {
+
+	switch node.dataType {
+	case "object":
+		return deltaStruct(node)
+	case "list":
+		return deltaArrayType{Type: "array", ElementType: deltaType(node.element), ContainsNull: true}
+	case "boolean":
+		return "boolean"
+	case "int64":
+		return "long"
+	case "double":
+		return "double"
+	case "timestamp_millis", "timestamp_micros":
+		return "timestamp"
+	}
+
+	if precision, scale, ok := decimalPrecisionScale(node.dataType); ok {
+		return fmt.Sprintf("decimal(%d,%d)", precision, scale)
+	}
+
+	return "string"
+}
+
+//all columns are nullable, fields the registry knows as required may still become optional later
+func deltaStruct(node *schemaNode) deltaStructType {
+
+	structType := deltaStructType{Type: "struct", Fields: make([]deltaField, 0)}
+	for _, name := range node.sortedFieldNames() {
+		structType.Fields = append(structType.Fields, deltaField{Name: name, Type: deltaType(node.fields[name]), Nullable: true, Metadata: map[string]interface{}{}})
+	}
+
+	return structType
+}
+
+//schemaString of a table, partition columns are added as strings and take the place of fields of the same name
+func deltaSchemaString(schema *schemaNode, partitionColumns []string) (string, error) {
+
+	structType := deltaStruct(schema)
+
+	for _, column := range partitionColumns {
+		partitionField := deltaField{Name: column, Type: "string", Nullable: true, Metadata: map[string]interface{}{}}
+		replaced := false
+		for index, field := range structType.Fields {
+			if field.Name == column {
+				structType.Fields[index] = partitionField
+				replaced = true
+			}
+		}
+		if !replaced {
+			structType.Fields = append(structType.Fields, partitionField)
+		}
+	}
+
+	schemaString, err := json.Marshal(structType)
+	return string(schemaString), err
+}
+
+//actions committing a file, the table is created with the first one
+func (deltaLog *deltaLog) commitActions(file tableFile, add *deltaAdd, schemaString string, partitionColumns []string) ([]deltaAction, error) {
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	partitionBy, _ := json.Marshal(partitionColumns)
+
+	actions := []deltaAction{{CommitInfo: &deltaCommitInfo{
+		Timestamp:           now,
+		Operation:           "WRITE",
+		OperationParameters: map[string]string{"mode": "Append", "partitionBy": string(partitionBy)},
+		IsBlindAppend:       true,
+		EngineInfo:          "rtdl-ingester",
+	}}}
+
+	if deltaLog.protocol == nil {
+		actions = append(actions, deltaAction{Protocol: &deltaProtocol{MinReaderVersion: 1, MinWriterVersion: 2}})
+	}
+
+	if deltaLog.metaData == nil {
+		actions = append(actions, deltaAction{MetaData: &deltaMetaData{
+			Id:               newTableId(),
+			Format:           deltaFormat{Provider: "parquet", Options: map[string]string{}},
+			SchemaString:     schemaString,
+			PartitionColumns: partitionColumns,
+			Configuration:    map[string]string{},
+			CreatedTime:      now,
+		}})
+	} else if deltaLog.metaData.SchemaString != schemaString {
+		if strings.Join(deltaLog.metaData.PartitionColumns, ",") != strings.Join(partitionColumns, ",") {
+			return nil, errors.New("the partition columns of Delta table " + file.tableKey() + " cannot change from " +
+				strings.Join(deltaLog.metaData.PartitionColumns, ",") + " to " + strings.Join(partitionColumns, ","))
+		}
+		metaData := *deltaLog.metaData
+		metaData.SchemaString = schemaString
+		actions = append(actions, deltaAction{MetaData: &metaData})
+	}
+
+	return append(actions, deltaAction{Add: add}), nil
+}
+
+func encodeDeltaActions(actions []deltaAction) ([]byte, error) {
+
+	var commit bytes.Buffer
+	for _, action := range actions {
+		line, err := json.Marshal(action)
+		if err != nil {
+			return nil, err
+		}
+		commit.Write(line)
+		commit.WriteByte('\n')
+	}
+
+	return commit.Bytes(), nil
+}
+
+//locks the state of a table, loading it first if it is not loaded
+func lockDeltaLog(ctx context.Context, store ObjectStore, tableKey string) (*deltaLog, error) {
+
+	deltaLog := openDeltaLog(store, tableKey)
+	deltaLog.Lock()
+
+	if !deltaLog.loaded {
+		if err := deltaLog.load(ctx, store, tableKey); err != nil {
+			deltaLog.Unlock()
+			return nil, err
+		}
+	}
+
+	return deltaLog, nil
+}
+
+//commits the actions built for the next version, they are built again for every attempt as the table may have
+//changed in between - a checkpoint is written if the commit is due for one
+func (deltaLog *deltaLog) commit(ctx context.Context, store ObjectStore, tableKey string, streamId string, buildActions func() ([]deltaAction, error)) error {
+
+	attempts := GetEnvInt("DELTA_COMMIT_ATTEMPTS", 10)
+	for attempt := 1; ; attempt++ {
+
+		actions, err := buildActions()
+		if err != nil {
+			return err
+		}
+		commit, err := encodeDeltaActions(actions)
+		if err != nil {
+			return err
+		}
+
+		err = store.PutIfAbsent(ctx, deltaCommitKey(tableKey, deltaLog.version+1), commit)
+		if err == nil {
+			for _, action := range actions {
+				deltaLog.apply(action)
+			}
+			deltaLog.version++
+			break
+		}
+
+		if err != errObjectExists || attempt >= attempts {
+			//the log may have moved on, it is read again with the next commit
+			deltaLog.loaded = false
+			return err
+		}
+
+		//another writer committed this version first
+		incrementCounter("delta_commit_conflicts", streamId)
+		if err = deltaLog.catchUp(ctx, store, tableKey); err != nil {
+			deltaLog.loaded = false
+			return err
+		}
+	}
+
+	incrementCounter("delta_commits", streamId)
+
+	if interval := int64(GetEnvInt("DELTA_CHECKPOINT_INTERVAL", 10)); interval > 0 && deltaLog.version > 0 && deltaLog.version%interval == 0 {
+		if err := deltaLog.writeCheckpoint(ctx, store, tableKey); err != nil {
+			log.Println("Unable to write Delta checkpoint of "+tableKey, err)
+		}
+	}
+
+	return nil
+}
+
+//add action of a file written to a table
+func deltaAddAction(file tableFile, dataChange bool) *deltaAdd {
+
+	stats, _ := json.Marshal(map[string]int{"numRecords": file.rows})
+
+	return &deltaAdd{
+		Path:             file.relativePath(),
+		PartitionValues:  file.partitionValues(),
+		Size:             file.size,
+		ModificationTime: time.Now().UnixNano() / int64(time.Millisecond),
+		DataChange:       dataChange,
+		Stats:            string(stats),
+	}
+}
+
+//commits a written file to the Delta table of its message type
+func commitDeltaFile(store ObjectStore, file tableFile) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	tableKey := file.tableKey()
+
+	deltaLog, err := lockDeltaLog(ctx, store, tableKey)
+	if err != nil {
+		return err
+	}
+	defer deltaLog.Unlock()
+
+	partitionColumns := partitionColumns(file.configRecord)
+	if partitionColumns == nil {
+		partitionColumns = []string{}
+	}
+	schemaString, err := deltaSchemaString(file.schema, partitionColumns)
+	if err != nil {
+		return err
+	}
+
+	add := deltaAddAction(file, true)
+	err = deltaLog.commit(ctx, store, tableKey, configString(file.configRecord, "stream_id"), func() ([]deltaAction, error) {
+		return deltaLog.commitActions(file, add, schemaString, partitionColumns)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Committed " + file.key + " to Delta table " + tableKey + " as version " + strconv.FormatInt(deltaLog.version, 10))
+
+	return nil
+}
+
+//keys of the data files of the Delta table of the file as of its latest version
+func deltaTableFiles(store ObjectStore, file tableFile) (map[string]bool, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	tableKey := file.tableKey()
+
+	deltaLog, err := lockDeltaLog(ctx, store, tableKey)
+	if err != nil {
+		return nil, err
+	}
+	defer deltaLog.Unlock()
+
+	if err = deltaLog.catchUp(ctx, store, tableKey); err != nil {
+		deltaLog.loaded = false
+		return nil, err
+	}
+
+	keys := make(map[string]bool, len(deltaLog.files))
+	for path := range deltaLog.files {
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			path = unescaped
+		}
+		keys[tableKey+"/"+path] = true
+	}
+
+	return keys, nil
+}
+
+//commits a file merging the originals in their place, as Delta's OPTIMIZE does the rows are not changed and
+//readers of the table's changes skip the commit
+//fails if an original is no longer part of the table, e.g. as another instance has merged it already
+func replaceDeltaFiles(store ObjectStore, merged tableFile, originals []tableFile) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	tableKey := merged.tableKey()
+
+	deltaLog, err := lockDeltaLog(ctx, store, tableKey)
+	if err != nil {
+		return err
+	}
+	defer deltaLog.Unlock()
+
+	add := deltaAddAction(merged, false)
+	err = deltaLog.commit(ctx, store, tableKey, configString(merged.configRecord, "stream_id"), func() ([]deltaAction, error) {
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		actions := []deltaAction{{CommitInfo: &deltaCommitInfo{
+			Timestamp:           now,
+			Operation:           "OPTIMIZE",
+			OperationParameters: map[string]string{"predicate": "[]", "zOrderBy": "[]"},
+			IsBlindAppend:       false,
+			EngineInfo:          "rtdl-ingester",
+		}}}
+
+		for _, original := range originals {
+			committed := deltaLog.files[original.relativePath()]
+			if committed == nil {
+				return nil, errors.New(original.key + " is no longer part of Delta table " + tableKey)
+			}
+			actions = append(actions, deltaAction{Remove: &deltaRemove{
+				Path:              committed.Path,
+				DeletionTimestamp: now,
+				DataChange:        false,
+				PartitionValues:   committed.PartitionValues,
+				Size:              committed.Size,
+			}})
+		}
+
+		return append(actions, deltaAction{Add: add}), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Println("Committed " + merged.key + " to Delta table " + tableKey + " in place of " + strconv.Itoa(len(originals)) + " files as version " + strconv.FormatInt(deltaLog.version, 10))
+
+	return nil
+}
+
+//writes the state of the table as a checkpoint and points _last_checkpoint to it
+//tombstones past their retention are left out, a missing checkpoint only makes loading the table slower
+func (deltaLog *deltaLog) writeCheckpoint(ctx context.Context, store ObjectStore, tableKey string) error {
+
+	actions := []deltaAction{{Protocol: deltaLog.protocol}, {MetaData: deltaLog.metaData}}
+	for _, add := range deltaLog.files {
+		actions = append(actions, deltaAction{Add: add})
+	}
+	expiry := time.Now().Add(-deltaTombstoneRetention).UnixNano() / int64(time.Millisecond)
+	for path, remove := range deltaLog.tombstones {
+		if remove.DeletionTimestamp < expiry {
+			delete(deltaLog.tombstones, path)
+			continue
+		}
+		actions = append(actions, deltaAction{Remove: remove})
+	}
+
+	checkpoint := buffer.NewBufferFile()
+	parquetWriter, err := writer.NewParquetWriter(checkpoint, new(deltaAction), 4)
+	if err != nil {
+		return err
+	}
+	parquetWriter.CompressionType = parquet.CompressionCodec_SNAPPY
+
+	for index := range actions {
+		if err = parquetWriter.Write(actions[index]); err != nil {
+			return err
+		}
+	}
+	if err = parquetWriter.WriteStop(); err != nil {
+		return err
+	}
+
+	if err = putObject(ctx, store, deltaCheckpointKey(tableKey, deltaLog.version), checkpoint.Bytes()); err != nil {
+		return err
+	}
+
+	lastCheckpoint, _ := json.Marshal(map[string]int64{"version": deltaLog.version, "size": int64(len(actions))})
+	return putObject(ctx, store, tableKey+"/_delta_log/_last_checkpoint", lastCheckpoint)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"reflect"
+	"strconv"
+
+	"statefun.io/greeter/dremio"
+)
+
+//every stream is a Dremio source named after its stream id, with a dataset per message type
+//DREMIO_DEPLOYMENT selects Dremio Software (`software`, the default) or Dremio Cloud (`cloud`), Cloud takes the
+//project of DREMIO_CLOUD_PROJECT_ID and a personal access token in DREMIO_PASSWORD
+//`dremio_metadata_policy` of a stream is the metadataPolicy of its source, e.g. {"datasetRefreshAfterMs": 60000},
+//Azure sources without one keep refreshing their metadata every minute
+var azureMetadataPolicy = map[string]interface{}{
+	"datasetUpdateMode":     "INLINE",
+	"datasetRefreshAfterMs": float64(60000),
+	"namesRefreshMs":        float64(60000),
+	"authTTLMs":             float64(60000),
+	"datasetExpireAfterMs":  float64(60000),
+}
+
+//initialize Dremio connection
+func SetDremioConnection() error {
+
+	deployment, err := dremio.ParseDeployment(GetEnv("DREMIO_DEPLOYMENT", "software"))
+	if err != nil {
+		return err
+	}
+
+	dremioClient, err = dremio.NewClient(dremio.Config{
+		Deployment: deployment,
+		Host:       GetEnv("DREMIO_HOST", "host.docker.internal"),
+		Port:       GetEnv("DREMIO_PORT", "9047"),
+		Username:   GetEnv("DREMIO_USERNAME", "rtdl"),
+		Password:   GetEnv("DREMIO_PASSWORD", "rtdl1234"),
+		ProjectId:  GetEnv("DREMIO_CLOUD_PROJECT_ID", ""),
+	})
+
+	return err
+}
+
+//format Dremio reads the folder of a message type with, Delta and Iceberg tables are read through their metadata
+func dremioDatasetFormat(configRecord map[string]interface{}) map[string]interface{} {
+	switch streamTableFormat(configRecord) {
+	case "table_format_delta":
+		return map[string]interface{}{"type": "Delta"}
+	case "table_format_iceberg":
+		return map[string]interface{}{"type": "Iceberg"}
+	}
+	return map[string]interface{}{"type": "Parquet"}
+}
+
+//path of the dataset of a message type, Dremio Cloud sources are rooted at the top of the bucket
+func dremioDatasetPath(messageType string, configRecord map[string]interface{}) []string {
+
+	path := []string{configString(configRecord, "stream_id")}
+	if dremioClient.Deployment() == dremio.Cloud {
+		path = append(path, configString(configRecord, "bucket_name"))
+		if folderName := configString(configRecord, "folder_name"); folderName != "" {
+			path = append(path, folderName)
+		}
+	}
+
+	return append(path, messageType)
+}
+
+//metadata policy of the source of a stream, nil for Dremio's defaults
+func dremioMetadataPolicy(sourceType string, configRecord map[string]interface{}) map[string]interface{} {
+
+	if policy, ok := configRecord["dremio_metadata_policy"].(map[string]interface{}); ok && len(policy) > 0 {
+		return policy
+	}
+	if sourceType == "Azure" {
+		return azureMetadataPolicy
+	}
+
+	return nil
+}
+
+//root path of a source below its location, with a trailing slash
+func dremioRootPath(location string, configRecord map[string]interface{}) string {
+
+	rootPath := "/" + location + "/"
+	if folderName := configString(configRecord, "folder_name"); folderName != "" {
+		rootPath += folderName + "/"
+	}
+
+	return rootPath
+}
+
+//definition of the source of a stream
+func dremioSourceDefinition(sourceType string, location string, configRecord map[string]interface{}) (map[string]interface{}, error) {
+
+	var sourceConfig map[string]interface{}
+	definition := map[string]interface{}{"name": configString(configRecord, "stream_id")}
+
+	switch sourceType {
+
+	case "Local":
+		definition["type"] = "NAS"
+		sourceConfig = map[string]interface{}{"path": "file:///" + GetEnv("DREMIO_MOUNT_PATH", "/mnt/datastore") + "/" + configString(configRecord, "folder_name")}
+
+	case "S3":
+		definition["type"] = "S3"
+		sourceConfig = map[string]interface{}{
+			"accessKey":    configString(configRecord, "aws_access_key_id"),
+			"accessSecret": configString(configRecord, "aws_secret_access_key"),
+			"rootPath":     dremioRootPath(location, configRecord),
+		}
+		if dremioClient.Deployment() == dremio.Cloud {
+			sourceConfig["rootPath"] = "/"
+		}
+
+		//S3-compatible stores are reached through the S3A properties in compatibility mode
+		//Dremio verifies certificates against its own trust store, s3_tls_verify and s3_ca_cert do not apply
+		s3Endpoint, err := streamS3Endpoint(configRecord)
+		if err != nil {
+			return nil, err
+		}
+		if s3Endpoint.url != "" {
+			sourceConfig["compatibilityMode"] = true
+			sourceConfig["secure"] = s3Endpoint.secure
+			sourceConfig["propertyList"] = []map[string]string{
+				{"name": "fs.s3a.endpoint", "value": s3Endpoint.host},
+				{"name": "fs.s3a.path.style.access", "value": strconv.FormatBool(s3Endpoint.pathStyle)},
+				{"name": "fs.s3a.connection.ssl.enabled", "value": strconv.FormatBool(s3Endpoint.secure)},
+			}
+		}
+
+	case "GCS":
+		//need to extract all variable values from GCP crendentials object
+		var gcpCreds map[string]interface{}
+		if err := json.Unmarshal([]byte(configString(configRecord, "gcp_json_credentials")), &gcpCreds); err != nil {
+			log.Println("Error reading GCP credentials from configuration record", err)
+			return nil, err
+		}
+
+		definition["type"] = "GCS"
+		sourceConfig = map[string]interface{}{
+			"projectId":    gcpCreds["project_id"],
+			"authMode":     "SERVICE_ACCOUNT_KEYS",
+			"clientEmail":  gcpCreds["client_email"],
+			"clientId":     gcpCreds["client_id"],
+			"privateKeyId": gcpCreds["private_key_id"],
+			"privateKey":   gcpCreds["private_key"],
+			"rootPath":     dremioRootPath(location, configRecord),
+		}
+
+	case "Azure":
+		definition["type"] = "AZURE_STORAGE"
+		sourceConfig = map[string]interface{}{
+			"accountName":      configString(configRecord, "azure_storage_account_name"),
+			"enableSSL":        true,
+			"isCachingEnabled": false,
+			"accountKind":      "STORAGE_V2", //candidate for future customisation
+			"credentialsType":  "ACCESS_KEY",
+			"accessKey":        configString(configRecord, "azure_storage_access_key"),
+			"rootPath":         dremioRootPath(location, configRecord),
+		}
+
+	case "HDFS":
+		port, _ := configRecord["namenode_port"].(float64)
+		definition["type"] = "HDFS"
+		sourceConfig = map[string]interface{}{
+			"hostname": configString(configRecord, "namenode_host"),
+			"port":     int(port),
+			"rootPath": dremioRootPath(location, configRecord),
+		}
+
+	default:
+		return nil, errors.New("Dremio cannot read " + sourceType + " file stores")
+	}
+
+	//Hive-style partition directories are read as columns
+	if len(partitionColumns(configRecord)) > 0 {
+		sourceConfig["isPartitionInferenceEnabled"] = true
+	}
+
+	definition["config"] = sourceConfig
+	if policy := dremioMetadataPolicy(sourceType, configRecord); policy != nil {
+		definition["metadataPolicy"] = policy
+	}
+
+	return definition, nil
+}
+
+//creates the source of a stream, or updates its metadata policy if the stream sets one that differs
+func ensureDremioSource(sourceType string, location string, configRecord map[string]interface{}) error {
+
+	source, err := dremioClient.Source(configString(configRecord, "stream_id"))
+
+	if errors.Is(err, dremio.ErrNotFound) {
+		log.Println("Source does not exist for stream, creating ...")
+		definition, err := dremioSourceDefinition(sourceType, location, configRecord)
+		if err != nil {
+			return err
+		}
+		if err = dremioClient.CreateSource(definition); err != nil && !errors.Is(err, dremio.ErrConflict) {
+			log.Println("Error creating Dremio source ", err)
+			return err
+		}
+		return nil
+	}
+	if err != nil {
+		log.Println("Error retrieving Dremio source information ", err)
+		return err
+	}
+
+	policy, ok := configRecord["dremio_metadata_policy"].(map[string]interface{})
+	if !ok || len(policy) == 0 {
+		return nil
+	}
+
+	//Dremio returns the policy with all of its settings, only the ones of the stream are compared
+	current, _ := source["metadataPolicy"].(map[string]interface{})
+	changed := current == nil
+	for key, value := range policy {
+		if current != nil && !reflect.DeepEqual(current[key], value) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	updated := make(map[string]interface{})
+	for key, value := range current {
+		updated[key] = value
+	}
+	for key, value := range policy {
+		updated[key] = value
+	}
+	source["metadataPolicy"] = updated
+
+	log.Println("Updating the metadata policy of Dremio source " + configString(configRecord, "stream_id"))
+	return dremioClient.UpdateSource(source)
+}
+
+//Function for making Dremio entry
+//creates the source of the stream and promotes the folder of the message type to a dataset, unless they exist
+func UpdateDremio(messageType string, sourceType string, location string, configRecord map[string]interface{}) error {
+
+	if err := ensureDremioSource(sourceType, location, configRecord); err != nil {
+		return err
+	}
+
+	if sourceType == "HDFS" {
+		return nil //HDFS dataset creation to be done separately
+	}
+
+	path := dremioDatasetPath(messageType, configRecord)
+	entity, err := dremioClient.EntityByPath(path)
+	if err != nil && !errors.Is(err, dremio.ErrNotFound) {
+		log.Println("Error retrieving Dremio dataset information ", err)
+		return err
+	}
+	if entity != nil && entity.EntityType == "dataset" {
+		return nil
+	}
+
+	//a folder promoted concurrently is fine
+	if err = dremioClient.PromoteDataset(path, dremioDatasetFormat(configRecord)); err != nil && !errors.Is(err, dremio.ErrConflict) {
+		log.Println("Error creating Dremio dataset ", err)
+		return err
+	}
+
+	log.Println("Dremio dataset " + dremio.QuotePath(path) + " created")
+	return nil
+}
+
+//Write local Parquet
+func CreateHDFSDataset(messageType string, configRecord map[string]interface{}) error {
+
+	err := dremioClient.SetFolderFormat(configString(configRecord, "stream_id"), messageType, dremioDatasetFormat(configRecord))
+	if err != nil && !errors.Is(err, dremio.ErrConflict) {
+		log.Println(err)
+		return err
+	}
+
+	return nil
+}
+
+//refreshes the metadata of the dataset of a file after a new partition was written, so that queries see it
+//before the source's next metadata refresh - only the new partition of Hive-style partitioned Parquet datasets
+func refreshDremioPartition(file tableFile) error {
+
+	partitions := make(map[string]string)
+	if streamTableFormat(file.configRecord) == "" {
+		for column, value := range file.partitionValues() {
+			if value == nil {
+				//the default partition is not addressable by value
+				partitions = nil
+				break
+			}
+			partitions[column] = *value
+		}
+	}
+
+	_, err := dremioClient.RefreshMetadata(dremioDatasetPath(file.messageType, file.configRecord), partitions)
+	return err
+}
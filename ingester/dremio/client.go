@@ -0,0 +1,351 @@
+//Dremio REST client of the ingester
+//Dremio Software is reached on http://<host>:<port> and logs in with a user name and password, the token of the
+//login is renewed whenever Dremio answers 401 - Dremio Cloud is reached on https://<host>/v0/projects/<project id>
+//with a personal access token
+package dremio
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//deployment type of the Dremio server
+type Deployment string
+
+const (
+	Software Deployment = "software"
+	Cloud    Deployment = "cloud"
+)
+
+//connection settings of a client
+type Config struct {
+	Deployment Deployment
+	Host       string
+	Port       string //Software only
+	Username   string //Software only
+	Password   string //password on Software, personal access token on Cloud
+	ProjectId  string //Cloud only
+	Timeout    time.Duration
+}
+
+type Client struct {
+	config     Config
+	httpClient *http.Client
+
+	lock  sync.Mutex
+	token string //Authorization header, blank until logged in
+}
+
+//catalog entity, a source, space, folder or dataset
+type Entity struct {
+	Id         string   `json:"id"`
+	EntityType string   `json:"entityType"`
+	Type       string   `json:"type"`
+	Path       []string `json:"path"`
+}
+
+//deployment type of a setting, software if blank
+func ParseDeployment(value string) (Deployment, error) {
+	switch Deployment(strings.ToLower(strings.TrimSpace(value))) {
+	case "", Software:
+		return Software, nil
+	case Cloud:
+		return Cloud, nil
+	}
+	return "", errors.New("invalid Dremio deployment type " + value + ", must be software or cloud")
+}
+
+//client of a Dremio server, logs in right away
+func NewClient(config Config) (*Client, error) {
+
+	if config.Host == "" {
+		return nil, errors.New("Dremio host cannot be blank")
+	}
+	if config.Deployment == Cloud && (config.ProjectId == "" || config.Password == "") {
+		return nil, errors.New("Dremio Cloud requires a project id and a personal access token")
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 60 * time.Second
+	}
+
+	client := &Client{config: config, httpClient: &http.Client{Timeout: config.Timeout}}
+	if err := client.login(); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (client *Client) Deployment() Deployment {
+	return client.config.Deployment
+}
+
+//URL of an endpoint, v2 endpoints only exist on Software
+func (client *Client) url(endpoint string, v2 bool) string {
+
+	if client.config.Deployment == Cloud {
+		return "https://" + client.config.Host + "/v0/projects/" + client.config.ProjectId + "/" + endpoint
+	}
+
+	version := "api/v3"
+	if v2 {
+		version = "apiv2"
+	}
+	return "http://" + client.config.Host + ":" + client.config.Port + "/" + version + "/" + endpoint
+}
+
+//retrieves a new token, Cloud tokens do not expire with a session
+func (client *Client) login() error {
+
+	if client.config.Deployment == Cloud {
+		client.setToken("Bearer " + client.config.Password)
+		return nil
+	}
+
+	credentials, err := json.Marshal(map[string]string{"userName": client.config.Username, "password": client.config.Password})
+	if err != nil {
+		return err
+	}
+
+	body, err := client.send(http.MethodPost, client.url("login", true), credentials, "")
+	if err != nil {
+		return err
+	}
+
+	var response struct {
+		Token string `json:"token"`
+	}
+	if err = json.Unmarshal(body, &response); err != nil {
+		return &Error{Method: http.MethodPost, Endpoint: "login", Message: "invalid response: " + err.Error()}
+	}
+	if response.Token == "" {
+		return &Error{Method: http.MethodPost, Endpoint: "login", Message: "no token in response"}
+	}
+
+	client.setToken(response.Token)
+	return nil
+}
+
+func (client *Client) setToken(token string) {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	client.token = token
+}
+
+func (client *Client) currentToken() string {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.token
+}
+
+//sends a request and returns the body of a successful response, responses other than 2xx are an *Error
+func (client *Client) send(method string, url string, data []byte, token string) ([]byte, error) {
+
+	var payload *bytes.Reader
+	if data != nil {
+		payload = bytes.NewReader(data)
+	} else {
+		payload = bytes.NewReader([]byte{})
+	}
+
+	request, err := http.NewRequest(method, url, payload)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json; charset=UTF-8")
+	if token != "" {
+		request.Header.Set("Authorization", token)
+	}
+
+	response, err := client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, newError(method, url, response.StatusCode, body)
+	}
+
+	return body, nil
+}
+
+//sends a request with the current token, logs in again and repeats the request once if the token has expired
+func (client *Client) do(method string, endpoint string, v2 bool, data []byte) ([]byte, error) {
+
+	token := client.currentToken()
+	body, err := client.send(method, client.url(endpoint, v2), data, token)
+	if err == nil || !errors.Is(err, ErrUnauthorized) || client.config.Deployment == Cloud {
+		return body, err
+	}
+
+	//another request may have logged in already
+	if client.currentToken() == token {
+		if err = client.login(); err != nil {
+			return nil, err
+		}
+	}
+
+	return client.send(method, client.url(endpoint, v2), data, client.currentToken())
+}
+
+//decodes the JSON response of a request into result, unless result is nil
+func (client *Client) call(method string, endpoint string, v2 bool, request interface{}, result interface{}) error {
+
+	var data []byte
+	if request != nil {
+		var err error
+		if data, err = json.Marshal(request); err != nil {
+			return err
+		}
+	}
+
+	body, err := client.do(method, endpoint, v2, data)
+	if err != nil {
+		return err
+	}
+
+	if result == nil || len(body) == 0 {
+		return nil
+	}
+	if err = json.Unmarshal(body, result); err != nil {
+		return &Error{Method: method, Endpoint: endpoint, Message: "invalid response: " + err.Error()}
+	}
+
+	return nil
+}
+
+//escapes the components of a catalog path
+func escapePath(path []string) string {
+	escaped := make([]string, len(path))
+	for index, component := range path {
+		escaped[index] = url.PathEscape(component)
+	}
+	return strings.Join(escaped, "/")
+}
+
+//catalog entity at path, an error matching ErrNotFound if there is none
+func (client *Client) EntityByPath(path []string) (*Entity, error) {
+
+	var entity Entity
+	if err := client.call(http.MethodGet, "catalog/by-path/"+escapePath(path), false, nil, &entity); err != nil {
+		return nil, err
+	}
+
+	return &entity, nil
+}
+
+//creates a source from its definition (name, type, config and optionally metadataPolicy)
+func (client *Client) CreateSource(definition map[string]interface{}) error {
+	return client.call(http.MethodPost, "source", false, definition, nil)
+}
+
+//definition of an existing source, an error matching ErrNotFound if there is none
+func (client *Client) Source(name string) (map[string]interface{}, error) {
+
+	var source map[string]interface{}
+	if err := client.call(http.MethodGet, "catalog/by-path/"+url.PathEscape(name), false, nil, &source); err != nil {
+		return nil, err
+	}
+
+	return source, nil
+}
+
+//updates an existing source with its definition as returned by Source, which includes the tag Dremio requires
+func (client *Client) UpdateSource(definition map[string]interface{}) error {
+
+	id, _ := definition["id"].(string)
+	if id == "" {
+		return errors.New("source definition without id")
+	}
+
+	update := make(map[string]interface{})
+	for key, value := range definition {
+		if key != "children" {
+			update[key] = value
+		}
+	}
+
+	return client.call(http.MethodPut, "catalog/"+url.PathEscape(id), false, update, nil)
+}
+
+//promotes the folder at path to a dataset read with format, e.g. {"type": "Parquet"}
+func (client *Client) PromoteDataset(path []string, format map[string]interface{}) error {
+
+	//the id of a folder that has not been promoted is its escaped path
+	id := "dremio%3A%2F" + strings.Replace(escapePath(path), "/", "%2F", -1)
+	definition := map[string]interface{}{
+		"id":         id,
+		"entityType": "dataset",
+		"path":       path,
+		"format":     format,
+		"type":       "PHYSICAL_DATASET",
+	}
+
+	return client.call(http.MethodPost, "catalog/"+id, false, definition, nil)
+}
+
+//sets the format of a folder of a source, which promotes it to a dataset (Software only, e.g. for HDFS sources)
+func (client *Client) SetFolderFormat(source string, folder string, format map[string]interface{}) error {
+	return client.call(http.MethodPut, "source/"+url.PathEscape(source)+"/folder_format/"+escapePath(strings.Split(folder, "/")), true, format, nil)
+}
+
+//submits a SQL statement and returns the id of its job, which runs asynchronously
+func (client *Client) Submit(sql string) (string, error) {
+
+	var job struct {
+		Id string `json:"id"`
+	}
+	if err := client.call(http.MethodPost, "sql", false, map[string]string{"sql": sql}, &job); err != nil {
+		return "", err
+	}
+
+	return job.Id, nil
+}
+
+//quotes a catalog path for SQL
+func QuotePath(path []string) string {
+	quoted := make([]string, len(path))
+	for index, component := range path {
+		quoted[index] = `"` + strings.Replace(component, `"`, `""`, -1) + `"`
+	}
+	return strings.Join(quoted, ".")
+}
+
+//refreshes the metadata of the dataset at path, of the given partitions only unless partitions is empty
+//partitions maps partition columns to their values, the refresh runs as a job
+func (client *Client) RefreshMetadata(path []string, partitions map[string]string) (string, error) {
+
+	sql := "ALTER TABLE " + QuotePath(path) + " REFRESH METADATA"
+
+	if len(partitions) > 0 {
+		columns := make([]string, 0, len(partitions))
+		for column := range partitions {
+			columns = append(columns, column)
+		}
+		sort.Strings(columns)
+
+		conditions := make([]string, len(columns))
+		for index, column := range columns {
+			conditions[index] = QuotePath([]string{column}) + " = '" + strings.Replace(partitions[column], "'", "''", -1) + "'"
+		}
+		sql += " FOR PARTITIONS (" + strings.Join(conditions, ", ") + ")"
+	}
+
+	return client.Submit(sql)
+}
@@ -0,0 +1,62 @@
+package dremio
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+//errors of responses by their status, match them with errors.Is
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+)
+
+//error of a request Dremio did not answer with success, StatusCode is 0 for responses that could not be read
+type Error struct {
+	Method     string
+	Endpoint   string
+	StatusCode int
+	Message    string
+}
+
+//error of a response with status, the message is taken from Dremio's error body if there is one
+func newError(method string, endpoint string, status int, body []byte) *Error {
+
+	var response struct {
+		ErrorMessage string `json:"errorMessage"`
+	}
+	message := string(body)
+	if json.Unmarshal(body, &response) == nil && response.ErrorMessage != "" {
+		message = response.ErrorMessage
+	}
+	if len(message) > 500 {
+		message = message[:500]
+	}
+
+	return &Error{Method: method, Endpoint: endpoint, StatusCode: status, Message: message}
+}
+
+func (err *Error) Error() string {
+	text := "Dremio " + err.Method + " " + err.Endpoint
+	if err.StatusCode != 0 {
+		text += " returned " + strconv.Itoa(err.StatusCode)
+	}
+	if err.Message != "" {
+		text += ": " + err.Message
+	}
+	return text
+}
+
+func (err *Error) Is(target error) bool {
+	switch target {
+	case ErrUnauthorized:
+		return err.StatusCode == 401
+	case ErrNotFound:
+		return err.StatusCode == 404
+	case ErrConflict:
+		return err.StatusCode == 409
+	}
+	return false
+}
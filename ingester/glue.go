@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+//Glue tables of a stream are either found by a crawler per message type on a schedule (glue_mode "crawler", the
+//default) or maintained by the ingester itself (glue_mode "direct"): the table is created from the inferred schema
+//with the first file, its columns are updated whenever the schema changes and a new partition is added as soon as
+//its first file is written, so that Athena sees new data right away
+//Delta and Iceberg tables are registered with their table_type, Athena reads their files and schema from the
+//table's own metadata - the metadata location of Iceberg tables is updated after every commit
+//glue_endpoint points the client to a Glue-compatible service instead of AWS, e.g. for testing
+const (
+	glueModeCrawler = "crawler"
+	glueModeDirect  = "direct"
+)
+
+//fingerprints of the schemas the Glue tables were last updated with
+var glueSchemas = struct {
+	sync.Mutex
+	entries map[string]string
+}{entries: make(map[string]string)}
+
+func glueMode(configRecord map[string]interface{}) string {
+	if configString(configRecord, "glue_mode") == glueModeDirect {
+		return glueModeDirect
+	}
+	return glueModeCrawler
+}
+
+//Glue client of a stream
+func newGlueClient(configRecord map[string]interface{}, awsSession client.ConfigProvider) *glue.Glue {
+
+	config := aws.NewConfig().WithRegion(configString(configRecord, "region"))
+	if endpoint := configString(configRecord, "glue_endpoint"); endpoint != "" {
+		config = config.WithEndpoint(endpoint)
+	}
+
+	return glue.New(awsSession, config)
+}
+
+func glueErrorCode(err error) string {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code()
+	}
+	return ""
+}
+
+//creates the database of a stream, named after the stream id, unless it exists
+func ensureGlueDatabase(glueClient *glue.Glue, streamId string) error {
+
+	_, err := glueClient.GetDatabase(&glue.GetDatabaseInput{Name: &streamId})
+	if err == nil {
+		return nil
+	}
+	if glueErrorCode(err) != glue.ErrCodeEntityNotFoundException {
+		return err
+	}
+
+	_, err = glueClient.CreateDatabase(&glue.CreateDatabaseInput{DatabaseInput: &glue.DatabaseInput{Name: &streamId}})
+	if err != nil && glueErrorCode(err) != glue.ErrCodeAlreadyExistsException {
+		log.Println("Error creating Glue database", err)
+		return err
+	}
+
+	log.Println("Glue database created")
+	return nil
+}
+
+//Hive type of a schema node
+func glueType(node *schemaNode) string {
+
+	switch node.dataType {
+	case "object":
+		fields := make([]string, 0, len(node.fields))
+		for _, name := range node.sortedFieldNames() {
+			fields = append(fields, name+":"+glueType(node.fields[name]))
+		}
+		return "struct<" + strings.Join(fields, ",") + ">"
+	case "list":
+		return "array<" + glueType(node.element) + ">"
+	case "boolean":
+		return "boolean"
+	case "int64":
+		return "bigint"
+	case "double":
+		return "double"
+	case "timestamp_millis", "timestamp_micros":
+		return "timestamp"
+	}
+
+	if precision, scale, ok := decimalPrecisionScale(node.dataType); ok {
+		return fmt.Sprintf("decimal(%d,%d)", precision, scale)
+	}
+
+	return "string"
+}
+
+//name of the Glue table of a message type, Glue keeps names in lower case
+func glueTableName(messageType string) string {
+	return strings.ToLower(messageType)
+}
+
+//columns of the schema, columns of the existing table the schema no longer has are kept
+//partition columns are left out, Hive does not allow data columns of the same name
+func glueColumns(schema *schemaNode, partitionColumns []string, existing []*glue.Column) []*glue.Column {
+
+	skip := make(map[string]bool)
+	for _, column := range partitionColumns {
+		skip[strings.ToLower(column)] = true
+	}
+
+	columns := make([]*glue.Column, 0)
+	types := make(map[string]string)
+	if schema != nil {
+		for _, name := range schema.sortedFieldNames() {
+			types[strings.ToLower(name)] = glueType(schema.fields[name])
+		}
+	}
+
+	//existing columns keep their position
+	for _, column := range existing {
+		name := strings.ToLower(aws.StringValue(column.Name))
+		if skip[name] {
+			continue
+		}
+		skip[name] = true
+		columnType := aws.StringValue(column.Type)
+		if schemaType, found := types[name]; found {
+			columnType = schemaType
+		}
+		columns = append(columns, &glue.Column{Name: aws.String(name), Type: aws.String(columnType)})
+	}
+
+	if schema != nil {
+		for _, name := range schema.sortedFieldNames() {
+			if !skip[strings.ToLower(name)] {
+				skip[strings.ToLower(name)] = true
+				columns = append(columns, &glue.Column{Name: aws.String(strings.ToLower(name)), Type: aws.String(types[strings.ToLower(name)])})
+			}
+		}
+	}
+
+	return columns
+}
+
+//storage descriptor of Parquet files at location
+func glueStorageDescriptor(location string, columns []*glue.Column) *glue.StorageDescriptor {
+	return &glue.StorageDescriptor{
+		Columns:      columns,
+		Location:     aws.String(location),
+		InputFormat:  aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetInputFormat"),
+		OutputFormat: aws.String("org.apache.hadoop.hive.ql.io.parquet.MapredParquetOutputFormat"),
+		SerdeInfo: &glue.SerDeInfo{
+			SerializationLibrary: aws.String("org.apache.hadoop.hive.ql.io.parquet.serde.ParquetHiveSerDe"),
+			Parameters:           map[string]*string{"serialization.format": aws.String("1")},
+		},
+	}
+}
+
+//definition of the table of the file, existing is the current definition if the table exists
+func glueTableInput(store ObjectStore, file tableFile, existing *glue.TableData) *glue.TableInput {
+
+	var existingColumns []*glue.Column
+	parameters := map[string]*string{"classification": aws.String("parquet"), "rtdl_stream_id": aws.String(configString(file.configRecord, "stream_id"))}
+	if existing != nil {
+		if existing.StorageDescriptor != nil {
+			existingColumns = existing.StorageDescriptor.Columns
+		}
+		for key, value := range existing.Parameters {
+			parameters[key] = value
+		}
+	}
+
+	input := &glue.TableInput{
+		Name:       aws.String(glueTableName(file.messageType)),
+		TableType:  aws.String("EXTERNAL_TABLE"),
+		Parameters: parameters,
+	}
+
+	location := store.URI(file.tableKey() + "/")
+
+	switch streamTableFormat(file.configRecord) {
+
+	case "table_format_delta":
+		parameters["table_type"] = aws.String("DELTA")
+		parameters["spark.sql.sources.provider"] = aws.String("delta")
+		input.StorageDescriptor = glueStorageDescriptor(location, glueColumns(file.schema, nil, existingColumns))
+
+	case "table_format_iceberg":
+		parameters["table_type"] = aws.String("ICEBERG")
+		if metadataLocation := icebergMetadataLocation(store, file.tableKey()); metadataLocation != "" {
+			if current := parameters["metadata_location"]; current != nil && aws.StringValue(current) != metadataLocation {
+				parameters["previous_metadata_location"] = current
+			}
+			parameters["metadata_location"] = aws.String(metadataLocation)
+		}
+		input.StorageDescriptor = glueStorageDescriptor(location, glueColumns(file.schema, nil, existingColumns))
+
+	default:
+		columns := partitionColumns(file.configRecord)
+		input.StorageDescriptor = glueStorageDescriptor(location, glueColumns(file.schema, columns, existingColumns))
+		for _, column := range columns {
+			input.PartitionKeys = append(input.PartitionKeys, &glue.Column{Name: aws.String(strings.ToLower(column)), Type: aws.String("string")})
+		}
+	}
+
+	//partition keys cannot be changed once the table exists
+	if existing != nil {
+		input.PartitionKeys = existing.PartitionKeys
+	}
+
+	return input
+}
+
+//creates the Glue table of the file or updates its definition, e.g. its columns after the schema changed
+func upsertGlueTable(store *s3Store, file tableFile) error {
+
+	streamId := configString(file.configRecord, "stream_id")
+	glueClient := newGlueClient(file.configRecord, store.session)
+
+	if err := ensureGlueDatabase(glueClient, streamId); err != nil {
+		return err
+	}
+
+	output, err := glueClient.GetTable(&glue.GetTableInput{DatabaseName: &streamId, Name: aws.String(glueTableName(file.messageType))})
+	if err != nil && glueErrorCode(err) != glue.ErrCodeEntityNotFoundException {
+		return err
+	}
+
+	if err != nil {
+		_, err = glueClient.CreateTable(&glue.CreateTableInput{DatabaseName: &streamId, TableInput: glueTableInput(store, file, nil)})
+		if err == nil {
+			log.Println("Glue table " + streamId + "." + glueTableName(file.messageType) + " created")
+			return nil
+		}
+		if glueErrorCode(err) != glue.ErrCodeAlreadyExistsException {
+			return err
+		}
+		//created concurrently, updated below
+		if output, err = glueClient.GetTable(&glue.GetTableInput{DatabaseName: &streamId, Name: aws.String(glueTableName(file.messageType))}); err != nil {
+			return err
+		}
+	}
+
+	_, err = glueClient.UpdateTable(&glue.UpdateTableInput{DatabaseName: &streamId, TableInput: glueTableInput(store, file, output.Table), SkipArchive: aws.Bool(true)})
+	return err
+}
+
+//registers the partition of the file with the Glue table, partitions that already exist are fine
+//only tables of plain Parquet files with Hive-style partitions have Glue partitions
+func createGluePartition(store *s3Store, file tableFile) error {
+
+	columns := partitionColumns(file.configRecord)
+	if len(columns) == 0 || streamTableFormat(file.configRecord) != "" {
+		return nil
+	}
+
+	values := make([]*string, len(columns))
+	directoryValues := file.partitionDirectoryValues()
+	for index := range columns {
+		value := defaultPartitionValue
+		if index < len(directoryValues) && directoryValues[index] != nil {
+			value = *directoryValues[index]
+		}
+		values[index] = aws.String(value)
+	}
+
+	streamId := configString(file.configRecord, "stream_id")
+	tableName := glueTableName(file.messageType)
+	glueClient := newGlueClient(file.configRecord, store.session)
+
+	output, err := glueClient.GetTable(&glue.GetTableInput{DatabaseName: &streamId, Name: &tableName})
+	if err != nil {
+		return err
+	}
+	var tableColumns []*glue.Column
+	if output.Table.StorageDescriptor != nil {
+		tableColumns = output.Table.StorageDescriptor.Columns
+	}
+	//the table is only updated after the partition, the partition gets the columns of the file right away
+	tableColumns = glueColumns(file.schema, columns, tableColumns)
+
+	partitions, err := glueClient.BatchCreatePartition(&glue.BatchCreatePartitionInput{
+		DatabaseName: &streamId,
+		TableName:    &tableName,
+		PartitionInputList: []*glue.PartitionInput{{
+			Values:            values,
+			StorageDescriptor: glueStorageDescriptor(store.URI(objectKey(file.configRecord, file.subFolderName, "")), tableColumns),
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, partitionError := range partitions.Errors {
+		if partitionError.ErrorDetail != nil && aws.StringValue(partitionError.ErrorDetail.ErrorCode) != glue.ErrCodeAlreadyExistsException {
+			return errors.New("creating Glue partition " + file.subFolderName + " failed: " + aws.StringValue(partitionError.ErrorDetail.ErrorMessage))
+		}
+	}
+
+	log.Println("Glue partition " + file.subFolderName + " registered")
+	return nil
+}
+
+//updates the Glue table after a file was written if its schema changed (or always, with force)
+//Iceberg tables are updated after every commit, their metadata location changes
+func syncGlueTable(store *s3Store, file tableFile, force bool) error {
+
+	fingerprint := ""
+	if file.schema != nil {
+		var err error
+		if fingerprint, err = schemaFingerprint(file.schema); err != nil {
+			return err
+		}
+	}
+
+	key := configString(file.configRecord, "stream_id") + "|" + file.tableKey()
+
+	glueSchemas.Lock()
+	changed := glueSchemas.entries[key] != fingerprint
+	glueSchemas.Unlock()
+
+	if !force && !changed && streamTableFormat(file.configRecord) != "table_format_iceberg" {
+		return nil
+	}
+
+	if err := upsertGlueTable(store, file); err != nil {
+		return err
+	}
+
+	glueSchemas.Lock()
+	glueSchemas.entries[key] = fingerprint
+	glueSchemas.Unlock()
+
+	return nil
+}
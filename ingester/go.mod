@@ -35,7 +35,7 @@ require (
 	github.com/cncf/xds/go v0.0.0-20220112060520-0fa49ea1db0c // indirect
 	github.com/colinmarc/hdfs v1.1.3
 	github.com/containerd/containerd v1.5.9 // indirect
-	github.com/creamdog/gonfig v0.0.0-20160810132730-80d86bfb5a37 // indirect
+	github.com/creamdog/gonfig v0.0.0-20160810132730-80d86bfb5a37
 	github.com/docker/distribution v2.8.0+incompatible // indirect
 	github.com/docker/docker v20.10.12+incompatible // indirect
 	github.com/docker/go-connections v0.4.0 // indirect
@@ -48,7 +48,7 @@ require (
 	github.com/klauspost/compress v1.15.6 // indirect
 	github.com/lib/pq v1.10.4
 	github.com/mattn/go-ieproxy v0.0.3 // indirect
-	github.com/segmentio/kafka-go v0.4.32 // indirect
+	github.com/segmentio/kafka-go v0.4.32
 	github.com/snowflakedb/gosnowflake v1.6.7
 	github.com/xitongsys/parquet-go v1.6.2
 	github.com/xitongsys/parquet-go-source v0.0.0-20211228015320-b4f792c43cd0
@@ -58,5 +58,8 @@ require (
 	golang.org/x/sys v0.0.0-20220310020820-b874c991c1a5 // indirect
 	google.golang.org/api v0.65.0
 	google.golang.org/genproto v0.0.0-20220310185008-1973136f34c6 // indirect
-
 )
+
+require rtdl/spool v0.0.0-00010101000000-000000000000
+
+replace rtdl/spool => ../spool
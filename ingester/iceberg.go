@@ -0,0 +1,1498 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Iceberg tables (table_format_iceberg, format version 1), committed by the ingester without a catalog service
+//tables use the layout of Iceberg's Hadoop catalog and can be read from their folder alone: version N of a table
+//is `<table>/metadata/v<N>.metadata.json` and `<table>/metadata/version-hint.text` holds the latest N
+//every written file is committed as a snapshot with a manifest of its own and a manifest list carrying over the
+//manifests of the previous snapshot, the next metadata version is created with ObjectStore.PutIfAbsent - a writer
+//that loses the race to another writer reads the versions it missed and retries
+//the table is maintained with the commits as Iceberg does by its table properties: small manifests are merged,
+//snapshots expire and the metadata log is trimmed, so that neither the manifest list nor the metadata grow per file
+//columns keep their field id for the lifetime of the table and data files are written with these ids
+//the partition spec follows the stream's partition spec where Iceberg has the same transform: identity of string,
+//long and boolean fields, truncate of string fields and year, month, day and hour of timestamp fields in UTC
+//week, quarter and bucket (Iceberg hashes differently) directories are left out of the spec
+type icebergMetadata struct {
+	FormatVersion      int                       `json:"format-version"`
+	TableUuid          string                    `json:"table-uuid"`
+	Location           string                    `json:"location"`
+	LastUpdatedMs      int64                     `json:"last-updated-ms"`
+	LastColumnId       int                       `json:"last-column-id"`
+	Schema             map[string]interface{}    `json:"schema"`
+	Schemas            []map[string]interface{}  `json:"schemas"`
+	CurrentSchemaId    int                       `json:"current-schema-id"`
+	PartitionSpec      []icebergPartitionField   `json:"partition-spec"`
+	PartitionSpecs     []icebergPartitionSpec    `json:"partition-specs"`
+	DefaultSpecId      int                       `json:"default-spec-id"`
+	LastPartitionId    int                       `json:"last-partition-id"`
+	Properties         map[string]string         `json:"properties"`
+	CurrentSnapshotId  int64                     `json:"current-snapshot-id"`
+	Snapshots          []icebergSnapshot         `json:"snapshots"`
+	SnapshotLog        []icebergSnapshotLogEntry `json:"snapshot-log"`
+	MetadataLog        []icebergMetadataLogEntry `json:"metadata-log"`
+	SortOrders         []map[string]interface{}  `json:"sort-orders"`
+	DefaultSortOrderId int                       `json:"default-sort-order-id"`
+}
+
+type icebergPartitionSpec struct {
+	SpecId int                     `json:"spec-id"`
+	Fields []icebergPartitionField `json:"fields"`
+}
+
+type icebergPartitionField struct {
+	Name      string `json:"name"`
+	Transform string `json:"transform"`
+	SourceId  int    `json:"source-id"`
+	FieldId   int    `json:"field-id"`
+}
+
+type icebergSnapshot struct {
+	SnapshotId       int64             `json:"snapshot-id"`
+	ParentSnapshotId *int64            `json:"parent-snapshot-id,omitempty"`
+	TimestampMs      int64             `json:"timestamp-ms"`
+	Summary          map[string]string `json:"summary"`
+	ManifestList     string            `json:"manifest-list"`
+	SchemaId         *int              `json:"schema-id,omitempty"`
+}
+
+type icebergSnapshotLogEntry struct {
+	TimestampMs int64 `json:"timestamp-ms"`
+	SnapshotId  int64 `json:"snapshot-id"`
+}
+
+type icebergMetadataLogEntry struct {
+	TimestampMs  int64  `json:"timestamp-ms"`
+	MetadataFile string `json:"metadata-file"`
+}
+
+//field id and type of a column of a table schema
+type icebergColumn struct {
+	id        int
+	fieldType interface{}
+}
+
+//a partition field of the table together with the partition directory its values come from
+type icebergPartitionColumn struct {
+	icebergPartitionField
+	directory  int
+	resultType string //Iceberg type of the partition values
+}
+
+//block size v1 manifests require, the value Iceberg itself writes
+const icebergBlockSize = 64 * 1024 * 1024
+
+var icebergDecimalPattern = regexp.MustCompile(`^decimal\((\d+),\s*(\d+)\)$`)
+
+//state of a table as of version, kept in memory between commits
+type icebergTable struct {
+	sync.Mutex
+	loaded   bool
+	version  int //0 for a table without metadata
+	metadata *icebergMetadata
+	//data files of the merged manifests of the table by manifest, to replace files that are written again
+	mergedFiles map[string]map[string]bool
+}
+
+//manifests the ingester wrote, named after their data file or merged - other writers' manifests are left as they are
+var icebergManifestPattern = regexp.MustCompile(`/metadata/([0-9a-f]{16}|merged)-[^/]*-m0\.avro$`)
+
+var icebergTables = struct {
+	sync.Mutex
+	entries map[string]*icebergTable
+}{entries: make(map[string]*icebergTable)}
+
+func icebergMetadataKey(tableKey string, version int) string {
+	return fmt.Sprintf("%s/metadata/v%d.metadata.json", tableKey, version)
+}
+
+func icebergVersionHintKey(tableKey string) string {
+	return tableKey + "/metadata/version-hint.text"
+}
+
+func openIcebergTable(store ObjectStore, tableKey string) *icebergTable {
+
+	key := store.SourceType() + "|" + store.Location() + "|" + tableKey
+
+	icebergTables.Lock()
+	defer icebergTables.Unlock()
+
+	if icebergTables.entries[key] == nil {
+		icebergTables.entries[key] = new(icebergTable)
+	}
+
+	return icebergTables.entries[key]
+}
+
+//loads the version the version hint points to and the versions after it
+func (table *icebergTable) load(ctx context.Context, store ObjectStore, tableKey string) error {
+
+	table.loaded, table.version, table.metadata = false, 0, nil
+
+	hint, err := store.Read(ctx, icebergVersionHintKey(tableKey))
+	if err != nil && err != errObjectNotFound {
+		return err
+	}
+	if version, err := strconv.Atoi(strings.TrimSpace(string(hint))); err == nil && version > 0 {
+		if err = table.readVersion(ctx, store, tableKey, version); err != nil {
+			return err
+		}
+	}
+
+	if err = table.catchUp(ctx, store, tableKey); err != nil {
+		return err
+	}
+	table.loaded = true
+
+	return nil
+}
+
+func (table *icebergTable) readVersion(ctx context.Context, store ObjectStore, tableKey string, version int) error {
+
+	data, err := store.Read(ctx, icebergMetadataKey(tableKey, version))
+	if err != nil {
+		return err
+	}
+
+	metadata := new(icebergMetadata)
+	if err = json.Unmarshal(data, metadata); err != nil {
+		return errors.New("invalid Iceberg metadata " + icebergMetadataKey(tableKey, version) + ": " + err.Error())
+	}
+	if metadata.FormatVersion != 1 {
+		return fmt.Errorf("Iceberg table %s has format version %d, only version 1 is supported", tableKey, metadata.FormatVersion)
+	}
+
+	//metadata written before schemas and partition specs were tracked has only the current one
+	if len(metadata.Schemas) == 0 && metadata.Schema != nil {
+		metadata.Schemas = []map[string]interface{}{metadata.Schema}
+		metadata.CurrentSchemaId = jsonInt(metadata.Schema["schema-id"])
+	}
+	if len(metadata.PartitionSpecs) == 0 {
+		metadata.PartitionSpecs = []icebergPartitionSpec{{SpecId: 0, Fields: metadata.PartitionSpec}}
+	}
+
+	table.version, table.metadata = version, metadata
+
+	return nil
+}
+
+//reads the versions after the current version
+func (table *icebergTable) catchUp(ctx context.Context, store ObjectStore, tableKey string) error {
+
+	for {
+		err := table.readVersion(ctx, store, tableKey, table.version+1)
+		if err == errObjectNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+//integer of decoded JSON
+func jsonInt(value interface{}) int {
+	switch typedValue := value.(type) {
+	case float64:
+		return int(typedValue)
+	case int:
+		return typedValue
+	}
+	return 0
+}
+
+//current schema of the table, nil for a new table
+func (metadata *icebergMetadata) currentSchema() map[string]interface{} {
+
+	if metadata == nil {
+		return nil
+	}
+	for _, schema := range metadata.Schemas {
+		if jsonInt(schema["schema-id"]) == metadata.CurrentSchemaId {
+			return schema
+		}
+	}
+
+	return metadata.Schema
+}
+
+//collects the columns of an Iceberg type by path, paths are those of type hints
+func icebergColumns(fieldType interface{}, path string, columns map[string]icebergColumn) {
+
+	typeMap, _ := fieldType.(map[string]interface{})
+
+	switch typeMap["type"] {
+
+	case "struct":
+		fields, _ := typeMap["fields"].([]interface{})
+		for _, fieldEntry := range fields {
+			field, _ := fieldEntry.(map[string]interface{})
+			name, _ := field["name"].(string)
+			columns[fieldPath(path, name)] = icebergColumn{id: jsonInt(field["id"]), fieldType: field["type"]}
+			icebergColumns(field["type"], fieldPath(path, name), columns)
+		}
+
+	case "list":
+		columns[path+"[]"] = icebergColumn{id: jsonInt(typeMap["element-id"]), fieldType: typeMap["element"]}
+		icebergColumns(typeMap["element"], path+"[]", columns)
+	}
+}
+
+//assigns field ids to the columns of a schema node, columns of the table keep their id and new columns get
+//the ids after lastColumnId, fields of a struct before the fields nested in them as Iceberg does
+func assignIcebergIds(node *schemaNode, path string, columns map[string]icebergColumn, lastColumnId *int, ids map[string]int) {
+
+	assign := func(path string) {
+		if column, found := columns[path]; found {
+			ids[path] = column.id
+			return
+		}
+		*lastColumnId++
+		ids[path] = *lastColumnId
+	}
+
+	switch node.dataType {
+
+	case "object":
+		names := node.sortedFieldNames()
+		for _, name := range names {
+			assign(fieldPath(path, name))
+		}
+		for _, name := range names {
+			assignIcebergIds(node.fields[name], fieldPath(path, name), columns, lastColumnId, ids)
+		}
+
+	case "list":
+		assign(path + "[]")
+		assignIcebergIds(node.element, path+"[]", columns, lastColumnId, ids)
+	}
+}
+
+//Iceberg type of a schema node, all columns are optional as in Delta tables
+func icebergType(node *schemaNode, path string, ids map[string]int) interface{} {
+
+	switch node.dataType {
+	case "object":
+		fields := make([]interface{}, 0)
+		for _, name := range node.sortedFieldNames() {
+			fields = append(fields, map[string]interface{}{
+				"id":       ids[fieldPath(path, name)],
+				"name":     name,
+				"required": false,
+				"type":     icebergType(node.fields[name], fieldPath(path, name), ids),
+			})
+		}
+		return map[string]interface{}{"type": "struct", "fields": fields}
+	case "list":
+		return map[string]interface{}{
+			"type":             "list",
+			"element-id":       ids[path+"[]"],
+			"element":          icebergType(node.element, path+"[]", ids),
+			"element-required": false,
+		}
+	case "boolean":
+		return "boolean"
+	case "int64":
+		return "long"
+	case "double":
+		return "double"
+	case "timestamp_millis", "timestamp_micros":
+		return "timestamptz"
+	}
+
+	if precision, scale, ok := decimalPrecisionScale(node.dataType); ok {
+		return fmt.Sprintf("decimal(%d, %d)", precision, scale)
+	}
+
+	return "string"
+}
+
+//true if Iceberg reads values of the type as the other type, decimals can only become more precise
+func icebergPromotes(fieldType string, otherType string) bool {
+
+	if fieldType == otherType {
+		return true
+	}
+
+	match, otherMatch := icebergDecimalPattern.FindStringSubmatch(fieldType), icebergDecimalPattern.FindStringSubmatch(otherType)
+	if match == nil || otherMatch == nil || match[2] != otherMatch[2] {
+		return false
+	}
+	precision, _ := strconv.Atoi(match[1])
+	otherPrecision, _ := strconv.Atoi(otherMatch[1])
+
+	return precision <= otherPrecision
+}
+
+//merges the type of a column of a new file into the type of the table, columns keep their position, new columns
+//are added after them and columns missing in the file are kept
+//Iceberg only allows lossless promotions, a column whose type changes otherwise cannot be written
+func mergeIcebergTypes(tableType interface{}, fileType interface{}, path string) (interface{}, error) {
+
+	if tableType == nil {
+		return fileType, nil
+	}
+
+	tableMap, tableIsMap := tableType.(map[string]interface{})
+	fileMap, fileIsMap := fileType.(map[string]interface{})
+
+	switch {
+
+	case tableIsMap && fileIsMap && tableMap["type"] == "struct" && fileMap["type"] == "struct":
+		tableFields, _ := tableMap["fields"].([]interface{})
+		fileFields, _ := fileMap["fields"].([]interface{})
+		fileFieldTypes := make(map[string]interface{})
+		for _, fieldEntry := range fileFields {
+			field := fieldEntry.(map[string]interface{})
+			fileFieldTypes[field["name"].(string)] = field["type"]
+		}
+
+		fields := make([]interface{}, 0, len(tableFields))
+		merged := make(map[string]bool)
+		for _, fieldEntry := range tableFields {
+			field, _ := fieldEntry.(map[string]interface{})
+			name, _ := field["name"].(string)
+			if fileFieldType, found := fileFieldTypes[name]; found {
+				fieldType, err := mergeIcebergTypes(field["type"], fileFieldType, fieldPath(path, name))
+				if err != nil {
+					return nil, err
+				}
+				field = map[string]interface{}{"id": field["id"], "name": name, "required": false, "type": fieldType}
+			}
+			fields = append(fields, field)
+			merged[name] = true
+		}
+		for _, fieldEntry := range fileFields {
+			if field := fieldEntry.(map[string]interface{}); !merged[field["name"].(string)] {
+				fields = append(fields, field)
+			}
+		}
+		return map[string]interface{}{"type": "struct", "fields": fields}, nil
+
+	case tableIsMap && fileIsMap && tableMap["type"] == "list" && fileMap["type"] == "list":
+		element, err := mergeIcebergTypes(tableMap["element"], fileMap["element"], path+"[]")
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "list", "element-id": fileMap["element-id"], "element": element, "element-required": false}, nil
+
+	case !tableIsMap && !fileIsMap:
+		tableName, _ := tableType.(string)
+		fileName, _ := fileType.(string)
+		if icebergPromotes(fileName, tableName) {
+			return tableType, nil
+		}
+		if icebergPromotes(tableName, fileName) {
+			return fileType, nil
+		}
+	}
+
+	typeName := func(fieldType interface{}) interface{} {
+		if typeMap, ok := fieldType.(map[string]interface{}); ok {
+			return typeMap["type"]
+		}
+		return fieldType
+	}
+
+	return nil, fmt.Errorf("column `%s` of the Iceberg table cannot change from %v to %v", path, typeName(tableType), typeName(fileType))
+}
+
+//Iceberg partition fields of the stream's partition spec, field ids are assigned once the spec is known to the table
+//partition names must not be taken by columns other than the source of identity partitions
+func icebergPartitionColumns(configRecord map[string]interface{}, columns map[string]icebergColumn) []icebergPartitionColumn {
+
+	spec, err := streamPartitionSpec(configRecord)
+	if err != nil {
+		//the files are partitioned by processing time then
+		spec, _ = streamPartitionSpec(map[string]interface{}{"partition_time_id": configRecord["partition_time_id"]})
+	}
+
+	partitionColumns := make([]icebergPartitionColumn, 0)
+	names := make(map[string]bool)
+	for index, field := range spec.fields {
+
+		source, transform, resultType := field.source, field.transformName, ""
+		if source == "" && partitionTransformIsTime(field.transformName) {
+			source = spec.eventTimeField
+		}
+		column, found := columns[source]
+		sourceType, _ := column.fieldType.(string)
+		if !found {
+			continue
+		}
+
+		switch field.transformName {
+		case "identity":
+			if sourceType == "string" || sourceType == "long" || sourceType == "boolean" {
+				resultType = sourceType
+			}
+		case "truncate":
+			if sourceType == "string" && field.argument > 0 {
+				transform, resultType = fmt.Sprintf("truncate[%d]", field.argument), "string"
+			}
+		case "year", "month", "hour":
+			if sourceType == "timestamptz" && spec.location == time.UTC {
+				resultType = "int"
+			}
+		case "day":
+			if sourceType == "timestamptz" && spec.location == time.UTC {
+				resultType = "date"
+			}
+		}
+		if resultType == "" {
+			continue
+		}
+
+		name := field.name
+		for {
+			if taken, found := columns[name]; !names[name] && (!found || (transform == "identity" && taken.id == column.id)) {
+				break
+			}
+			name += "_" + field.transformName
+		}
+		names[name] = true
+
+		partitionColumns = append(partitionColumns, icebergPartitionColumn{
+			icebergPartitionField: icebergPartitionField{Name: name, Transform: transform, SourceId: column.id},
+			directory:             index,
+			resultType:            resultType,
+		})
+	}
+
+	return partitionColumns
+}
+
+//value of a partition column read back from its directory, nil if it cannot be read
+func (partitionColumn icebergPartitionColumn) value(directoryValues []*string) interface{} {
+
+	if partitionColumn.directory >= len(directoryValues) || directoryValues[partitionColumn.directory] == nil {
+		return nil
+	}
+	value := *directoryValues[partitionColumn.directory]
+
+	var err error
+	var result interface{}
+	var partitionTime time.Time
+
+	switch partitionColumn.Transform {
+	case "identity":
+		switch partitionColumn.resultType {
+		case "long":
+			result, err = strconv.ParseInt(value, 10, 64)
+		case "boolean":
+			result, err = strconv.ParseBool(value)
+		default:
+			result = value
+		}
+	case "year":
+		partitionTime, err = time.Parse("2006", value)
+		result = int64(partitionTime.Year() - 1970)
+	case "month":
+		partitionTime, err = time.Parse("2006-01", value)
+		result = int64((partitionTime.Year()-1970)*12 + int(partitionTime.Month()) - 1)
+	case "day":
+		partitionTime, err = time.Parse("2006-01-02", value)
+		result = partitionTime.Unix() / 86400
+	case "hour":
+		partitionTime, err = time.Parse("2006-01-02-15", value)
+		result = partitionTime.Unix() / 3600
+	default:
+		result = value
+	}
+
+	if err != nil {
+		return nil
+	}
+
+	return result
+}
+
+//Avro type of the values of a partition column
+func (partitionColumn icebergPartitionColumn) avroType() interface{} {
+	switch partitionColumn.resultType {
+	case "date":
+		return map[string]interface{}{"type": "int", "logicalType": "date"}
+	case "long", "int", "boolean":
+		return partitionColumn.resultType
+	}
+	return "string"
+}
+
+//single-value serialisation Iceberg uses for bounds
+func (partitionColumn icebergPartitionColumn) bound(value interface{}) []byte {
+
+	switch typedValue := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []byte(typedValue)
+	case bool:
+		if typedValue {
+			return []byte{1}
+		}
+		return []byte{0}
+	case int64:
+		if partitionColumn.resultType == "long" {
+			bound := make([]byte, 8)
+			binary.LittleEndian.PutUint64(bound, uint64(typedValue))
+			return bound
+		}
+		bound := make([]byte, 4)
+		binary.LittleEndian.PutUint32(bound, uint32(int32(typedValue)))
+		return bound
+	}
+
+	return nil
+}
+
+//Avro field names are restricted, Iceberg escapes other characters as _x<hex>
+func avroFieldName(name string) string {
+
+	var escaped strings.Builder
+	for index, character := range name {
+		switch {
+		case character == '_' || (character >= 'a' && character <= 'z') || (character >= 'A' && character <= 'Z'):
+			escaped.WriteRune(character)
+		case character >= '0' && character <= '9' && index > 0:
+			escaped.WriteRune(character)
+		case character >= '0' && character <= '9':
+			escaped.WriteString("_" + string(character))
+		default:
+			escaped.WriteString(fmt.Sprintf("_x%X", character))
+		}
+	}
+
+	return escaped.String()
+}
+
+//Avro schema of manifests (v1) with the partition columns of their spec
+func icebergManifestSchema(partitionColumns []icebergPartitionColumn) string {
+
+	partitionFields := make([]interface{}, 0)
+	for _, partitionColumn := range partitionColumns {
+		partitionFields = append(partitionFields, map[string]interface{}{
+			"name": avroFieldName(partitionColumn.Name), "type": []interface{}{"null", partitionColumn.avroType()}, "default": nil, "field-id": partitionColumn.FieldId,
+		})
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{"type": "record", "name": "manifest_entry", "fields": []interface{}{
+		map[string]interface{}{"name": "status", "type": "int", "field-id": 0},
+		map[string]interface{}{"name": "snapshot_id", "type": "long", "field-id": 1},
+		map[string]interface{}{"name": "data_file", "field-id": 2, "type": map[string]interface{}{"type": "record", "name": "r2", "fields": []interface{}{
+			map[string]interface{}{"name": "file_path", "type": "string", "field-id": 100},
+			map[string]interface{}{"name": "file_format", "type": "string", "field-id": 101},
+			map[string]interface{}{"name": "partition", "field-id": 102, "type": map[string]interface{}{"type": "record", "name": "r102", "fields": partitionFields}},
+			map[string]interface{}{"name": "record_count", "type": "long", "field-id": 103},
+			map[string]interface{}{"name": "file_size_in_bytes", "type": "long", "field-id": 104},
+			map[string]interface{}{"name": "block_size_in_bytes", "type": "long", "field-id": 105},
+		}}},
+	}})
+
+	return string(schema)
+}
+
+//Avro schema of manifest lists (v1)
+func icebergManifestListSchema() string {
+
+	optional := func(name string, avroType interface{}, fieldId int) interface{} {
+		return map[string]interface{}{"name": name, "type": []interface{}{"null", avroType}, "default": nil, "field-id": fieldId}
+	}
+
+	schema, _ := json.Marshal(map[string]interface{}{"type": "record", "name": "manifest_file", "fields": []interface{}{
+		map[string]interface{}{"name": "manifest_path", "type": "string", "field-id": 500},
+		map[string]interface{}{"name": "manifest_length", "type": "long", "field-id": 501},
+		map[string]interface{}{"name": "partition_spec_id", "type": "int", "field-id": 502},
+		optional("added_snapshot_id", "long", 503),
+		optional("added_data_files_count", "int", 504),
+		optional("existing_data_files_count", "int", 505),
+		optional("deleted_data_files_count", "int", 506),
+		optional("partitions", map[string]interface{}{"type": "array", "element-id": 508, "items": map[string]interface{}{"type": "record", "name": "r508", "fields": []interface{}{
+			map[string]interface{}{"name": "contains_null", "type": "boolean", "field-id": 509},
+			optional("contains_nan", "boolean", 518),
+			optional("lower_bound", "bytes", 510),
+			optional("upper_bound", "bytes", 511),
+		}}}, 507),
+		optional("added_rows_count", "long", 512),
+		optional("existing_rows_count", "long", 513),
+		optional("deleted_rows_count", "long", 514),
+	}})
+
+	return string(schema)
+}
+
+//start of the names of the manifests of a data file
+func icebergManifestPrefix(file tableFile) string {
+
+	hash := fnv.New64a()
+	hash.Write([]byte(file.relativePath()))
+
+	return fmt.Sprintf("%016x", hash.Sum64())
+}
+
+//random positive snapshot id
+func newSnapshotId() int64 {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return int64(binary.BigEndian.Uint64(id) & math.MaxInt64)
+}
+
+//field ids of the columns of the file as of the current version of the table
+func (table *icebergTable) fieldIds(file tableFile) (map[string]int, int) {
+
+	columns := make(map[string]icebergColumn)
+	lastColumnId := 0
+	if table.metadata != nil {
+		icebergColumns(table.metadata.currentSchema(), "", columns)
+		lastColumnId = table.metadata.LastColumnId
+	}
+
+	ids := make(map[string]int)
+	assignIcebergIds(file.schema, "", columns, &lastColumnId, ids)
+
+	return ids, lastColumnId
+}
+
+//field ids to write a file to the Iceberg table of its message type with
+func icebergFieldIds(store ObjectStore, file tableFile) (map[string]int, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	table := openIcebergTable(store, file.tableKey())
+	table.Lock()
+	defer table.Unlock()
+
+	if !table.loaded {
+		if err := table.load(ctx, store, file.tableKey()); err != nil {
+			return nil, err
+		}
+	}
+
+	ids, _ := table.fieldIds(file)
+	return ids, nil
+}
+
+//metadata of the next version of the table with the schema and the partition spec of the file
+//returns the partition columns of the spec the file is committed with
+func (table *icebergTable) nextMetadata(store ObjectStore, file tableFile, now int64) (*icebergMetadata, []icebergPartitionColumn, error) {
+
+	metadata := icebergMetadata{
+		FormatVersion:     1,
+		TableUuid:         newTableId(),
+		Location:          store.URI(file.tableKey()),
+		CurrentSchemaId:   -1,
+		DefaultSpecId:     -1,
+		LastPartitionId:   999,
+		Properties:        map[string]string{},
+		CurrentSnapshotId: -1,
+		SortOrders:        []map[string]interface{}{{"order-id": 0, "fields": []interface{}{}}},
+	}
+	if table.metadata != nil {
+		metadata = *table.metadata
+	}
+	metadata.LastUpdatedMs = now
+
+	//the file was written with the ids of an earlier version, they must still be the ids of its columns
+	ids, lastColumnId := table.fieldIds(file)
+	for path, id := range ids {
+		if file.fieldIds[path] != id {
+			return nil, nil, errors.New("the columns of Iceberg table " + file.tableKey() + " changed while the file was written")
+		}
+	}
+	metadata.LastColumnId = lastColumnId
+
+	currentSchema := metadata.currentSchema()
+	var currentType interface{}
+	if currentSchema != nil {
+		currentType = currentSchema
+	}
+	schemaType, err := mergeIcebergTypes(currentType, icebergType(file.schema, "", ids), "")
+	if err != nil {
+		return nil, nil, err
+	}
+	schema := schemaType.(map[string]interface{})
+
+	fields, _ := json.Marshal(schema["fields"])
+	currentFields, _ := json.Marshal(currentSchema["fields"])
+	if currentSchema == nil || string(fields) != string(currentFields) {
+		schemaId := 0
+		for _, existing := range metadata.Schemas {
+			if id := jsonInt(existing["schema-id"]); id >= schemaId {
+				schemaId = id + 1
+			}
+		}
+		schema["schema-id"] = schemaId
+		metadata.Schemas = append(metadata.Schemas[:len(metadata.Schemas):len(metadata.Schemas)], schema)
+		metadata.CurrentSchemaId = schemaId
+		metadata.Schema = schema
+	}
+
+	columns := make(map[string]icebergColumn)
+	icebergColumns(metadata.currentSchema(), "", columns)
+	partitionColumns := icebergPartitionColumns(file.configRecord, columns)
+
+	//a spec with the same fields is used again, otherwise the spec evolves and keeps the ids of fields it shares
+	specId := -1
+	for _, spec := range metadata.PartitionSpecs {
+		if len(spec.Fields) != len(partitionColumns) {
+			continue
+		}
+		matches := true
+		for index, field := range spec.Fields {
+			partitionColumn := partitionColumns[index]
+			matches = matches && field.Name == partitionColumn.Name && field.Transform == partitionColumn.Transform && field.SourceId == partitionColumn.SourceId
+		}
+		if matches {
+			specId = spec.SpecId
+			for index, field := range spec.Fields {
+				partitionColumns[index].FieldId = field.FieldId
+			}
+			break
+		}
+	}
+
+	if specId < 0 {
+		for _, spec := range metadata.PartitionSpecs {
+			if spec.SpecId > specId {
+				specId = spec.SpecId
+			}
+		}
+		specId++
+
+		fields := make([]icebergPartitionField, len(partitionColumns))
+		for index := range partitionColumns {
+			partitionColumn := &partitionColumns[index]
+			for _, spec := range metadata.PartitionSpecs {
+				for _, field := range spec.Fields {
+					if field.Transform == partitionColumn.Transform && field.SourceId == partitionColumn.SourceId {
+						partitionColumn.FieldId = field.FieldId
+					}
+				}
+			}
+			if partitionColumn.FieldId == 0 {
+				metadata.LastPartitionId++
+				partitionColumn.FieldId = metadata.LastPartitionId
+			}
+			fields[index] = partitionColumn.icebergPartitionField
+		}
+		metadata.PartitionSpecs = append(metadata.PartitionSpecs[:len(metadata.PartitionSpecs):len(metadata.PartitionSpecs)], icebergPartitionSpec{SpecId: specId, Fields: fields})
+	}
+
+	for _, spec := range metadata.PartitionSpecs {
+		if spec.SpecId == specId {
+			metadata.DefaultSpecId, metadata.PartitionSpec = specId, spec.Fields
+		}
+	}
+
+	return &metadata, partitionColumns, nil
+}
+
+//integer table property, fallback (Iceberg's default) if it is not set
+func (metadata *icebergMetadata) property(name string, fallback int64) int64 {
+
+	if value, err := strconv.ParseInt(metadata.Properties[name], 10, 64); err == nil {
+		return value
+	}
+
+	return fallback
+}
+
+//manifest entries of the current snapshot, carried over into the manifest list of the next one
+func (table *icebergTable) currentManifests(ctx context.Context, store ObjectStore) ([]map[string]interface{}, error) {
+
+	if table.metadata == nil {
+		return nil, nil
+	}
+
+	for _, snapshot := range table.metadata.Snapshots {
+		if snapshot.SnapshotId != table.metadata.CurrentSnapshotId {
+			continue
+		}
+		if !strings.HasPrefix(snapshot.ManifestList, store.URI("")) {
+			return nil, errors.New("manifest list " + snapshot.ManifestList + " is not in the data store")
+		}
+		data, err := store.Read(ctx, strings.TrimPrefix(snapshot.ManifestList, store.URI("")))
+		if err != nil {
+			return nil, err
+		}
+		manifests, _, err := decodeAvroFile(data)
+		return manifests, err
+	}
+
+	return nil, nil
+}
+
+//writes the manifest and the manifest list of a snapshot appending the file, returns the snapshot
+func (table *icebergTable) writeSnapshot(ctx context.Context, store ObjectStore, file tableFile, metadata *icebergMetadata, partitionColumns []icebergPartitionColumn, snapshotId int64) (*icebergSnapshot, error) {
+
+	tableKey := file.tableKey()
+
+	partition := make(map[string]interface{})
+	directoryValues := file.partitionDirectoryValues()
+	for _, partitionColumn := range partitionColumns {
+		partition[avroFieldName(partitionColumn.Name)] = partitionColumn.value(directoryValues)
+	}
+
+	specFields := make([]icebergPartitionField, len(partitionColumns))
+	for index, partitionColumn := range partitionColumns {
+		specFields[index] = partitionColumn.icebergPartitionField
+	}
+	specJSON, _ := json.Marshal(specFields)
+	schemaJSON, _ := json.Marshal(metadata.currentSchema())
+
+	manifest, err := encodeAvroFile(icebergManifestSchema(partitionColumns), map[string]string{
+		"schema":            string(schemaJSON),
+		"schema-id":         strconv.Itoa(metadata.CurrentSchemaId),
+		"partition-spec":    string(specJSON),
+		"partition-spec-id": strconv.Itoa(metadata.DefaultSpecId),
+		"format-version":    "1",
+	}, []map[string]interface{}{{
+		"status":      1, //added
+		"snapshot_id": snapshotId,
+		"data_file": map[string]interface{}{
+			"file_path":           store.URI(file.key),
+			"file_format":         "PARQUET",
+			"partition":           partition,
+			"record_count":        file.rows,
+			"file_size_in_bytes":  file.size,
+			"block_size_in_bytes": icebergBlockSize,
+		},
+	}})
+	if err != nil {
+		return nil, err
+	}
+	summaries := icebergPartitionSummaries(partitionColumns, []map[string]interface{}{{"partition": partition}})
+
+	//manifests are named after their data file, the manifest of a file that is written again replaces the earlier one
+	manifestPrefix := tableKey + "/metadata/" + icebergManifestPrefix(file) + "-"
+	manifestKey := manifestPrefix + newTableId() + "-m0.avro"
+	if err = putObject(ctx, store, manifestKey, manifest); err != nil {
+		return nil, err
+	}
+
+	current, err := table.currentManifests(ctx, store)
+	if err != nil {
+		return nil, err
+	}
+	replaced := 0
+	manifests := make([]map[string]interface{}, 0, len(current)+1)
+	for _, entry := range current {
+		manifestPath, _ := entry["manifest_path"].(string)
+		if strings.HasPrefix(manifestPath, store.URI(manifestPrefix)) {
+			replaced++
+			continue
+		}
+
+		//a merged manifest listing the file is written again without it
+		if strings.HasPrefix(manifestPath, store.URI(tableKey+"/metadata/merged-")) {
+			files, err := table.mergedManifestFiles(ctx, store, manifestPath)
+			if err != nil {
+				return nil, err
+			}
+			if files[store.URI(file.key)] {
+				replaced++
+				entry, err = table.writeMergedManifest(ctx, store, tableKey, []map[string]interface{}{entry}, snapshotId, store.URI(file.key))
+				if err != nil {
+					return nil, err
+				}
+				if entry == nil {
+					continue
+				}
+			}
+		}
+
+		manifests = append(manifests, entry)
+	}
+	manifests = append([]map[string]interface{}{{
+		"manifest_path":             store.URI(manifestKey),
+		"manifest_length":           len(manifest),
+		"partition_spec_id":         metadata.DefaultSpecId,
+		"added_snapshot_id":         snapshotId,
+		"added_data_files_count":    1,
+		"existing_data_files_count": 0,
+		"deleted_data_files_count":  0,
+		"partitions":                summaries,
+		"added_rows_count":          file.rows,
+		"existing_rows_count":       0,
+		"deleted_rows_count":        0,
+	}}, manifests...)
+
+	if manifests, err = table.mergeManifests(ctx, store, tableKey, metadata, manifests, snapshotId); err != nil {
+		return nil, err
+	}
+
+	schemaId := metadata.CurrentSchemaId
+	snapshot := &icebergSnapshot{
+		SnapshotId:   snapshotId,
+		TimestampMs:  metadata.LastUpdatedMs,
+		ManifestList: store.URI(fmt.Sprintf("%s/metadata/snap-%d-1-%s.avro", tableKey, snapshotId, newTableId())),
+		SchemaId:     &schemaId,
+		Summary: map[string]string{
+			"operation":        "append",
+			"added-data-files": "1",
+			"added-records":    strconv.Itoa(file.rows),
+			"added-files-size": strconv.FormatInt(file.size, 10),
+		},
+	}
+
+	parentSnapshotId := "null"
+	if metadata.CurrentSnapshotId >= 0 {
+		parent := metadata.CurrentSnapshotId
+		snapshot.ParentSnapshotId = &parent
+		parentSnapshotId = strconv.FormatInt(parent, 10)
+	}
+
+	//totals are only kept as long as every snapshot had them, the size of a replaced file is not known
+	totals := map[string]int64{"total-data-files": 1, "total-records": int64(file.rows), "total-files-size": file.size}
+	if replaced > 0 {
+		snapshot.Summary["operation"] = "overwrite"
+		snapshot.Summary["deleted-data-files"] = strconv.Itoa(replaced)
+		totals = nil
+	}
+	for _, previous := range metadata.Snapshots {
+		if previous.SnapshotId != metadata.CurrentSnapshotId {
+			continue
+		}
+		for name := range totals {
+			total, err := strconv.ParseInt(previous.Summary[name], 10, 64)
+			if err != nil {
+				totals = nil
+				break
+			}
+			totals[name] += total
+		}
+	}
+	for name, total := range totals {
+		snapshot.Summary[name] = strconv.FormatInt(total, 10)
+	}
+
+	manifestList, err := encodeAvroFile(icebergManifestListSchema(), map[string]string{
+		"snapshot-id":        strconv.FormatInt(snapshotId, 10),
+		"parent-snapshot-id": parentSnapshotId,
+		"format-version":     "1",
+	}, manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = putObject(ctx, store, strings.TrimPrefix(snapshot.ManifestList, store.URI("")), manifestList); err != nil {
+		return nil, err
+	}
+
+	//merged manifests that are no longer listed are forgotten
+	listed := make(map[string]bool)
+	for _, manifest := range manifests {
+		manifestPath, _ := manifest["manifest_path"].(string)
+		listed[manifestPath] = true
+	}
+	for manifestPath := range table.mergedFiles {
+		if !listed[manifestPath] {
+			delete(table.mergedFiles, manifestPath)
+		}
+	}
+
+	return snapshot, nil
+}
+
+//true if value sorts before other, both being partition values of the same column
+func icebergLess(value interface{}, other interface{}) bool {
+
+	switch typedValue := value.(type) {
+	case int64:
+		otherValue, _ := other.(int64)
+		return typedValue < otherValue
+	case string:
+		otherValue, _ := other.(string)
+		return typedValue < otherValue
+	case bool:
+		return !typedValue && other == true
+	}
+
+	return false
+}
+
+//partition field summaries of the manifest list for manifest entries, entries being data files or their partition
+func icebergPartitionSummaries(partitionColumns []icebergPartitionColumn, entries []map[string]interface{}) []interface{} {
+
+	summaries := make([]interface{}, 0)
+	for _, partitionColumn := range partitionColumns {
+		containsNull := false
+		var lower, upper interface{}
+		for _, entry := range entries {
+			partition, _ := entry["partition"].(map[string]interface{})
+			value := partition[avroFieldName(partitionColumn.Name)]
+			switch {
+			case value == nil:
+				containsNull = true
+			case lower == nil:
+				lower, upper = value, value
+			case icebergLess(value, lower):
+				lower = value
+			case icebergLess(upper, value):
+				upper = value
+			}
+		}
+		summaries = append(summaries, map[string]interface{}{
+			"contains_null": containsNull,
+			"contains_nan":  nil,
+			"lower_bound":   partitionColumn.bound(lower),
+			"upper_bound":   partitionColumn.bound(upper),
+		})
+	}
+
+	return summaries
+}
+
+//partition columns of a manifest read back from its Avro schema, as far as summaries need them
+func icebergManifestPartitionColumns(schemaJSON string) ([]icebergPartitionColumn, error) {
+
+	var schema interface{}
+	if err := json.Unmarshal([]byte(schemaJSON), &schema); err != nil {
+		return nil, err
+	}
+
+	//type of a field of an Avro record
+	fieldType := func(record interface{}, name string) interface{} {
+		recordSchema, _ := record.(map[string]interface{})
+		fields, _ := recordSchema["fields"].([]interface{})
+		for _, fieldEntry := range fields {
+			if field, _ := fieldEntry.(map[string]interface{}); field["name"] == name {
+				return field["type"]
+			}
+		}
+		return nil
+	}
+
+	partitionSchema, _ := fieldType(fieldType(schema, "data_file"), "partition").(map[string]interface{})
+	fields, _ := partitionSchema["fields"].([]interface{})
+
+	partitionColumns := make([]icebergPartitionColumn, 0, len(fields))
+	for _, fieldEntry := range fields {
+		field, _ := fieldEntry.(map[string]interface{})
+		name, _ := field["name"].(string)
+		partitionColumn := icebergPartitionColumn{icebergPartitionField: icebergPartitionField{Name: name}, resultType: "string"}
+		branches, _ := field["type"].([]interface{})
+		for _, branch := range branches {
+			switch typedBranch := branch.(type) {
+			case string:
+				if typedBranch != "null" {
+					partitionColumn.resultType = typedBranch
+				}
+			case map[string]interface{}:
+				if typedBranch["logicalType"] == "date" {
+					partitionColumn.resultType = "date"
+				}
+			}
+		}
+		partitionColumns = append(partitionColumns, partitionColumn)
+	}
+
+	return partitionColumns, nil
+}
+
+//data files listed by a merged manifest, merged manifests are never changed so they are only read once
+func (table *icebergTable) mergedManifestFiles(ctx context.Context, store ObjectStore, manifestPath string) (map[string]bool, error) {
+
+	if files, ok := table.mergedFiles[manifestPath]; ok {
+		return files, nil
+	}
+
+	data, err := store.Read(ctx, strings.TrimPrefix(manifestPath, store.URI("")))
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := decodeAvroFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]bool)
+	for _, entry := range entries {
+		dataFile, _ := entry["data_file"].(map[string]interface{})
+		filePath, _ := dataFile["file_path"].(string)
+		files[filePath] = true
+	}
+
+	if table.mergedFiles == nil {
+		table.mergedFiles = make(map[string]map[string]bool)
+	}
+	table.mergedFiles[manifestPath] = files
+
+	return files, nil
+}
+
+//writes the entries of manifests of a partition spec to a single manifest, as existing files of the snapshot
+//the data file at dropPath is left out, returns the manifest list entry of the merged manifest - nil if it is empty
+func (table *icebergTable) writeMergedManifest(ctx context.Context, store ObjectStore, tableKey string, manifests []map[string]interface{}, snapshotId int64, dropPath string) (map[string]interface{}, error) {
+
+	var schemaJSON string
+	fileMetadata := make(map[string]string)
+	entries := make([]map[string]interface{}, 0)
+	dataFiles := make([]map[string]interface{}, 0)
+	files := make(map[string]bool)
+	rows := int64(0)
+
+	for _, manifest := range manifests {
+		manifestPath, _ := manifest["manifest_path"].(string)
+		data, err := store.Read(ctx, strings.TrimPrefix(manifestPath, store.URI("")))
+		if err != nil {
+			return nil, err
+		}
+		manifestEntries, manifestMetadata, err := decodeAvroFile(data)
+		if err != nil {
+			return nil, err
+		}
+
+		//manifests are newest first, the merged manifest takes the file metadata of the newest
+		if schemaJSON == "" {
+			schemaJSON = manifestMetadata["avro.schema"]
+			for key, value := range manifestMetadata {
+				if !strings.HasPrefix(key, "avro.") {
+					fileMetadata[key] = value
+				}
+			}
+		}
+
+		for _, entry := range manifestEntries {
+			dataFile, _ := entry["data_file"].(map[string]interface{})
+			filePath, _ := dataFile["file_path"].(string)
+			if status, _ := avroInt(entry["status"]); status == 2 || filePath == dropPath {
+				continue
+			}
+			recordCount, _ := avroInt(dataFile["record_count"])
+			entry["status"] = 0 //existing
+			entries = append(entries, entry)
+			dataFiles = append(dataFiles, dataFile)
+			files[filePath] = true
+			rows += recordCount
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	partitionColumns, err := icebergManifestPartitionColumns(schemaJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := encodeAvroFile(schemaJSON, fileMetadata, entries)
+	if err != nil {
+		return nil, err
+	}
+	mergedKey := tableKey + "/metadata/merged-" + newTableId() + "-m0.avro"
+	if err = putObject(ctx, store, mergedKey, merged); err != nil {
+		return nil, err
+	}
+
+	if table.mergedFiles == nil {
+		table.mergedFiles = make(map[string]map[string]bool)
+	}
+	table.mergedFiles[store.URI(mergedKey)] = files
+
+	return map[string]interface{}{
+		"manifest_path":             store.URI(mergedKey),
+		"manifest_length":           len(merged),
+		"partition_spec_id":         manifests[0]["partition_spec_id"],
+		"added_snapshot_id":         snapshotId,
+		"added_data_files_count":    0,
+		"existing_data_files_count": len(entries),
+		"deleted_data_files_count":  0,
+		"partitions":                icebergPartitionSummaries(partitionColumns, dataFiles),
+		"added_rows_count":          0,
+		"existing_rows_count":       rows,
+		"deleted_rows_count":        0,
+	}, nil
+}
+
+//merges the manifests of a snapshot once it has commit.manifest.min-count-to-merge (100) of them, as Iceberg's
+//merge appends do: the small manifests of a partition spec are merged up to commit.manifest.target-size-bytes
+//(8 MB), the new manifest of the snapshot and the manifests of other writers are kept as they are
+func (table *icebergTable) mergeManifests(ctx context.Context, store ObjectStore, tableKey string, metadata *icebergMetadata, manifests []map[string]interface{}, snapshotId int64) ([]map[string]interface{}, error) {
+
+	if int64(len(manifests)) < metadata.property("commit.manifest.min-count-to-merge", 100) {
+		return manifests, nil
+	}
+	targetSize := metadata.property("commit.manifest.target-size-bytes", 8388608)
+
+	type manifestBin struct {
+		manifests []map[string]interface{}
+		size      int64
+	}
+	bins := make([]*manifestBin, 0)
+	openBins := make(map[int64]*manifestBin)
+
+	merged := []map[string]interface{}{manifests[0]}
+	for _, manifest := range manifests[1:] {
+		manifestPath, _ := manifest["manifest_path"].(string)
+		length, _ := avroInt(manifest["manifest_length"])
+		specId, _ := avroInt(manifest["partition_spec_id"])
+		if length >= targetSize || !icebergManifestPattern.MatchString(manifestPath) {
+			merged = append(merged, manifest)
+			continue
+		}
+
+		bin := openBins[specId]
+		if bin == nil || bin.size+length > targetSize {
+			bin = new(manifestBin)
+			openBins[specId] = bin
+			bins = append(bins, bin)
+		}
+		bin.manifests = append(bin.manifests, manifest)
+		bin.size += length
+	}
+
+	for _, bin := range bins {
+		if len(bin.manifests) == 1 {
+			merged = append(merged, bin.manifests[0])
+			continue
+		}
+		manifest, err := table.writeMergedManifest(ctx, store, tableKey, bin.manifests, snapshotId, "")
+		if err != nil {
+			return nil, err
+		}
+		if manifest != nil {
+			merged = append(merged, manifest)
+		}
+	}
+
+	return merged, nil
+}
+
+//expires the snapshots older than history.expire.max-snapshot-age-ms (5 days) except for the
+//history.expire.min-snapshots-to-keep (1) latest ones and keeps write.metadata.previous-versions-max (100) earlier
+//metadata files in the metadata log, returns the expired snapshots and the metadata files that were dropped
+func (metadata *icebergMetadata) expire(now int64) ([]icebergSnapshot, []string) {
+
+	maxAge := metadata.property("history.expire.max-snapshot-age-ms", 432000000)
+	minSnapshots := int(metadata.property("history.expire.min-snapshots-to-keep", 1))
+
+	kept := make([]icebergSnapshot, 0, len(metadata.Snapshots))
+	expired := make([]icebergSnapshot, 0)
+	retained := make(map[int64]bool)
+	for index, snapshot := range metadata.Snapshots {
+		if snapshot.SnapshotId == metadata.CurrentSnapshotId || index >= len(metadata.Snapshots)-minSnapshots || snapshot.TimestampMs >= now-maxAge {
+			kept = append(kept, snapshot)
+			retained[snapshot.SnapshotId] = true
+			continue
+		}
+		expired = append(expired, snapshot)
+	}
+	metadata.Snapshots = kept
+
+	if len(expired) > 0 {
+		snapshotLog := make([]icebergSnapshotLogEntry, 0, len(metadata.SnapshotLog))
+		for _, entry := range metadata.SnapshotLog {
+			if retained[entry.SnapshotId] {
+				snapshotLog = append(snapshotLog, entry)
+			}
+		}
+		metadata.SnapshotLog = snapshotLog
+	}
+
+	dropped := make([]string, 0)
+	if previousVersions := int(metadata.property("write.metadata.previous-versions-max", 100)); len(metadata.MetadataLog) > previousVersions {
+		for _, entry := range metadata.MetadataLog[:len(metadata.MetadataLog)-previousVersions] {
+			dropped = append(dropped, entry.MetadataFile)
+		}
+		metadata.MetadataLog = metadata.MetadataLog[len(metadata.MetadataLog)-previousVersions:]
+	}
+
+	return expired, dropped
+}
+
+//manifests listed by the manifest list of a snapshot
+func icebergSnapshotManifests(ctx context.Context, store ObjectStore, snapshot icebergSnapshot) (map[string]bool, error) {
+
+	data, err := store.Read(ctx, strings.TrimPrefix(snapshot.ManifestList, store.URI("")))
+	if err != nil {
+		return nil, err
+	}
+	entries, _, err := decodeAvroFile(data)
+	if err != nil {
+		return nil, err
+	}
+
+	manifests := make(map[string]bool)
+	for _, entry := range entries {
+		manifestPath, _ := entry["manifest_path"].(string)
+		manifests[manifestPath] = true
+	}
+
+	return manifests, nil
+}
+
+//deletes the manifest lists of expired snapshots and the manifests only they listed, and the dropped metadata files
+//if write.metadata.delete-after-commit.enabled is set - data files are never deleted, files written again keep their
+//path and no file is removed from the table otherwise
+//snapshots follow each other, a manifest the oldest remaining snapshot does not list is not listed by a later one
+func (table *icebergTable) deleteExpired(ctx context.Context, store ObjectStore, tableKey string, expired []icebergSnapshot, dropped []string) {
+
+	if table.metadata.Properties["write.metadata.delete-after-commit.enabled"] == "true" {
+		for _, metadataFile := range dropped {
+			if !strings.HasPrefix(metadataFile, store.URI(tableKey+"/metadata/")) {
+				continue
+			}
+			if err := store.Delete(ctx, strings.TrimPrefix(metadataFile, store.URI(""))); err != nil {
+				log.Println("Unable to delete Iceberg metadata file "+metadataFile, err)
+			}
+		}
+	}
+
+	if len(expired) == 0 || len(table.metadata.Snapshots) == 0 {
+		return
+	}
+
+	oldest := table.metadata.Snapshots[0]
+	for _, snapshot := range table.metadata.Snapshots {
+		if snapshot.TimestampMs < oldest.TimestampMs {
+			oldest = snapshot
+		}
+	}
+	listed, err := icebergSnapshotManifests(ctx, store, oldest)
+	if err != nil {
+		log.Println("Unable to read the manifests of Iceberg table "+tableKey+", expired snapshots are not deleted", err)
+		return
+	}
+
+	for _, snapshot := range expired {
+		if !strings.HasPrefix(snapshot.ManifestList, store.URI(tableKey+"/metadata/")) {
+			continue
+		}
+		manifests, err := icebergSnapshotManifests(ctx, store, snapshot)
+		if err != nil && err != errObjectNotFound {
+			log.Println("Unable to read manifest list "+snapshot.ManifestList, err)
+			continue
+		}
+		for manifestPath := range manifests {
+			if listed[manifestPath] || !strings.HasPrefix(manifestPath, store.URI(tableKey+"/metadata/")) {
+				continue
+			}
+			if err = store.Delete(ctx, strings.TrimPrefix(manifestPath, store.URI(""))); err != nil {
+				log.Println("Unable to delete Iceberg manifest "+manifestPath, err)
+			}
+		}
+		if err = store.Delete(ctx, strings.TrimPrefix(snapshot.ManifestList, store.URI(""))); err != nil {
+			log.Println("Unable to delete Iceberg manifest list "+snapshot.ManifestList, err)
+		}
+	}
+}
+
+//URI of the current metadata file of a table, blank if the table was not committed to yet
+func icebergMetadataLocation(store ObjectStore, tableKey string) string {
+
+	table := openIcebergTable(store, tableKey)
+	table.Lock()
+	defer table.Unlock()
+
+	if !table.loaded || table.version == 0 {
+		return ""
+	}
+
+	return store.URI(icebergMetadataKey(tableKey, table.version))
+}
+
+//commits a written file to the Iceberg table of its message type
+func commitIcebergFile(store ObjectStore, file tableFile) error {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	streamId := configString(file.configRecord, "stream_id")
+	tableKey := file.tableKey()
+
+	table := openIcebergTable(store, tableKey)
+	table.Lock()
+	defer table.Unlock()
+
+	if !table.loaded {
+		if err := table.load(ctx, store, tableKey); err != nil {
+			return err
+		}
+	}
+
+	snapshotId := newSnapshotId()
+
+	var expired []icebergSnapshot
+	var dropped []string
+	attempts := GetEnvInt("ICEBERG_COMMIT_ATTEMPTS", 10)
+	for attempt := 1; ; attempt++ {
+
+		now := time.Now().UnixNano() / int64(time.Millisecond)
+		metadata, partitionColumns, err := table.nextMetadata(store, file, now)
+		if err != nil {
+			return err
+		}
+
+		snapshot, err := table.writeSnapshot(ctx, store, file, metadata, partitionColumns, snapshotId)
+		if err != nil {
+			table.loaded = false
+			return err
+		}
+
+		metadata.Snapshots = append(metadata.Snapshots[:len(metadata.Snapshots):len(metadata.Snapshots)], *snapshot)
+		metadata.CurrentSnapshotId = snapshotId
+		metadata.SnapshotLog = append(metadata.SnapshotLog[:len(metadata.SnapshotLog):len(metadata.SnapshotLog)], icebergSnapshotLogEntry{TimestampMs: now, SnapshotId: snapshotId})
+		if table.metadata != nil {
+			metadata.MetadataLog = append(metadata.MetadataLog[:len(metadata.MetadataLog):len(metadata.MetadataLog)], icebergMetadataLogEntry{
+				TimestampMs:  table.metadata.LastUpdatedMs,
+				MetadataFile: store.URI(icebergMetadataKey(tableKey, table.version)),
+			})
+		}
+		expired, dropped = metadata.expire(now)
+
+		data, err := json.MarshalIndent(metadata, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		err = store.PutIfAbsent(ctx, icebergMetadataKey(tableKey, table.version+1), data)
+		if err == nil {
+			table.version++
+			table.metadata = metadata
+			break
+		}
+
+		if err != errObjectExists || attempt >= attempts {
+			//the table may have moved on, it is read again with the next commit
+			table.loaded = false
+			return err
+		}
+
+		//another writer committed this version first
+		incrementCounter("iceberg_commit_conflicts", streamId)
+		if err = table.catchUp(ctx, store, tableKey); err != nil {
+			table.loaded = false
+			return err
+		}
+	}
+
+	incrementCounter("iceberg_commits", streamId)
+	log.Println("Committed " + file.key + " to Iceberg table " + tableKey + " as version " + strconv.Itoa(table.version))
+
+	table.deleteExpired(ctx, store, tableKey, expired, dropped)
+
+	//readers find the latest version without the hint as well, only slower
+	if err := putObject(ctx, store, icebergVersionHintKey(tableKey), []byte(strconv.Itoa(table.version))); err != nil {
+		log.Println("Unable to write Iceberg version hint of "+tableKey, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+)
+
+//in-process counters, per stream, exposed as JSON on /metrics
+var metrics = struct {
+	sync.Mutex
+	counters map[string]map[string]int64
+}{counters: make(map[string]map[string]int64)}
+
+//utility method to increment the counter `name` of a stream
+func incrementCounter(name string, streamId string) {
+	addToCounter(name, streamId, 1)
+}
+
+//utility method to add delta to the counter `name` of a stream
+func addToCounter(name string, streamId string, delta int64) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if metrics.counters[name] == nil {
+		metrics.counters[name] = make(map[string]int64)
+	}
+	metrics.counters[name][streamId] += delta
+}
+
+//handler function for the metrics view
+func metricsHandler() func(http.ResponseWriter, *http.Request) {
+	return http.HandlerFunc(func(wrt http.ResponseWriter, req *http.Request) {
+
+		view := map[string]interface{}{"circuit_breakers": openCircuitBreakers(), "failing_catalogs": failingCatalogs()}
+		if deadLetterSpool != nil {
+			view["spool"] = deadLetterSpool.Stats()
+		}
+
+		metrics.Lock()
+		view["counters"] = metrics.counters
+		body, err := json.Marshal(view)
+		metrics.Unlock()
+
+		if err != nil {
+			log.Println(err)
+			http.Error(wrt, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		wrt.Header().Set("Content-Type", "application/json")
+		wrt.Write(body)
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/writerfile"
+)
+
+//storage backend of a stream, selected by its file_store_type_id
+//files are streamed to the store while they are encoded, nothing is staged in the working directory
+//adding a backend means implementing ObjectStore and registering its constructor under a new
+//file_store_types.json literal in objectStores
+type ObjectStore interface {
+	//source type of the store as known to the catalogs, e.g. "S3"
+	SourceType() string
+	//bucket, container or root folder the keys are relative to
+	Location() string
+	//absolute URI of the object at key, as table formats reference their files
+	URI(key string) string
+	//opens a writer for the object at key, the object only becomes visible once the writer is closed
+	Create(ctx context.Context, key string) (ObjectWriter, error)
+	//reads a small object as a whole, errObjectNotFound if it does not exist
+	Read(ctx context.Context, key string) ([]byte, error)
+	//all objects below the folder prefix (the whole store for a blank prefix), in no particular order
+	List(ctx context.Context, prefix string) ([]objectInfo, error)
+	//creates a small object unless it already exists, errObjectExists if it does
+	//table formats commit through this, it has to be atomic even with concurrent writers
+	PutIfAbsent(ctx context.Context, key string, data []byte) error
+	//deletes the object at key, objects that do not exist are not an error
+	Delete(ctx context.Context, key string) error
+	//moves the object at key to newKey, replacing an object at newKey
+	//stores without a rename copy the object and delete it afterwards
+	Rename(ctx context.Context, key string, newKey string) error
+}
+
+type objectInfo struct {
+	key      string
+	size     int64
+	modified time.Time
+}
+
+type ObjectWriter interface {
+	io.Writer
+	//completes the object
+	Close() error
+	//discards the object, used when encoding the file failed
+	Abort(err error)
+}
+
+var (
+	errObjectNotFound = errors.New("object not found")
+	errObjectExists   = errors.New("object already exists")
+)
+
+var objectStores = map[string]func(configRecord map[string]interface{}) (ObjectStore, error){
+	"file_store_local": newLocalStore,
+	"file_store_aws":   newS3Store,
+	"file_store_gcp":   newGCSStore,
+	"file_store_azure": newAzureStore,
+	"file_store_hdfs":  newHDFSStore,
+}
+
+//object store of a stream
+func openObjectStore(configRecord map[string]interface{}) (ObjectStore, error) {
+
+	for literal, constructor := range objectStores {
+		if configRecord["file_store_type_id"] == GetStorageTypeId(literal) {
+			return constructor(configRecord)
+		}
+	}
+
+	return nil, fmt.Errorf("unknown file_store_type_id %v", configRecord["file_store_type_id"])
+}
+
+//string value of a stream config attribute, blank if it is not set
+func configString(configRecord map[string]interface{}, attribute string) string {
+	value, _ := configRecord[attribute].(string)
+	return value
+}
+
+//key of a file below the store's location: folder_name/<message type and partitions>/<file name>
+func objectKey(configRecord map[string]interface{}, subFolderName string, fileName string) string {
+
+	if folderName := configString(configRecord, "folder_name"); folderName != "" {
+		return folderName + "/" + subFolderName + "/" + fileName
+	}
+
+	return subFolderName + "/" + fileName
+}
+
+//prefix of the keys below a folder for stores that list by key prefix
+func folderPrefix(folder string) string {
+
+	if folder = strings.TrimSuffix(folder, "/"); folder == "" {
+		return ""
+	}
+
+	return folder + "/"
+}
+
+//counts the bytes written to an object
+type countingWriter struct {
+	ObjectWriter
+	size int64
+}
+
+func (writer *countingWriter) Write(data []byte) (int, error) {
+	written, err := writer.ObjectWriter.Write(data)
+	writer.size += int64(written)
+	return written, err
+}
+
+//rows of a Parquet file, passed to write one by one so that they do not have to be in memory all at once
+type parquetRows func(write func(row []byte) error) error
+
+//rows of a Parquet file that are in memory
+func rowSlice(rows [][]byte) parquetRows {
+	return func(write func(row []byte) error) error {
+		for _, row := range rows {
+			if err := write(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+//encodes the rows as Parquet straight into a new object of the store and returns its size
+func writeObject(store ObjectStore, key string, schema string, rows parquetRows, configRecord map[string]interface{}) (int64, error) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	objectWriter, err := store.Create(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	counter := &countingWriter{ObjectWriter: objectWriter}
+
+	if err = WriteToFile(schema, writerfile.NewWriterFile(counter), rows, configRecord); err != nil {
+		objectWriter.Abort(err)
+		return 0, err
+	}
+
+	return counter.size, objectWriter.Close()
+}
+
+//writes a small object as a whole, replacing it if it exists
+func putObject(ctx context.Context, store ObjectStore, key string, data []byte) error {
+
+	objectWriter, err := store.Create(ctx, key)
+	if err != nil {
+		return err
+	}
+	if _, err = objectWriter.Write(data); err != nil {
+		objectWriter.Abort(err)
+		return err
+	}
+
+	return objectWriter.Close()
+}
+
+//writes a batch of rows sharing a schema to a single file of the stream's data store, commits it to the
+//stream's table format and updates the catalogs
+//failed writes are retried with backoff (see retry.go), the rows are still in memory so the file is encoded again
+//an error means the file was not written or not committed, catalog failures are logged and counted but do not fail the write
+func writeRows(messageType string, subFolderName string, fileName string, schemaNode *schemaNode, rows [][]byte, configRecord map[string]interface{}) error {
+
+	store, err := openObjectStore(configRecord)
+	if err != nil {
+		return err
+	}
+
+	file := tableFile{
+		messageType:   messageType,
+		subFolderName: subFolderName,
+		key:           objectKey(configRecord, subFolderName, fileName),
+		rows:          len(rows),
+		schema:        schemaNode,
+		configRecord:  configRecord,
+	}
+	key := file.key
+
+	if file.fieldIds, err = tableFieldIds(store, file); err != nil {
+		return errors.New("reading the table of " + key + " failed: " + err.Error())
+	}
+	schema, err := schemaNode.ParquetSchema(messageType, file.fieldIds)
+	if err != nil {
+		return err
+	}
+
+	err = withRetry(store.URI(""), storeRetryPolicy(store), func() error {
+		file.size, err = writeObject(store, key, schema, rowSlice(rows), configRecord)
+		return err
+	})
+	if err != nil {
+		return errors.New("writing " + key + " to " + store.SourceType() + " failed: " + err.Error())
+	}
+
+	log.Println("Finished writing " + key + " to " + store.SourceType())
+
+	if err = commitTableFile(store, file); err != nil {
+		//the file stays behind uncommitted, table readers do not see it
+		return errors.New("committing " + key + " failed: " + err.Error())
+	}
+
+	registerFile(store, file)
+
+	return nil
+}
+
+//object writer streaming into an upload that reads the other end of a pipe
+//the upload sees the error passed to Abort and must not complete the object then
+type pipeUpload struct {
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func startPipeUpload(upload func(reader io.Reader) error) *pipeUpload {
+
+	reader, writer := io.Pipe()
+	pipeUpload := &pipeUpload{pipe: writer, done: make(chan error, 1)}
+
+	go func() {
+		err := upload(reader)
+		//unblocks writes if the upload gave up early, they fail with the error of the upload
+		if err != nil {
+			reader.CloseWithError(err)
+		} else {
+			reader.CloseWithError(errors.New("upload ended before the file was complete"))
+		}
+		pipeUpload.done <- err
+	}()
+
+	return pipeUpload
+}
+
+func (pipeUpload *pipeUpload) Write(data []byte) (int, error) {
+	return pipeUpload.pipe.Write(data)
+}
+
+func (pipeUpload *pipeUpload) Close() error {
+	pipeUpload.pipe.Close()
+	return <-pipeUpload.done
+}
+
+func (pipeUpload *pipeUpload) Abort(err error) {
+	pipeUpload.pipe.CloseWithError(err)
+	<-pipeUpload.done
+}
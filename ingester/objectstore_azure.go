@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+//Azure Blob Storage, files are uploaded as blocks while they are encoded
+//bucket_name maps to the container, which is created if it does not exist
+type azureStore struct {
+	containerURL azblob.ContainerURL
+	accountName  string
+	bucket       string
+}
+
+func newAzureStore(configRecord map[string]interface{}) (ObjectStore, error) {
+
+	bucket := configString(configRecord, "bucket_name")
+	if bucket == "" {
+		return nil, errors.New("Bucket name (maps to Azure Storage Account Name) cannot be null or empty")
+	}
+
+	accountName := configString(configRecord, "azure_storage_account_name")
+	azureCredential, err := azblob.NewSharedKeyCredential(accountName, configString(configRecord, "azure_storage_access_key"))
+	if err != nil {
+		return nil, err
+	}
+
+	//Storage account blob service URL endpoint
+	azureUrl, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net", accountName))
+	if err != nil {
+		return nil, err
+	}
+
+	azureServiceURL := azblob.NewServiceURL(*azureUrl, azblob.NewPipeline(azureCredential, azblob.PipelineOptions{}))
+
+	return &azureStore{
+		containerURL: azureServiceURL.NewContainerURL(strings.ToLower(bucket)), // Container names require lowercase
+		accountName:  accountName,
+		bucket:       bucket,
+	}, nil
+}
+
+func (store *azureStore) SourceType() string {
+	return "Azure"
+}
+
+func (store *azureStore) Location() string {
+	return store.bucket
+}
+
+//ABFS URI of the blob, as Hadoop-based readers address the account
+func (store *azureStore) URI(key string) string {
+	return "abfss://" + strings.ToLower(store.bucket) + "@" + store.accountName + ".dfs.core.windows.net/" + key
+}
+
+func (store *azureStore) createContainer(ctx context.Context) error {
+
+	if properties, _ := store.containerURL.GetProperties(ctx, azblob.LeaseAccessConditions{}); properties == nil {
+		if _, err := store.containerURL.Create(ctx, azblob.Metadata{}, azblob.PublicAccessNone); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//service code of an Azure storage error, blank for other errors
+func azureServiceCode(err error) azblob.ServiceCodeType {
+
+	var storageErr azblob.StorageError
+	if errors.As(err, &storageErr) {
+		return storageErr.ServiceCode()
+	}
+
+	return ""
+}
+
+//blocks of a failed or aborted upload are never committed
+func (store *azureStore) Create(ctx context.Context, key string) (ObjectWriter, error) {
+
+	if err := store.createContainer(ctx); err != nil {
+		return nil, err
+	}
+
+	blobURL := store.containerURL.NewBlockBlobURL(key)
+
+	return startPipeUpload(func(reader io.Reader) error {
+		_, err := azblob.UploadStreamToBlockBlob(ctx, reader, blobURL, azblob.UploadStreamToBlockBlobOptions{
+			BufferSize:      4 * 1024 * 1024,
+			MaxBuffers:      4,
+			BlobHTTPHeaders: azblob.BlobHTTPHeaders{ContentType: "application/octet-stream"},
+		})
+		return err
+	}), nil
+}
+
+func (store *azureStore) Read(ctx context.Context, key string) ([]byte, error) {
+
+	response, err := store.containerURL.NewBlobURL(key).Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if code := azureServiceCode(err); code == azblob.ServiceCodeBlobNotFound || code == azblob.ServiceCodeContainerNotFound {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	body := response.Body(azblob.RetryReaderOptions{MaxRetryRequests: 3})
+	defer body.Close()
+
+	return ioutil.ReadAll(body)
+}
+
+func (store *azureStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+
+	objects := make([]objectInfo, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		segment, err := store.containerURL.ListBlobsFlatSegment(ctx, marker, azblob.ListBlobsSegmentOptions{Prefix: folderPrefix(prefix)})
+		if azureServiceCode(err) == azblob.ServiceCodeContainerNotFound {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range segment.Segment.BlobItems {
+			object := objectInfo{key: blob.Name, modified: blob.Properties.LastModified}
+			if blob.Properties.ContentLength != nil {
+				object.size = *blob.Properties.ContentLength
+			}
+			objects = append(objects, object)
+		}
+		marker = segment.NextMarker
+	}
+
+	return objects, nil
+}
+
+func (store *azureStore) Delete(ctx context.Context, key string) error {
+
+	_, err := store.containerURL.NewBlobURL(key).Delete(ctx, azblob.DeleteSnapshotsOptionInclude, azblob.BlobAccessConditions{})
+	if code := azureServiceCode(err); code == azblob.ServiceCodeBlobNotFound || code == azblob.ServiceCodeContainerNotFound {
+		return nil
+	}
+
+	return err
+}
+
+//the blob is only uploaded if it has no ETag yet
+func (store *azureStore) PutIfAbsent(ctx context.Context, key string, data []byte) error {
+
+	if err := store.createContainer(ctx); err != nil {
+		return err
+	}
+
+	_, err := store.containerURL.NewBlockBlobURL(key).Upload(ctx, bytes.NewReader(data),
+		azblob.BlobHTTPHeaders{ContentType: "application/octet-stream"}, azblob.Metadata{},
+		azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfNoneMatch: azblob.ETagAny}},
+		azblob.DefaultAccessTier, nil, azblob.ClientProvidedKeyOptions{})
+
+	if code := azureServiceCode(err); code == azblob.ServiceCodeBlobAlreadyExists || code == azblob.ServiceCodeConditionNotMet {
+		return errObjectExists
+	}
+
+	return err
+}
+
+//copies the blob within the container, waits for the copy to complete and deletes the original
+func (store *azureStore) Rename(ctx context.Context, key string, newKey string) error {
+
+	blobURL := store.containerURL.NewBlobURL(newKey)
+	started, err := blobURL.StartCopyFromURL(ctx, store.containerURL.NewBlobURL(key).URL(), azblob.Metadata{},
+		azblob.ModifiedAccessConditions{}, azblob.BlobAccessConditions{}, azblob.DefaultAccessTier, nil)
+	if err != nil {
+		return err
+	}
+
+	for status := started.CopyStatus(); status != azblob.CopyStatusSuccess; {
+		if status != azblob.CopyStatusPending {
+			return errors.New("copying " + key + " to " + newKey + " ended with status " + string(status))
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+		properties, err := blobURL.GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		if err != nil {
+			return err
+		}
+		status = properties.CopyStatus()
+	}
+
+	return store.Delete(ctx, key)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	secretmanager "cloud.google.com/go/secretmanager/apiv1"
+	"cloud.google.com/go/storage"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+//GCP Cloud Storage, files are uploaded in chunks while they are encoded
+type gcsStore struct {
+	credentials *google.Credentials
+	bucket      string
+}
+
+type gcsWriter struct {
+	client *storage.Client
+	writer *storage.Writer
+	cancel context.CancelFunc
+}
+
+func newGCSStore(configRecord map[string]interface{}) (ObjectStore, error) {
+
+	bucket := configString(configRecord, "bucket_name")
+	if bucket == "" {
+		return nil, errors.New("GCS bucket name cannot be null or empty")
+	}
+
+	//replace all \n	with \\n to preserve them
+	jsonCreds := strings.Replace(configString(configRecord, "gcp_json_credentials"), "\n", "\\n", -1)
+
+	creds, err := google.CredentialsFromJSON(context.Background(), []byte(jsonCreds), secretmanager.DefaultAuthScopes()...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gcsStore{credentials: creds, bucket: bucket}, nil
+}
+
+func (store *gcsStore) SourceType() string {
+	return "GCS"
+}
+
+func (store *gcsStore) Location() string {
+	return store.bucket
+}
+
+func (store *gcsStore) URI(key string) string {
+	return "gs://" + store.bucket + "/" + key
+}
+
+func (store *gcsStore) Create(ctx context.Context, key string) (ObjectWriter, error) {
+
+	client, err := storage.NewClient(ctx, option.WithCredentials(store.credentials))
+	if err != nil {
+		return nil, err
+	}
+
+	//the upload is abandoned by cancelling its context
+	ctx, cancel := context.WithCancel(ctx)
+
+	return &gcsWriter{client: client, writer: client.Bucket(store.bucket).Object(key).NewWriter(ctx), cancel: cancel}, nil
+}
+
+func (writer *gcsWriter) Write(data []byte) (int, error) {
+	return writer.writer.Write(data)
+}
+
+func (writer *gcsWriter) Close() error {
+
+	defer writer.client.Close()
+	defer writer.cancel()
+
+	return writer.writer.Close()
+}
+
+func (writer *gcsWriter) Abort(err error) {
+	writer.cancel()
+	writer.writer.Close()
+	writer.client.Close()
+}
+
+func (store *gcsStore) Read(ctx context.Context, key string) ([]byte, error) {
+
+	client, err := storage.NewClient(ctx, option.WithCredentials(store.credentials))
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	reader, err := client.Bucket(store.bucket).Object(key).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (store *gcsStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+
+	client, err := storage.NewClient(ctx, option.WithCredentials(store.credentials))
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	objects := make([]objectInfo, 0)
+	objectIterator := client.Bucket(store.bucket).Objects(ctx, &storage.Query{Prefix: folderPrefix(prefix)})
+	for {
+		attributes, err := objectIterator.Next()
+		if err == iterator.Done {
+			return objects, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, objectInfo{key: attributes.Name, size: attributes.Size, modified: attributes.Updated})
+	}
+}
+
+func (store *gcsStore) Delete(ctx context.Context, key string) error {
+
+	client, err := storage.NewClient(ctx, option.WithCredentials(store.credentials))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.Bucket(store.bucket).Object(key).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+
+	return err
+}
+
+//the object is only created if no generation of it exists
+func (store *gcsStore) PutIfAbsent(ctx context.Context, key string, data []byte) error {
+
+	client, err := storage.NewClient(ctx, option.WithCredentials(store.credentials))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	writer := client.Bucket(store.bucket).Object(key).If(storage.Conditions{DoesNotExist: true}).NewWriter(ctx)
+	if _, err = writer.Write(data); err != nil {
+		writer.Close()
+		return err
+	}
+
+	var apiErr *googleapi.Error
+	if err = writer.Close(); errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed {
+		return errObjectExists
+	}
+
+	return err
+}
+
+//copies the object within the bucket and deletes the original
+func (store *gcsStore) Rename(ctx context.Context, key string, newKey string) error {
+
+	client, err := storage.NewClient(ctx, option.WithCredentials(store.credentials))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	bucket := client.Bucket(store.bucket)
+	if _, err = bucket.Object(newKey).CopierFrom(bucket.Object(key)).Run(ctx); err != nil {
+		return err
+	}
+
+	err = bucket.Object(key).Delete(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/colinmarc/hdfs"
+	hdfsproto "github.com/colinmarc/hdfs/protocol/hadoop_hdfs"
+	"github.com/colinmarc/hdfs/rpc"
+)
+
+//HDFS, bucket_name is the root folder
+type hdfsStore struct {
+	address string
+	root    string
+}
+
+//files are written under a hidden name and renamed once complete
+type hdfsWriter struct {
+	client    *hdfs.Client
+	writer    *hdfs.FileWriter
+	path      string
+	finalPath string
+}
+
+func newHDFSStore(configRecord map[string]interface{}) (ObjectStore, error) {
+
+	bucket := configString(configRecord, "bucket_name")
+	if bucket == "" {
+		return nil, errors.New("HDFS root folder (bucket) name cannot be null or empty")
+	}
+
+	port, _ := configRecord["namenode_port"].(float64)
+
+	return &hdfsStore{
+		address: configString(configRecord, "namenode_host") + ":" + strconv.Itoa(int(port)),
+		root:    bucket,
+	}, nil
+}
+
+func (store *hdfsStore) SourceType() string {
+	return "HDFS"
+}
+
+func (store *hdfsStore) Location() string {
+	return store.root
+}
+
+func (store *hdfsStore) URI(key string) string {
+	return "hdfs://" + store.address + path.Join("/", store.root) + "/" + key
+}
+
+//connects to the namenode and creates the parent folder of key
+func (store *hdfsStore) connect(key string) (*hdfs.Client, string, error) {
+
+	client, err := hdfs.New(store.address)
+	if err != nil {
+		return nil, "", err
+	}
+
+	finalPath := path.Join("/", store.root, key)
+	if err = client.MkdirAll(path.Dir(finalPath), os.FileMode(0777)); err != nil {
+		client.Close()
+		return nil, "", err
+	}
+
+	return client, finalPath, nil
+}
+
+func (store *hdfsStore) Create(ctx context.Context, key string) (ObjectWriter, error) {
+
+	client, finalPath, err := store.connect(key)
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := path.Join(path.Dir(finalPath), "."+path.Base(finalPath))
+	client.Remove(filePath) //left over from an earlier attempt
+
+	writer, err := client.Create(filePath)
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &hdfsWriter{client: client, writer: writer, path: filePath, finalPath: finalPath}, nil
+}
+
+func (writer *hdfsWriter) Write(data []byte) (int, error) {
+	return writer.writer.Write(data)
+}
+
+func (writer *hdfsWriter) Close() error {
+
+	defer writer.client.Close()
+
+	err := writer.writer.Close()
+	if err == nil {
+		writer.client.Remove(writer.finalPath) //renaming onto an existing file fails
+		err = writer.client.Rename(writer.path, writer.finalPath)
+	}
+	if err != nil {
+		writer.client.Remove(writer.path)
+	}
+
+	return err
+}
+
+func (writer *hdfsWriter) Abort(err error) {
+	writer.writer.Close()
+	writer.client.Remove(writer.path)
+	writer.client.Close()
+}
+
+func (store *hdfsStore) Read(ctx context.Context, key string) ([]byte, error) {
+
+	client, err := hdfs.New(store.address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	data, err := client.ReadFile(path.Join("/", store.root, key))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+
+	return data, err
+}
+
+func (store *hdfsStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+
+	client, err := hdfs.New(store.address)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	root := path.Join("/", store.root)
+	objects := make([]objectInfo, 0)
+	err = client.Walk(path.Join(root, prefix), func(filePath string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return err
+		}
+		objects = append(objects, objectInfo{key: strings.TrimPrefix(filePath, root+"/"), size: info.Size(), modified: info.ModTime()})
+		return nil
+	})
+
+	return objects, err
+}
+
+func (store *hdfsStore) Delete(ctx context.Context, key string) error {
+
+	client, err := hdfs.New(store.address)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.Remove(path.Join("/", store.root, key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+func (store *hdfsStore) Rename(ctx context.Context, key string, newKey string) error {
+
+	client, newPath, err := store.connect(newKey)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	client.Remove(newPath) //renaming onto an existing file fails
+
+	return client.Rename(path.Join("/", store.root, key), newPath)
+}
+
+//the object is written under a hidden name and renamed to its final name without overwriting,
+//so that readers never see a partly written object - the namenode refuses the rename if the object exists
+func (store *hdfsStore) PutIfAbsent(ctx context.Context, key string, data []byte) error {
+
+	user, err := hdfs.Username()
+	if err != nil {
+		return err
+	}
+
+	//the rename is sent on the connection directly, the client only renames with overwrite
+	namenode, err := rpc.NewNamenodeConnection(store.address, user)
+	if err != nil {
+		return err
+	}
+	client, err := hdfs.NewClient(hdfs.ClientOptions{Namenode: namenode})
+	if err != nil {
+		namenode.Close()
+		return err
+	}
+	defer client.Close()
+
+	finalPath := path.Join("/", store.root, key)
+	if err = client.MkdirAll(path.Dir(finalPath), os.FileMode(0777)); err != nil {
+		return err
+	}
+
+	//unique per attempt, concurrent writers of the same object do not share it
+	filePath := path.Join(path.Dir(finalPath), "."+path.Base(finalPath)+"."+strconv.FormatInt(randomInt63(), 16))
+	writer, err := client.Create(filePath)
+	if err != nil {
+		return err
+	}
+	defer client.Remove(filePath)
+
+	_, err = writer.Write(data)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	overwrite := false
+	err = namenode.Execute("rename2", &hdfsproto.Rename2RequestProto{Src: &filePath, Dst: &finalPath, OverwriteDest: &overwrite}, &hdfsproto.Rename2ResponseProto{})
+	if namenodeErr, ok := err.(*rpc.NamenodeError); ok && namenodeErr.Exception == "org.apache.hadoop.fs.FileAlreadyExistsException" {
+		return errObjectExists
+	}
+
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+//local data store, mounted into Dremio at DREMIO_MOUNT_PATH
+type localStore struct {
+	root string
+}
+
+//files are written under a hidden name and renamed once complete, Dremio skips hidden files
+type localWriter struct {
+	file      *os.File
+	path      string
+	finalPath string
+}
+
+func newLocalStore(configRecord map[string]interface{}) (ObjectStore, error) {
+	return &localStore{root: "datastore"}, nil //root will always be datastore
+}
+
+func (store *localStore) SourceType() string {
+	return "Local"
+}
+
+func (store *localStore) Location() string {
+	return store.root
+}
+
+//files are referenced where Dremio sees them
+func (store *localStore) URI(key string) string {
+	return "file://" + strings.TrimSuffix(GetEnv("DREMIO_MOUNT_PATH", "/mnt/datastore"), "/") + "/" + key
+}
+
+func (store *localStore) Create(ctx context.Context, key string) (ObjectWriter, error) {
+
+	finalPath := filepath.Join(store.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(filepath.Dir(finalPath), "."+filepath.Base(finalPath))
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &localWriter{file: file, path: path, finalPath: finalPath}, nil
+}
+
+func (writer *localWriter) Write(data []byte) (int, error) {
+	return writer.file.Write(data)
+}
+
+func (writer *localWriter) Close() error {
+
+	err := writer.file.Sync()
+	if closeErr := writer.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(writer.path, writer.finalPath)
+	}
+	if err != nil {
+		os.Remove(writer.path)
+	}
+
+	return err
+}
+
+func (writer *localWriter) Abort(err error) {
+	writer.file.Close()
+	os.Remove(writer.path)
+}
+
+func (store *localStore) Read(ctx context.Context, key string) ([]byte, error) {
+
+	data, err := ioutil.ReadFile(filepath.Join(store.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil, errObjectNotFound
+	}
+
+	return data, err
+}
+
+func (store *localStore) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+
+	objects := make([]objectInfo, 0)
+	err := filepath.Walk(filepath.Join(store.root, filepath.FromSlash(prefix)), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || info.IsDir() || strings.HasPrefix(info.Name(), ".") {
+			return err
+		}
+		key, err := filepath.Rel(store.root, path)
+		objects = append(objects, objectInfo{key: filepath.ToSlash(key), size: info.Size(), modified: info.ModTime()})
+		return err
+	})
+
+	return objects, err
+}
+
+func (store *localStore) Delete(ctx context.Context, key string) error {
+
+	err := os.Remove(filepath.Join(store.root, filepath.FromSlash(key)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+//the object is written under a hidden name and linked to its final name, linking fails if that exists
+func (store *localStore) PutIfAbsent(ctx context.Context, key string, data []byte) error {
+
+	finalPath := filepath.Join(store.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(finalPath), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(finalPath), "."+filepath.Base(finalPath))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Link(file.Name(), finalPath); os.IsExist(err) {
+		return errObjectExists
+	}
+
+	return err
+}
+
+func (store *localStore) Rename(ctx context.Context, key string, newKey string) error {
+	return os.Rename(filepath.Join(store.root, filepath.FromSlash(key)), filepath.Join(store.root, filepath.FromSlash(newKey)))
+}
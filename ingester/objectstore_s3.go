@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+//AWS S3 or an S3-compatible store (MinIO, Ceph, R2), files are uploaded in parts while they are encoded
+type s3Store struct {
+	session  *session.Session
+	bucket   string
+	endpoint s3Endpoint
+}
+
+//S3-compatible endpoint of a stream, blank url for AWS itself
+//	s3_endpoint         - URL of the endpoint, e.g. https://minio.internal:9000
+//	s3_force_path_style - bucket in the path instead of the host name, defaults to true with an endpoint
+//	s3_tls_verify       - verify the endpoint's certificate, defaults to true
+//	s3_ca_cert          - PEM encoded CA certificate(s), or the path of a PEM file, to verify the endpoint with
+type s3Endpoint struct {
+	url       string
+	host      string
+	secure    bool
+	pathStyle bool
+	tlsVerify bool
+	caCert    string
+}
+
+func streamS3Endpoint(configRecord map[string]interface{}) (s3Endpoint, error) {
+
+	endpoint := s3Endpoint{url: strings.TrimSpace(configString(configRecord, "s3_endpoint")), secure: true, tlsVerify: true}
+	endpoint.caCert = strings.TrimSpace(configString(configRecord, "s3_ca_cert"))
+	if tlsVerify, ok := configRecord["s3_tls_verify"].(bool); ok {
+		endpoint.tlsVerify = tlsVerify
+	}
+	endpoint.pathStyle, _ = configRecord["s3_force_path_style"].(bool)
+
+	if endpoint.url == "" {
+		return endpoint, nil
+	}
+
+	parsed, err := url.Parse(endpoint.url)
+	if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return endpoint, errors.New("s3_endpoint must be an http or https URL")
+	}
+	endpoint.host = parsed.Host
+	endpoint.secure = parsed.Scheme == "https"
+
+	if _, found := configRecord["s3_force_path_style"]; !found {
+		endpoint.pathStyle = true //most S3-compatible stores do not support virtual-hosted buckets
+	}
+
+	return endpoint, nil
+}
+
+//HTTP client of the endpoint, nil for the default client
+//the SDK installs a custom CA bundle in the transport of the client, so the store needs a client of its own then
+func (endpoint s3Endpoint) httpClient() *http.Client {
+
+	if endpoint.tlsVerify && endpoint.caCert == "" {
+		return nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: !endpoint.tlsVerify}
+
+	return &http.Client{Transport: transport}
+}
+
+//CA bundle the endpoint is verified with, nil for the system's (or AWS_CA_BUNDLE's) trust store
+func (endpoint s3Endpoint) caBundle() ([]byte, error) {
+
+	if endpoint.caCert == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(endpoint.caCert, "-----BEGIN") {
+		return []byte(endpoint.caCert), nil
+	}
+
+	return ioutil.ReadFile(endpoint.caCert)
+}
+
+func newS3Store(configRecord map[string]interface{}) (ObjectStore, error) {
+
+	endpoint, err := streamS3Endpoint(configRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	region := strings.TrimSpace(configString(configRecord, "region"))
+	if region == "" && endpoint.url != "" {
+		region = "us-east-1" //S3-compatible stores mostly ignore the region, but the signature needs one
+	}
+	if region == "" {
+		return nil, errors.New("AWS Region cannot be null or empty")
+	}
+
+	bucket := configString(configRecord, "bucket_name")
+	if bucket == "" {
+		return nil, errors.New("S3 bucket name cannot be null or empty")
+	}
+
+	awsConfig := &aws.Config{
+		Region: aws.String(region),
+		Credentials: credentials.NewStaticCredentials(
+			strings.TrimSpace(configString(configRecord, "aws_access_key_id")),
+			strings.TrimSpace(configString(configRecord, "aws_secret_access_key")),
+			""),
+		S3ForcePathStyle: aws.Bool(endpoint.pathStyle),
+	}
+	if endpoint.url != "" {
+		awsConfig.Endpoint = aws.String(endpoint.url)
+	}
+
+	if httpClient := endpoint.httpClient(); httpClient != nil {
+		awsConfig.HTTPClient = httpClient
+	}
+
+	//a bundle of the stream takes precedence over AWS_CA_BUNDLE
+	options := session.Options{Config: *awsConfig}
+	caBundle, err := endpoint.caBundle()
+	if err != nil {
+		return nil, err
+	}
+	if caBundle != nil {
+		options.CustomCABundle = bytes.NewReader(caBundle)
+	}
+
+	awsSession, err := session.NewSessionWithOptions(options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Store{session: awsSession, bucket: bucket, endpoint: endpoint}, nil
+}
+
+func (store *s3Store) SourceType() string {
+	return "S3"
+}
+
+func (store *s3Store) Location() string {
+	return store.bucket
+}
+
+func (store *s3Store) URI(key string) string {
+	return "s3://" + store.bucket + "/" + key
+}
+
+//a failed or aborted upload is not completed, the uploader aborts the multipart upload
+func (store *s3Store) Create(ctx context.Context, key string) (ObjectWriter, error) {
+
+	uploader := s3manager.NewUploader(store.session)
+
+	return startPipeUpload(func(reader io.Reader) error {
+		_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket: aws.String(store.bucket),
+			Key:    aws.String(key),
+			Body:   reader,
+		})
+		return err
+	}), nil
+}
+
+func (store *s3Store) Read(ctx context.Context, key string) ([]byte, error) {
+
+	output, err := s3.New(store.session).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return nil, errObjectNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return ioutil.ReadAll(output.Body)
+}
+
+func (store *s3Store) List(ctx context.Context, prefix string) ([]objectInfo, error) {
+
+	objects := make([]objectInfo, 0)
+	err := s3.New(store.session).ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(store.bucket),
+		Prefix: aws.String(folderPrefix(prefix)),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			objects = append(objects, objectInfo{key: aws.StringValue(object.Key), size: aws.Int64Value(object.Size), modified: aws.TimeValue(object.LastModified)})
+		}
+		return true
+	})
+
+	return objects, err
+}
+
+//conditional writes (If-None-Match) are supported by S3 and most S3-compatible stores
+//a concurrent conditional write of the same key is reported as a conflict, it is treated as existing as well
+func (store *s3Store) PutIfAbsent(ctx context.Context, key string, data []byte) error {
+
+	_, err := s3.New(store.session).PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}, request.WithSetRequestHeaders(map[string]string{"If-None-Match": "*"}))
+
+	if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == "PreconditionFailed" || awsErr.Code() == "ConditionalRequestConflict") {
+		return errObjectExists
+	}
+
+	return err
+}
+
+func (store *s3Store) Delete(ctx context.Context, key string) error {
+
+	_, err := s3.New(store.session).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(store.bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+//copies the object within the bucket and deletes the original, single copies are limited to 5 GB
+func (store *s3Store) Rename(ctx context.Context, key string, newKey string) error {
+
+	_, err := s3.New(store.session).CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:     aws.String(store.bucket),
+		Key:        aws.String(newKey),
+		CopySource: aws.String((&url.URL{Path: store.bucket + "/" + key}).EscapedPath()),
+	})
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(ctx, key)
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata" //the alpine image has no zoneinfo
+)
+
+//partition spec of a stream (`partition_spec`), e.g.
+//	{"event_time_field": "created_at", "timezone": "Europe/Berlin", "hive_style": true,
+//	 "fields": [{"name": "event_day", "transform": "day"}, {"name": "country", "source": "country"}]}
+//every field adds one directory level below the message type, `key=value` if hive_style is set
+//time transforms use the event time unless they have a source field of their own, the event time is taken
+//from event_time_field (RFC3339 or epoch) and falls back to the time the event is processed
+//streams without a spec are partitioned by the processing time at the granularity of partition_time_id
+type partitionSpec struct {
+	eventTimeField string
+	location       *time.Location
+	hiveStyle      bool
+	fields         []partitionField
+}
+
+type partitionField struct {
+	name          string
+	source        string //dotted path of the payload field, blank for the event time
+	transformName string
+	transform     partitionTransform
+	argument      int
+}
+
+//derives a partition value from a field value (nil if it is missing) and the event time of the row
+//the second return value is false if there is no value, the row then ends up in the default partition
+type partitionTransform func(value interface{}, eventTime time.Time, argument int) (string, bool)
+
+//transforms by name, time transforms are applied to the event time in the timezone of the spec
+//transforms taking an argument are written as name[argument], e.g. bucket[16]
+var partitionTransforms = map[string]partitionTransform{
+	"identity": identityTransform,
+	"year":     timeTransform(func(t time.Time) string { return t.Format("2006") }),
+	"quarter":  timeTransform(func(t time.Time) string { return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())+2)/3) }),
+	"month":    timeTransform(func(t time.Time) string { return t.Format("2006-01") }),
+	"week": timeTransform(func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	}),
+	"day":      timeTransform(func(t time.Time) string { return t.Format("2006-01-02") }),
+	"hour":     timeTransform(func(t time.Time) string { return t.Format("2006-01-02-15") }),
+	"truncate": truncateTransform,
+	"bucket":   bucketTransform,
+}
+
+//time transforms of the legacy partition_time_id values
+var partitionTimeTransforms = map[string]string{
+	"partition_time_hourly":    "hour",
+	"partition_time_daily":     "day",
+	"partition_time_weekly":    "week",
+	"partition_time_monthly":   "month",
+	"partition_time_quarterly": "quarter",
+}
+
+//folder formats of streams without a partition_spec that differ from the transforms, kept so that their
+//tables are not split across two layouts - the legacy quarterly format was broken and is written as YYYY-Q
+var legacyPartitionTimeTransforms = map[string]partitionTransform{
+	"week": timeTransform(func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	}),
+	"quarter": timeTransform(func(t time.Time) string { return fmt.Sprintf("%d-%d", t.Year(), (int(t.Month())+2)/3) }),
+}
+
+//true for transforms of the event time
+func partitionTransformIsTime(transformName string) bool {
+	switch transformName {
+	case "year", "quarter", "month", "week", "day", "hour":
+		return true
+	}
+	return false
+}
+
+//Hive's name for the partition of missing values
+const defaultPartitionValue = "__HIVE_DEFAULT_PARTITION__"
+
+var transformPattern = regexp.MustCompile(`^([a-z_]+)(?:\[(\d+)\])?$`)
+
+var locations sync.Map
+
+func identityTransform(value interface{}, eventTime time.Time, argument int) (string, bool) {
+
+	switch typedValue := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return typedValue, typedValue != ""
+	case float64:
+		return strconv.FormatFloat(typedValue, 'f', -1, 64), true
+	}
+
+	return fmt.Sprint(value), true
+}
+
+func timeTransform(format func(time.Time) string) partitionTransform {
+	return func(value interface{}, eventTime time.Time, argument int) (string, bool) {
+		return format(eventTime), true
+	}
+}
+
+//first argument characters of the value
+func truncateTransform(value interface{}, eventTime time.Time, argument int) (string, bool) {
+
+	partition, ok := identityTransform(value, eventTime, argument)
+	if runes := []rune(partition); ok && argument > 0 && len(runes) > argument {
+		partition = string(runes[:argument])
+	}
+
+	return partition, ok
+}
+
+//hash of the value modulo argument, spreads high cardinality fields over a fixed number of partitions
+func bucketTransform(value interface{}, eventTime time.Time, argument int) (string, bool) {
+
+	partition, ok := identityTransform(value, eventTime, argument)
+	if !ok || argument <= 0 {
+		return "", false
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(partition))
+	return strconv.Itoa(int(hash.Sum32() % uint32(argument))), true
+}
+
+//value of a dotted path in the payload, nil if it does not exist
+func lookupPath(payload map[string]interface{}, path string) interface{} {
+
+	var value interface{} = payload
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[name]
+	}
+
+	return value
+}
+
+func loadLocation(name string) (*time.Location, error) {
+
+	if name == "" {
+		return time.UTC, nil
+	}
+	if location, found := locations.Load(name); found {
+		return location.(*time.Location), nil
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations.Store(name, location)
+
+	return location, nil
+}
+
+//parses a partition field of the spec
+func parsePartitionField(entry map[string]interface{}) (partitionField, error) {
+
+	field := partitionField{}
+	field.name, _ = entry["name"].(string)
+	field.source, _ = entry["source"].(string)
+	transformName, _ := entry["transform"].(string)
+
+	if transformName == "" {
+		transformName = "identity"
+	}
+	if field.name == "" {
+		field.name = field.source
+	}
+	if field.name == "" {
+		return field, errors.New("partition field without name")
+	}
+
+	match := transformPattern.FindStringSubmatch(transformName)
+	if match == nil || partitionTransforms[match[1]] == nil {
+		return field, errors.New("unknown partition transform `" + transformName + "`")
+	}
+	field.transformName = match[1]
+	field.transform = partitionTransforms[match[1]]
+	field.argument, _ = strconv.Atoi(match[2])
+
+	return field, nil
+}
+
+//time partition field of the partition_time_id of a stream, in the legacy folder format if legacy is set
+func partitionTimeFields(configRecord map[string]interface{}, legacy bool) []partitionField {
+
+	for literal, transformName := range partitionTimeTransforms {
+		if configRecord["partition_time_id"] == GetPartitionTimeId(literal) {
+			transform := partitionTransforms[transformName]
+			if legacyTransform, found := legacyPartitionTimeTransforms[transformName]; legacy && found {
+				transform = legacyTransform
+			}
+			return []partitionField{{name: "event_" + transformName, transformName: transformName, transform: transform}}
+		}
+	}
+
+	return nil
+}
+
+//partition spec of a stream, built from partition_time_id if the stream has none
+//streams without one keep the folders they have always been written to, by the local processing time
+func streamPartitionSpec(configRecord map[string]interface{}) (*partitionSpec, error) {
+
+	spec := &partitionSpec{location: time.UTC}
+
+	entries, _ := configRecord["partition_spec"].(map[string]interface{})
+	if entries == nil {
+		spec.location = time.Local
+		spec.fields = partitionTimeFields(configRecord, true)
+		return spec, nil
+	}
+
+	spec.eventTimeField, _ = entries["event_time_field"].(string)
+	spec.hiveStyle, _ = entries["hive_style"].(bool)
+
+	timezone, _ := entries["timezone"].(string)
+	location, err := loadLocation(timezone)
+	if err != nil {
+		return nil, err
+	}
+	spec.location = location
+
+	fields, _ := entries["fields"].([]interface{})
+	for _, fieldEntry := range fields {
+		entry, _ := fieldEntry.(map[string]interface{})
+		field, err := parsePartitionField(entry)
+		if err != nil {
+			return nil, err
+		}
+		spec.fields = append(spec.fields, field)
+	}
+
+	//a spec without fields still partitions by the granularity of the stream, but on event time
+	if len(fields) == 0 {
+		spec.fields = partitionTimeFields(configRecord, false)
+	}
+
+	return spec, nil
+}
+
+//event time of a payload, false if the stream has no event time field or the field is missing or invalid
+func (spec *partitionSpec) payloadEventTime(payload map[string]interface{}) (time.Time, bool) {
+
+	if spec.eventTimeField == "" {
+		return time.Time{}, false
+	}
+
+	value := lookupPath(payload, spec.eventTimeField)
+	if value == nil {
+		return time.Time{}, false
+	}
+
+	nanoseconds, err := toTimestamp(value, time.Nanosecond)
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return time.Unix(0, nanoseconds), true
+}
+
+//event time of a payload, the processing time if the event time field is missing or invalid
+func (spec *partitionSpec) eventTime(payload map[string]interface{}, now time.Time) time.Time {
+
+	if eventTime, ok := spec.payloadEventTime(payload); ok {
+		return eventTime
+	}
+
+	return now
+}
+
+//escapes characters that cannot be used in directory names the way Hive does
+func escapePartitionValue(value string) string {
+
+	var escaped strings.Builder
+	for _, character := range []byte(value) {
+		if character < 0x20 || character == 0x7f || strings.IndexByte("\"#%'*/:=?\\{}[]^", character) >= 0 {
+			escaped.WriteString(fmt.Sprintf("%%%02X", character))
+		} else {
+			escaped.WriteByte(character)
+		}
+	}
+
+	return escaped.String()
+}
+
+//partition directories of a payload, relative to the message type folder
+func (spec *partitionSpec) directories(payload map[string]interface{}, eventTime time.Time) []string {
+
+	eventTime = eventTime.In(spec.location)
+
+	directories := make([]string, 0, len(spec.fields))
+	for _, field := range spec.fields {
+
+		var value interface{}
+		fieldTime := eventTime
+		if field.source != "" {
+			value = lookupPath(payload, field.source)
+			if nanoseconds, err := toTimestamp(value, time.Nanosecond); err == nil {
+				fieldTime = time.Unix(0, nanoseconds).In(spec.location)
+			}
+		}
+
+		partition, ok := field.transform(value, fieldTime, field.argument)
+		if ok {
+			partition = escapePartitionValue(partition)
+		} else {
+			partition = defaultPartitionValue
+		}
+
+		if spec.hiveStyle {
+			partition = escapePartitionValue(field.name) + "=" + partition
+		}
+		directories = append(directories, partition)
+	}
+
+	return directories
+}
+
+//names of the partition columns of a stream, only if they are written Hive-style and can be read as columns
+func partitionColumns(configRecord map[string]interface{}) []string {
+
+	spec, err := streamPartitionSpec(configRecord)
+	if err != nil || !spec.hiveStyle {
+		return nil
+	}
+
+	columns := make([]string, len(spec.fields))
+	for index, field := range spec.fields {
+		columns[index] = field.name
+	}
+
+	return columns
+}
+
+//folder of a payload below the stream's folder: the message type followed by the partition directories
+func generateSubFolderName(messageType string, payload map[string]interface{}, configRecord map[string]interface{}) string {
+
+	spec, err := streamPartitionSpec(configRecord)
+	if err != nil {
+		log.Println("Invalid partition spec, partitioning by processing time", err)
+		spec, _ = streamPartitionSpec(map[string]interface{}{"partition_time_id": configRecord["partition_time_id"]})
+	}
+
+	return strings.Join(append([]string{messageType}, spec.directories(payload, spec.eventTime(payload, time.Now()))...), "/")
+}
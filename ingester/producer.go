@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//shared, long-lived Kafka producer used to forward messages to the next function in the chain
+//kafka.Writer is safe for concurrent use, messages written by concurrent invocations are batched together
+var producer *kafka.Writer
+
+//GetEnvInt get key environment variable as an int if exist and valid otherwise return defaultValue
+func GetEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(GetEnv(key, ""))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+//maps KAFKA_ACKS to the kafka-go setting, defaults to waiting for all in-sync replicas
+func getRequiredAcks(acks string) kafka.RequiredAcks {
+	switch strings.ToLower(acks) {
+	case "0", "none":
+		return kafka.RequireNone
+	case "1", "one", "leader":
+		return kafka.RequireOne
+	}
+	return kafka.RequireAll
+}
+
+//maps KAFKA_COMPRESSION to the kafka-go codec, no compression if blank or unknown
+func getCompression(compression string) kafka.Compression {
+	switch strings.ToLower(compression) {
+	case "gzip":
+		return kafka.Gzip
+	case "snappy":
+		return kafka.Snappy
+	case "lz4":
+		return kafka.Lz4
+	case "zstd":
+		return kafka.Zstd
+	}
+	return 0
+}
+
+//creates the Kafka producer using environment variables
+//messages are partitioned by key with the same murmur2 hashing the Java clients use,
+//so every stream always lands on the same partition and keeps its order
+//attempts and timeout are read from the same settings as in the ingest service
+func NewProducer(kafkaURL string) *kafka.Writer {
+
+	return &kafka.Writer{
+		Addr:                   kafka.TCP(strings.Split(kafkaURL, ",")...),
+		Balancer:               &kafka.Murmur2Balancer{},
+		BatchSize:              GetEnvInt("KAFKA_BATCH_SIZE", 100),
+		BatchBytes:             int64(GetEnvInt("KAFKA_BATCH_BYTES", 1048576)),
+		BatchTimeout:           time.Duration(GetEnvInt("KAFKA_LINGER_MS", 10)) * time.Millisecond,
+		WriteTimeout:           time.Duration(GetEnvInt("KAFKA_WRITE_TIMEOUT_MS", 2000)) * time.Millisecond,
+		MaxAttempts:            GetEnvInt("KAFKA_MAX_ATTEMPTS", 3),
+		RequiredAcks:           getRequiredAcks(GetEnv("KAFKA_ACKS", "all")),
+		Compression:            getCompression(GetEnv("KAFKA_COMPRESSION", "")),
+		AllowAutoTopicCreation: true, //same behaviour as DialLeader
+	}
+}
+
+//key for partitioning, messages of a stream share the key so that their order is kept
+func streamKey(request IncomingMessage) string {
+	if request.StreamId != "" {
+		return request.StreamId
+	}
+	if request.StreamAltId != "" {
+		return request.StreamAltId
+	}
+	return "message"
+}
+
+//utility method for Kafka message writing
+//blocks until the batch containing the messages has been acknowledged
+func WriteKafkaMessage(messages ...kafka.Message) error {
+
+	err := producer.WriteMessages(context.Background(), messages...)
+	if err != nil {
+		log.Println("failed to write messages:", err)
+		return err
+	}
+
+	return nil
+}
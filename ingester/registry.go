@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//schema registry, every version of the schema of a stream and message type is an object in the stream's data store
+//at `<folder_name>/_schemas/<message_type>/<version>.json`, created with ObjectStore.PutIfAbsent so that ingester
+//instances agree on the history - an instance that loses the race for a version reads it and checks its rows again
+//every schema files of a stream are written with is kept as a version along with its fingerprint, a copy of the
+//history is kept at schemas/<stream_id>/<message_type>.json for the config service
+//rows are checked against the schema_compatibility policy of their stream before they are written:
+//	backward - the new schema can read all data written so far (fields may only be added as optional,
+//	           types may only be promoted, e.g. int64 to double)
+//	forward  - the latest registered schema can read the new data (required fields must be present,
+//	           types may not change or be widened)
+//	full     - both
+//	none     - anything goes, conflicting types are widened
+//rows breaking the policy are dead-lettered and end up in the quarantine table of their stream
+type SchemaVersion struct {
+	Version     int         `json:"version"`
+	Fingerprint string      `json:"fingerprint"`
+	CreatedAt   string      `json:"created_at"`
+	Schema      *schemaNode `json:"schema"`
+}
+
+type SchemaHistory struct {
+	StreamId    string          `json:"stream_id"`
+	MessageType string          `json:"message_type"`
+	Versions    []SchemaVersion `json:"versions"`
+}
+
+//row that was not accepted by the registry
+type SchemaRejection struct {
+	Request IncomingMessage
+	Reason  string
+}
+
+var registry = struct {
+	sync.Mutex
+	histories map[string]*SchemaHistory
+}{histories: make(map[string]*SchemaHistory)}
+
+var schemaVersionPattern = regexp.MustCompile(`^([0-9]{20})\.json$`)
+
+//folder of the schema versions of a message type in the stream's data store
+func schemaVersionFolder(configRecord map[string]interface{}, messageType string) string {
+	return objectKey(configRecord, "_schemas", url.PathEscape(messageType))
+}
+
+func schemaVersionKey(configRecord map[string]interface{}, messageType string, version int) string {
+	return schemaVersionFolder(configRecord, messageType) + "/" + fmt.Sprintf("%020d.json", version)
+}
+
+func schemaRegistryPath(streamId string, messageType string) string {
+	return filepath.Join(GetEnv("SCHEMA_REGISTRY_DIR", "schemas"), url.PathEscape(streamId), url.PathEscape(messageType)+".json")
+}
+
+//compatibility policy of a stream, backward unless configured otherwise
+func schemaCompatibility(configRecord map[string]interface{}) string {
+	if policy, ok := configRecord["schema_compatibility"].(string); ok && policy != "" {
+		return policy
+	}
+	return GetEnv("SCHEMA_COMPATIBILITY", "backward")
+}
+
+//fingerprint of a schema, the JSON encoding is canonical as maps are encoded with sorted keys
+func schemaFingerprint(schema *schemaNode) (string, error) {
+
+	encoded, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+//loads the schema history of a stream and message type from its data store
+//versions never change once created, only those created since the last load are read
+//must be called with the registry locked
+func loadSchemaHistory(ctx context.Context, store ObjectStore, configRecord map[string]interface{}, messageType string) (*SchemaHistory, error) {
+
+	streamId := configString(configRecord, "stream_id")
+	key := streamId + "|" + messageType
+	history, found := registry.histories[key]
+	if !found {
+		history = &SchemaHistory{StreamId: streamId, MessageType: messageType, Versions: make([]SchemaVersion, 0)}
+		registry.histories[key] = history
+	}
+
+	objects, err := store.List(ctx, schemaVersionFolder(configRecord, messageType))
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]int, 0, len(objects))
+	for _, object := range objects {
+		match := schemaVersionPattern.FindStringSubmatch(object.key[strings.LastIndex(object.key, "/")+1:])
+		if match == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(match[1])
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	loaded := len(history.Versions)
+	for _, version := range versions {
+		if version != len(history.Versions)+1 {
+			continue
+		}
+
+		content, err := store.Read(ctx, schemaVersionKey(configRecord, messageType, version))
+		if err != nil {
+			return nil, err
+		}
+		var schemaVersion SchemaVersion
+		if err = json.Unmarshal(content, &schemaVersion); err != nil {
+			return nil, err
+		}
+		history.Versions = append(history.Versions, schemaVersion)
+	}
+
+	if len(history.Versions) > loaded {
+		if err = saveSchemaHistory(history); err != nil {
+			log.Println("error saving the schema history for the config service", err)
+		}
+	}
+
+	return history, nil
+}
+
+//saves the copy of a schema history the config service reads, the file is replaced atomically
+func saveSchemaHistory(history *SchemaHistory) error {
+
+	path := schemaRegistryPath(history.StreamId, history.MessageType)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(history, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	tempPath := path + ".tmp"
+	if err = ioutil.WriteFile(tempPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tempPath, path)
+}
+
+//latest registered schema, nil if there is none yet
+func (history *SchemaHistory) latest() *schemaNode {
+	if len(history.Versions) == 0 {
+		return nil
+	}
+	return history.Versions[len(history.Versions)-1].Schema
+}
+
+//checks a single row against the policy
+//current is the latest version merged with the rows accepted so far
+func checkCompatibility(policy string, latest *schemaNode, current *schemaNode, row *schemaNode) error {
+
+	//rows are written with the candidate schema, so values of promoted types are written as promoted
+	candidate := row
+	if current != nil {
+		candidate = current.prune()
+		candidate.mergeNode(row)
+	}
+
+	if policy == "backward" || policy == "full" {
+		if err := canRead(candidate, current, ""); err != nil {
+			return err
+		}
+	}
+
+	if policy == "forward" || policy == "full" {
+		if err := canRead(latest, candidate, ""); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//checks rows against the latest registered schema, returns the schema the accepted rows have to be written with
+func checkRows(policy string, latest *schemaNode, requests []IncomingMessage, typeHints map[string]string) (*schemaNode, []IncomingMessage, []SchemaRejection) {
+
+	var current *schemaNode
+	if latest != nil {
+		current = latest.prune()
+	}
+
+	accepted := make([]IncomingMessage, 0, len(requests))
+	rejected := make([]SchemaRejection, 0)
+
+	for _, request := range requests {
+
+		row := InferSchema([]map[string]interface{}{request.Payload}, typeHints)
+
+		if err := row.validate(request.Payload, ""); err != nil {
+			rejected = append(rejected, SchemaRejection{Request: request, Reason: "invalid value: " + err.Error()})
+			continue
+		}
+
+		if policy != "none" {
+			if err := checkCompatibility(policy, latest, current, row); err != nil {
+				rejected = append(rejected, SchemaRejection{Request: request, Reason: "incompatible schema: " + err.Error()})
+				continue
+			}
+		}
+
+		if current == nil {
+			current = row.prune()
+		} else {
+			current.mergeNode(row)
+		}
+		accepted = append(accepted, request)
+	}
+
+	return current, accepted, rejected
+}
+
+//checks the rows of a stream and message type against the registry and registers the schema
+//the accepted rows have to be written with, a new version is only added if the schema changed
+//an error means the registry could not be updated, the returned schema can still be used
+func RegisterSchema(configRecord map[string]interface{}, messageType string, requests []IncomingMessage) (*schemaNode, []IncomingMessage, []SchemaRejection, error) {
+
+	streamId, _ := configRecord["stream_id"].(string)
+	policy := schemaCompatibility(configRecord)
+	typeHints := streamTypeHints(configRecord)
+
+	registry.Lock()
+	defer registry.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(GetEnvInt("STORE_WRITE_TIMEOUT_SECONDS", 300))*time.Second)
+	defer cancel()
+
+	store, err := openObjectStore(configRecord)
+	if err != nil {
+		return InferRequestSchema(requests, typeHints), requests, nil, err
+	}
+
+	attempts := GetEnvInt("SCHEMA_REGISTRY_ATTEMPTS", 10)
+	for attempt := 1; ; attempt++ {
+
+		history, err := loadSchemaHistory(ctx, store, configRecord, messageType)
+		if err != nil {
+			//without its history the schema cannot be checked, rows are written as they are
+			return InferRequestSchema(requests, typeHints), requests, nil, err
+		}
+
+		current, accepted, rejected := checkRows(policy, history.latest(), requests, typeHints)
+		if current == nil {
+			return nil, accepted, rejected, nil
+		}
+
+		fingerprint, err := schemaFingerprint(current)
+		if err != nil {
+			return current, accepted, rejected, err
+		}
+
+		if len(history.Versions) > 0 && history.Versions[len(history.Versions)-1].Fingerprint == fingerprint {
+			return current, accepted, rejected, nil
+		}
+
+		version := SchemaVersion{
+			Version:     len(history.Versions) + 1,
+			Fingerprint: fingerprint,
+			CreatedAt:   time.Now().UTC().Format(time.RFC3339),
+			Schema:      current,
+		}
+		content, err := json.MarshalIndent(version, "", "    ")
+		if err != nil {
+			return current, accepted, rejected, err
+		}
+
+		err = store.PutIfAbsent(ctx, schemaVersionKey(configRecord, messageType, version.Version), content)
+		if err == nil {
+			history.Versions = append(history.Versions, version)
+			if err = saveSchemaHistory(history); err != nil {
+				log.Println("error saving the schema history for the config service", err)
+			}
+			incrementCounter("schema_versions_registered", streamId)
+			return current, accepted, rejected, nil
+		}
+
+		//another instance registered the version first, the rows are checked against it
+		if err != errObjectExists || attempt >= attempts {
+			return current, accepted, rejected, err
+		}
+	}
+}
+
+//infers the schema of a list of incoming messages
+func InferRequestSchema(requests []IncomingMessage, typeHints map[string]string) *schemaNode {
+
+	payloads := make([]map[string]interface{}, len(requests))
+	for index, request := range requests {
+		payloads[index] = request.Payload
+	}
+
+	return InferSchema(payloads, typeHints)
+}
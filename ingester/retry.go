@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//writes to the data stores and catalog updates are retried with exponential backoff and full jitter:
+//attempt n+1 waits a random time of up to min(<kind>_RETRY_MAX_MS, <kind>_RETRY_MS * 2^(n-1)) after attempt n failed
+//every destination (bucket, container, HDFS root or catalog) has a circuit breaker: once CIRCUIT_BREAKER_FAILURES
+//attempts in a row failed it opens and further operations fail right away for CIRCUIT_BREAKER_OPEN_SECONDS, so
+//that a broken destination does not hold up the buffers of other streams with its retries - after that a single
+//operation is let through as a probe and closes the breaker again if it succeeds
+type retryPolicy struct {
+	attempts       int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+}
+
+type circuitBreaker struct {
+	failures  int       //attempts that failed in a row
+	openUntil time.Time //zero while closed
+	probing   bool      //a probe is under way, other operations are still rejected
+}
+
+var circuitBreakers = struct {
+	sync.Mutex
+	entries map[string]*circuitBreaker
+}{entries: make(map[string]*circuitBreaker)}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+//retry policy of a kind of destination, e.g. "S3" or "Dremio"
+//<KIND>_RETRY_ATTEMPTS, <KIND>_RETRY_MS and <KIND>_RETRY_MAX_MS override the defaults of its group
+func retryPolicyFor(kind string, attemptsKey string, backoffKey string) retryPolicy {
+
+	prefix := strings.ToUpper(kind) + "_"
+
+	return retryPolicy{
+		attempts:       GetEnvInt(prefix+"RETRY_ATTEMPTS", GetEnvInt(attemptsKey, 3)),
+		initialBackoff: time.Duration(GetEnvInt(prefix+"RETRY_MS", GetEnvInt(backoffKey, 1000))) * time.Millisecond,
+		maxBackoff:     time.Duration(GetEnvInt(prefix+"RETRY_MAX_MS", GetEnvInt("RETRY_MAX_MS", 30000))) * time.Millisecond,
+	}
+}
+
+//retry policy of the writes to a data store, STORE_WRITE_ATTEMPTS and STORE_RETRY_MS by default
+func storeRetryPolicy(store ObjectStore) retryPolicy {
+	return retryPolicyFor(store.SourceType(), "STORE_WRITE_ATTEMPTS", "STORE_RETRY_MS")
+}
+
+//retry policy of the updates of a catalog, CATALOG_RETRY_ATTEMPTS and CATALOG_RETRY_MS by default
+func catalogRetryPolicy(catalog string) retryPolicy {
+	return retryPolicyFor(catalog, "CATALOG_RETRY_ATTEMPTS", "CATALOG_RETRY_MS")
+}
+
+//random wait before the attempt after the failed attempt, full jitter keeps writers that failed together apart
+func (policy retryPolicy) backoff(attempt int) time.Duration {
+
+	backoff := policy.initialBackoff
+	for step := 1; step < attempt && backoff < policy.maxBackoff; step++ {
+		backoff *= 2
+	}
+	if backoff > policy.maxBackoff {
+		backoff = policy.maxBackoff
+	}
+	if backoff <= 0 {
+		return 0
+	}
+
+	return time.Duration(randomInt63() % (int64(backoff) + 1))
+}
+
+//true if an operation may go to the destination
+func allowDestination(destination string) bool {
+
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+
+	breaker := circuitBreakers.entries[destination]
+	if breaker == nil || breaker.openUntil.IsZero() {
+		return true
+	}
+	if breaker.probing || time.Now().Before(breaker.openUntil) {
+		return false
+	}
+
+	breaker.probing = true
+	return true
+}
+
+//records the outcome of an attempt, the breaker of the destination opens once too many failed in a row
+func recordAttempt(destination string, err error) {
+
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+
+	breaker := circuitBreakers.entries[destination]
+	if err == nil {
+		if breaker != nil && !breaker.openUntil.IsZero() {
+			log.Println("Circuit breaker of " + destination + " closed")
+		}
+		delete(circuitBreakers.entries, destination)
+		return
+	}
+
+	if breaker == nil {
+		breaker = &circuitBreaker{}
+		circuitBreakers.entries[destination] = breaker
+	}
+	breaker.failures++
+
+	//a failed probe opens the breaker again right away
+	if breaker.probing || breaker.failures >= GetEnvInt("CIRCUIT_BREAKER_FAILURES", 5) {
+		if breaker.openUntil.IsZero() {
+			log.Println("Circuit breaker of " + destination + " opened after " + strconv.Itoa(breaker.failures) + " failures")
+			incrementCounter("circuit_breakers_opened", destination)
+		}
+		breaker.openUntil = time.Now().Add(time.Duration(GetEnvInt("CIRCUIT_BREAKER_OPEN_SECONDS", 60)) * time.Second)
+		breaker.probing = false
+	}
+}
+
+//destinations with an open circuit breaker and until when, for the metrics view
+func openCircuitBreakers() map[string]string {
+
+	circuitBreakers.Lock()
+	defer circuitBreakers.Unlock()
+
+	open := make(map[string]string)
+	for destination, breaker := range circuitBreakers.entries {
+		if !breaker.openUntil.IsZero() {
+			open[destination] = breaker.openUntil.UTC().Format(time.RFC3339)
+		}
+	}
+
+	return open
+}
+
+//runs the operation against the destination until it succeeds, the attempts of the policy are used up or the
+//circuit breaker of the destination opens - the error of the last attempt is returned then
+func withRetry(destination string, policy retryPolicy, operation func() error) error {
+
+	var err error
+	attempt := 0
+	for attempt < policy.attempts || attempt == 0 {
+		attempt++
+
+		if attempt > 1 {
+			log.Println("Attempt "+strconv.Itoa(attempt-1)+" of "+destination+" failed, retrying", err)
+			time.Sleep(policy.backoff(attempt - 1))
+		}
+
+		if !allowDestination(destination) {
+			if err == nil {
+				return errors.New(destination + ": " + errCircuitOpen.Error())
+			}
+			return errors.New(destination + ": " + errCircuitOpen.Error() + ", last error: " + err.Error())
+		}
+
+		err = operation()
+		recordAttempt(destination, err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return errors.New(destination + " failed after " + strconv.Itoa(attempt) + " attempts: " + err.Error())
+}
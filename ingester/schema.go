@@ -0,0 +1,450 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+)
+
+//schema inference across many payloads
+//payloads are merged into a tree of schema nodes: conflicting types are widened, fields that are missing
+//or null in some payloads become OPTIONAL and arrays are typed from all of their (non-null) elements
+//rows are then conformed to the merged schema so that all of them can be written to the same file
+type schemaNode struct {
+	dataType string                 //scalar type of the values (see types.go), "object" or "list", blank while only nulls were seen
+	fields   map[string]*schemaNode //fields of objects
+	element  *schemaNode            //element of lists
+	optional bool
+	objects  int //number of objects merged, fields first seen after the first object are optional
+}
+
+//Parquet schema in the JSON format of parquet-go
+type parquetSchemaItem struct {
+	Tag    string               `json:"Tag"`
+	Fields []*parquetSchemaItem `json:"Fields,omitempty"`
+}
+
+//infers the schema of a list of payloads, typeHints override the inferred types of the given paths
+func InferSchema(payloads []map[string]interface{}, typeHints map[string]string) *schemaNode {
+
+	root := new(schemaNode)
+	for _, payload := range payloads {
+		root.merge(payload, "", typeHints)
+	}
+
+	return root
+}
+
+//widest type two conflicting types can be represented with
+//anything can be represented as a string - objects and lists as their JSON encoding
+func widenType(dataType string, otherDataType string) string {
+
+	if dataType == otherDataType {
+		return dataType
+	}
+	if promoted := promoteType(dataType, otherDataType); promoted != "" {
+		return promoted
+	}
+
+	return "string"
+}
+
+func (node *schemaNode) mergeType(dataType string) {
+
+	if node.dataType == "" {
+		node.dataType = dataType
+		return
+	}
+
+	widened := widenType(node.dataType, dataType)
+	if widened != node.dataType && widened != "object" && widened != "list" {
+		node.fields = nil
+		node.element = nil
+	}
+	node.dataType = widened
+}
+
+//path of a field of an object at path
+func fieldPath(path string, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+//merges a single value at path into the node
+func (node *schemaNode) merge(value interface{}, path string, typeHints map[string]string) {
+
+	if hint, found := typeHints[path]; found && value != nil {
+		node.mergeType(hint)
+		return
+	}
+
+	switch typedValue := value.(type) {
+
+	case nil:
+		node.optional = true
+
+	case map[string]interface{}:
+		node.mergeType("object")
+		if node.dataType != "object" {
+			return
+		}
+
+		if node.fields == nil {
+			node.fields = make(map[string]*schemaNode)
+		}
+
+		for key, fieldValue := range typedValue {
+			field := node.fields[key]
+			if field == nil {
+				field = &schemaNode{optional: node.objects > 0}
+				node.fields[key] = field
+			}
+			field.merge(fieldValue, fieldPath(path, key), typeHints)
+		}
+
+		for key, field := range node.fields {
+			if _, found := typedValue[key]; !found {
+				field.optional = true
+			}
+		}
+
+		node.objects++
+
+	case []interface{}:
+		node.mergeType("list")
+		if node.dataType != "list" {
+			return
+		}
+
+		if node.element == nil {
+			node.element = new(schemaNode)
+		}
+
+		//parquet-go cannot write null list elements, they are dropped
+		for _, element := range typedValue {
+			if element != nil {
+				node.element.merge(element, path+"[]", typeHints)
+			}
+		}
+
+	default:
+		node.mergeType(inferType(value))
+	}
+}
+
+//nulls only, empty objects and empty lists cannot be represented in Parquet and are left out
+func (node *schemaNode) representable() bool {
+
+	switch node.dataType {
+	case "":
+		return false
+	case "object":
+		for _, field := range node.fields {
+			if field.representable() {
+				return true
+			}
+		}
+		return false
+	case "list":
+		return node.element != nil && node.element.representable()
+	}
+
+	return parquetTypeTag(node.dataType) != ""
+}
+
+func (node *schemaNode) repetitionType() string {
+	if node.optional {
+		return "OPTIONAL"
+	}
+	return "REQUIRED"
+}
+
+//fields of an object node sorted by name, so that the same structure always gives the same schema
+func (node *schemaNode) sortedFieldNames() []string {
+
+	names := make([]string, 0, len(node.fields))
+	for name, field := range node.fields {
+		if field.representable() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+//Parquet schema item of the node at path, tagged with its field id if fieldIds has one for the path
+func (node *schemaNode) parquetItem(name string, path string, fieldIds map[string]int) *parquetSchemaItem {
+
+	tag := "name=" + name
+	if fieldId, found := fieldIds[path]; found {
+		tag += ", fieldid=" + strconv.Itoa(fieldId)
+	}
+
+	switch node.dataType {
+
+	case "object":
+		item := &parquetSchemaItem{Tag: tag + ", repetitiontype=" + node.repetitionType()}
+		for _, fieldName := range node.sortedFieldNames() {
+			item.Fields = append(item.Fields, node.fields[fieldName].parquetItem(fieldName, fieldPath(path, fieldName), fieldIds))
+		}
+		return item
+
+	case "list":
+		return &parquetSchemaItem{
+			Tag:    tag + ", type=LIST, repetitiontype=" + node.repetitionType(),
+			Fields: []*parquetSchemaItem{node.element.parquetItem("element", path+"[]", fieldIds)},
+		}
+	}
+
+	return &parquetSchemaItem{Tag: tag + ", " + parquetTypeTag(node.dataType) + ", repetitiontype=" + node.repetitionType()}
+}
+
+//renders the schema in the JSON format expected by the parquet-go JSON writer
+//fieldIds optionally maps field paths (as used by type hints) to the field ids of table formats that need them
+func (node *schemaNode) ParquetSchema(messageType string, fieldIds map[string]int) (string, error) {
+
+	if node.dataType != "object" || !node.representable() {
+		return "", errors.New("no fields to write for message type " + messageType)
+	}
+
+	root := &parquetSchemaItem{Tag: "name=" + messageType + ", repetitiontype=REQUIRED"}
+	for _, fieldName := range node.sortedFieldNames() {
+		root.Fields = append(root.Fields, node.fields[fieldName].parquetItem(fieldName, fieldName, fieldIds))
+	}
+
+	schema, err := json.Marshal(root)
+	if err != nil {
+		return "", err
+	}
+
+	return string(schema), nil
+}
+
+//converts a value to the (possibly widened) type of the node
+//fields that are not part of the schema are dropped
+func (node *schemaNode) conform(value interface{}) interface{} {
+
+	if value == nil {
+		return nil
+	}
+
+	switch node.dataType {
+
+	case "object":
+		object, _ := value.(map[string]interface{})
+		conformed := make(map[string]interface{}, len(object))
+		for name, field := range node.fields {
+			if fieldValue, found := object[name]; found && fieldValue != nil && field.representable() {
+				conformed[name] = field.conform(fieldValue)
+			}
+		}
+		return conformed
+
+	case "list":
+		list, _ := value.([]interface{})
+		conformed := make([]interface{}, 0, len(list))
+		for _, element := range list {
+			if element != nil {
+				conformed = append(conformed, node.element.conform(element))
+			}
+		}
+		return conformed
+	}
+
+	//values that cannot be converted are rejected by the registry beforehand
+	converted, err := node.convert(value)
+	if err != nil {
+		return nil
+	}
+	return converted
+}
+
+func (node *schemaNode) convert(value interface{}) (interface{}, error) {
+	return convertValue(node.dataType, value)
+}
+
+//checks that all values of a payload can be converted to the types of the schema
+//only values of hinted fields can fail, inferred types always fit the values they were inferred from
+func (node *schemaNode) validate(value interface{}, path string) error {
+
+	if value == nil || node.dataType == "" {
+		return nil
+	}
+
+	switch node.dataType {
+
+	case "object":
+		object, _ := value.(map[string]interface{})
+		for name, field := range node.fields {
+			if err := field.validate(object[name], fieldPath(path, name)); err != nil {
+				return err
+			}
+		}
+
+	case "list":
+		list, _ := value.([]interface{})
+		for _, element := range list {
+			if err := node.element.validate(element, path+"[]"); err != nil {
+				return err
+			}
+		}
+
+	default:
+		if _, err := node.convert(value); err != nil {
+			return errors.New("`" + path + "` is not a valid " + node.dataType + ": " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+//conforms a payload to the schema and encodes it as a row for the parquet-go JSON writer
+func (node *schemaNode) ConformRow(payload map[string]interface{}) ([]byte, error) {
+	return json.Marshal(node.conform(payload))
+}
+
+//JSON representation of a schema node, used by the schema registry
+type schemaNodeJSON struct {
+	Type     string                 `json:"type"`
+	Optional bool                   `json:"optional,omitempty"`
+	Fields   map[string]*schemaNode `json:"fields,omitempty"`
+	Element  *schemaNode            `json:"element,omitempty"`
+}
+
+func (node *schemaNode) MarshalJSON() ([]byte, error) {
+	return json.Marshal(schemaNodeJSON{Type: node.dataType, Optional: node.optional, Fields: node.fields, Element: node.element})
+}
+
+func (node *schemaNode) UnmarshalJSON(data []byte) error {
+
+	var nodeJSON schemaNodeJSON
+	if err := json.Unmarshal(data, &nodeJSON); err != nil {
+		return err
+	}
+
+	node.dataType = nodeJSON.Type
+	if dataType := normalizeType(nodeJSON.Type); dataType != "" {
+		node.dataType = dataType
+	}
+	node.optional = nodeJSON.Optional
+	node.fields = nodeJSON.Fields
+	node.element = nodeJSON.Element
+	if node.dataType == "object" {
+		node.objects = 1
+	}
+
+	return nil
+}
+
+//deep copy of the node without the parts that cannot be represented in Parquet
+func (node *schemaNode) prune() *schemaNode {
+
+	pruned := &schemaNode{dataType: node.dataType, optional: node.optional, objects: node.objects}
+
+	switch node.dataType {
+	case "object":
+		pruned.fields = make(map[string]*schemaNode)
+		for name, field := range node.fields {
+			if field.representable() {
+				pruned.fields[name] = field.prune()
+			}
+		}
+	case "list":
+		if node.element != nil {
+			pruned.element = node.element.prune()
+		}
+	}
+
+	return pruned
+}
+
+//merges another schema into the node, fields only known to one of them become optional
+func (node *schemaNode) mergeNode(other *schemaNode) {
+
+	if other == nil {
+		return
+	}
+	if other.optional {
+		node.optional = true
+	}
+	if other.dataType == "" {
+		return
+	}
+
+	if node.dataType == "" {
+		optional := node.optional
+		*node = *other.prune()
+		node.optional = node.optional || optional
+		return
+	}
+
+	node.mergeType(other.dataType)
+
+	switch node.dataType {
+
+	case "object":
+		if node.fields == nil {
+			node.fields = make(map[string]*schemaNode)
+		}
+		for name, field := range other.fields {
+			if existing, found := node.fields[name]; found {
+				existing.mergeNode(field)
+			} else {
+				added := field.prune()
+				added.optional = true
+				node.fields[name] = added
+			}
+		}
+		for name, field := range node.fields {
+			if _, found := other.fields[name]; !found {
+				field.optional = true
+			}
+		}
+
+	case "list":
+		if node.element == nil {
+			node.element = new(schemaNode)
+		}
+		node.element.mergeNode(other.element)
+	}
+}
+
+//checks that data written with the writer schema can be read with the reader schema
+//fields unknown to the reader are ignored, fields the reader requires have to be present
+func canRead(reader *schemaNode, writer *schemaNode, path string) error {
+
+	if reader == nil || reader.dataType == "" || writer == nil || writer.dataType == "" {
+		return nil
+	}
+
+	//values of the writer type may still be readable as a promoted type, e.g. int64 as double
+	if reader.dataType != writer.dataType && promoteType(reader.dataType, writer.dataType) != reader.dataType {
+		return errors.New("type of `" + path + "` changed between " + reader.dataType + " and " + writer.dataType)
+	}
+	if writer.optional && !reader.optional {
+		return errors.New("`" + path + "` is required but may be null")
+	}
+
+	switch reader.dataType {
+
+	case "object":
+		for name, field := range reader.fields {
+			writerField := writer.fields[name]
+			if (writerField == nil || writerField.dataType == "") && !field.optional {
+				return errors.New("`" + fieldPath(path, name) + "` is required but missing or null")
+			}
+			if err := canRead(field, writerField, fieldPath(path, name)); err != nil {
+				return err
+			}
+		}
+
+	case "list":
+		return canRead(reader.element, writer.element, path+"[]")
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apache/flink-statefun/statefun-sdk-go/v3/pkg/statefun"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//files are named after the messages they hold, so that writing the same messages again replaces the file
+//instead of adding the rows a second time:
+//	<stream key>_<ingress topic>_<kafka partition>_<writer id>_<epoch>_<first sequence>-<last sequence>.parquet
+//the StateFun Kafka ingress does not pass Kafka partitions and offsets on to functions, messages are numbered per
+//stream key (the Kafka key, so within a single Kafka partition) in function state instead - Flink restores the
+//numbers together with the offsets of the ingress and the buffered rows, so a message that is delivered again gets
+//its number again and is buffered as if it was delivered the first time, and as buffers only end on a row count,
+//a byte count or a flush marker read from the ingress topic (see FlushBuffers), it ends up in the same file again
+//the epoch, the Kafka partition of the stream key and the writer id are kept in state when the numbering of a stream
+//key starts, a restart without state draws a new epoch and the same names are never used for other rows
+//files of rows without numbers (quarantine rows, compacted files) are named by time, writer id and a random suffix
+var (
+	MessageSequenceSpec = statefun.ValueSpec{
+		Name:      "message_sequence",
+		ValueType: statefun.Int64Type,
+	}
+	MessageSequenceEpochSpec = statefun.ValueSpec{
+		Name:      "message_sequence_epoch",
+		ValueType: statefun.Int64Type,
+	}
+	MessageSequencePartitionSpec = statefun.ValueSpec{
+		Name:      "message_sequence_partition",
+		ValueType: statefun.Int64Type,
+	}
+	MessageSequenceWriterSpec = statefun.ValueSpec{
+		Name:      "message_sequence_writer",
+		ValueType: statefun.StringType,
+	}
+)
+
+//partitions of the ingress topic, looked up once
+var (
+	ingressPartitions     []int
+	ingressPartitionsLock sync.Mutex
+)
+
+//position of a message within its stream key, the zero value for messages that are not numbered
+type messageSequence struct {
+	epoch     int64
+	number    int64
+	partition int64
+	writer    string
+}
+
+//random positive number
+func randomInt63() int64 {
+
+	var data [8]byte
+	rand.Read(data[:])
+
+	return int64(binary.BigEndian.Uint64(data[:]) >> 1)
+}
+
+//numbers the next message of the stream key of the function, starting with 1
+func nextMessageSequence(storage statefun.AddressScopedStorage, streamKey string) (messageSequence, error) {
+
+	var sequence messageSequence
+	if !storage.Get(MessageSequenceEpochSpec, &sequence.epoch) {
+		sequence.epoch = randomInt63()
+		storage.Set(MessageSequenceEpochSpec, sequence.epoch)
+	}
+	if !storage.Get(MessageSequencePartitionSpec, &sequence.partition) {
+		partition, err := ingressPartition(streamKey)
+		if err != nil {
+			return sequence, err
+		}
+		sequence.partition = int64(partition)
+		storage.Set(MessageSequencePartitionSpec, sequence.partition)
+	}
+	if !storage.Get(MessageSequenceWriterSpec, &sequence.writer) {
+		sequence.writer = writerId()
+		storage.Set(MessageSequenceWriterSpec, sequence.writer)
+	}
+	storage.Get(MessageSequenceSpec, &sequence.number)
+
+	sequence.number++
+	storage.Set(MessageSequenceSpec, sequence.number)
+
+	return sequence, nil
+}
+
+//Kafka partition of the ingress topic the messages of a stream key are on, picked the way the producers pick it
+func ingressPartition(streamKey string) (int, error) {
+
+	ingressPartitionsLock.Lock()
+	defer ingressPartitionsLock.Unlock()
+
+	if len(ingressPartitions) == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		client := &kafka.Client{Addr: producer.Addr}
+		metadata, err := client.Metadata(ctx, &kafka.MetadataRequest{Topics: []string{ingressTopic()}})
+		if err != nil {
+			return 0, err
+		}
+		partitions := make([]int, 0)
+		for _, topic := range metadata.Topics {
+			if topic.Error != nil {
+				return 0, topic.Error
+			}
+			for _, partition := range topic.Partitions {
+				partitions = append(partitions, partition.ID)
+			}
+		}
+		if len(partitions) == 0 {
+			return 0, errors.New("no partitions found for topic " + ingressTopic())
+		}
+		sort.Ints(partitions)
+		ingressPartitions = partitions
+	}
+
+	return (&kafka.Murmur2Balancer{}).Balance(kafka.Message{Key: []byte(streamKey)}, ingressPartitions...), nil
+}
+
+//topic the ingester's messages are consumed from, as configured in module.yaml
+func ingressTopic() string {
+	return GetEnv("INGRESS_TOPIC", "ingester-ingress")
+}
+
+//id of the ingester instance, WRITER_ID or the host name
+func writerId() string {
+
+	if id := GetEnv("WRITER_ID", ""); id != "" {
+		return id
+	}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		return hostname
+	}
+
+	return "ingester"
+}
+
+//name of a file holding the numbered messages first to last of a stream key
+func sequencedFileName(streamKey string, sequence messageSequence, first int64, last int64) string {
+	return fmt.Sprintf("%s_%s_%d_%s_%016x_%020d-%020d.parquet", escapePartitionValue(streamKey), escapePartitionValue(ingressTopic()),
+		sequence.partition, escapePartitionValue(sequence.writer), sequence.epoch, first, last)
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/snowflakedb/gosnowflake"
+)
+
+//Snowflake reads the files of a message type through a stage on the folder of its table, by snowflake_mode:
+//	external          an external table, refreshed by Snowflake itself through event notifications (default)
+//	external_refresh  an external table the ingester refreshes for the partition of every file it writes
+//	copy              a native table every file is loaded into with COPY INTO, the files that were loaded are
+//	                  kept in RTDL_LOADED_FILES of the stream's schema so that a file is never loaded twice
+//Delta external tables cannot be refreshed by Snowflake and are always refreshed after every file
+//stages reach S3 with the stream's AWS keys, or any store through snowflake_storage_integration - GCS and Azure
+//can only be reached through a storage integration
+//snowflake_private_key (a PEM encoded PKCS#8 or PKCS#1 RSA key, or the path of one) authenticates with a key pair
+//instead of snowflake_password
+const (
+	snowflakeModeExternal        = "external"
+	snowflakeModeExternalRefresh = "external_refresh"
+	snowflakeModeCopy            = "copy"
+)
+
+const snowflakeLoadedFilesTable = "RTDL_LOADED_FILES"
+
+//fingerprints of the schemas the native Snowflake tables were last evolved to
+var snowflakeSchemas = struct {
+	sync.Mutex
+	entries map[string]string
+}{entries: make(map[string]string)}
+
+func snowflakeMode(configRecord map[string]interface{}) string {
+	switch mode := configString(configRecord, "snowflake_mode"); mode {
+	case snowflakeModeExternalRefresh, snowflakeModeCopy:
+		return mode
+	}
+	return snowflakeModeExternal
+}
+
+//quotes an identifier, quoted identifiers keep their case
+func snowflakeIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+//quotes a string literal
+func snowflakeLiteral(value string) string {
+	return "'" + strings.Replace(strings.Replace(value, `\`, `\\`, -1), "'", `\'`, -1) + "'"
+}
+
+//RSA key of a PEM block or of the PEM file at path
+func parseSnowflakePrivateKey(key string) (*rsa.PrivateKey, error) {
+
+	data := []byte(key)
+	if !strings.Contains(key, "-----BEGIN") {
+		var err error
+		if data, err = ioutil.ReadFile(key); err != nil {
+			return nil, err
+		}
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("snowflake_private_key is not PEM encoded")
+	}
+
+	if privateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return privateKey, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.New("snowflake_private_key is not an unencrypted RSA key: " + err.Error())
+	}
+	privateKey, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("snowflake_private_key is not an RSA key")
+	}
+
+	return privateKey, nil
+}
+
+//opens a connection to the Snowflake database of a stream
+func openSnowflake(configRecord map[string]interface{}) (*sql.DB, error) {
+
+	// 20220606, Gavin: changed from environment variables to configuration attributes
+	config := gosnowflake.Config{
+		Account:   configString(configRecord, "snowflake_account"),
+		User:      configString(configRecord, "snowflake_username"),
+		Password:  configString(configRecord, "snowflake_password"),
+		Database:  configString(configRecord, "snowflake_database"),
+		Warehouse: configString(configRecord, "snowflake_warehouse"),
+		Role:      configString(configRecord, "snowflake_role"),
+	}
+
+	if key := configString(configRecord, "snowflake_private_key"); key != "" {
+		privateKey, err := parseSnowflakePrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		config.Authenticator = gosnowflake.AuthTypeJwt
+		config.PrivateKey = privateKey
+		config.Password = ""
+	}
+
+	if config.Account == "" || config.User == "" || config.Database == "" || (config.Password == "" && config.PrivateKey == nil) {
+		return nil, errors.New("Valid values required for all of Snowflake Account, User, Password (or Private Key) and Database")
+	}
+
+	dsn, err := gosnowflake.DSN(&config)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := sql.Open("snowflake", dsn)
+	if err != nil {
+		log.Println("Unable to open Snowflake connection", err)
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+//Snowflake schema of a stream and table (and stage) of a message type, quoted
+func snowflakeNames(messageType string, configRecord map[string]interface{}) (string, string) {
+
+	//cannot use stream_id as is for schema name like Dremio or Glue
+	//because of Snowflake naming convention-related restrictions
+	schemaName := "s_" + strings.Replace(configString(configRecord, "stream_id"), "-", "_", -1)
+
+	//stagename also needs to be cleansed similarly
+	stageName := strings.Replace(messageType, "-", "_", -1)
+
+	//upper case, as the unquoted names of existing schemas and tables were resolved
+	schemaName = snowflakeIdentifier(strings.ToUpper(schemaName))
+
+	return schemaName, schemaName + "." + snowflakeIdentifier(strings.ToUpper(stageName))
+}
+
+//URL and access of the stage on the folder of a table
+func snowflakeStage(store ObjectStore, messageType string, configRecord map[string]interface{}) (string, error) {
+
+	integration := configString(configRecord, "snowflake_storage_integration")
+	folder := strings.TrimSuffix(objectKey(configRecord, messageType, ""), "/") //do not remove hyphens, this is the location of the files
+
+	var stage string
+
+	switch typedStore := store.(type) {
+
+	case *s3Store:
+		stage = "URL = " + snowflakeLiteral("s3://"+typedStore.bucket+"/"+folder)
+		if typedStore.endpoint.url != "" {
+			//S3-compatible storage, the endpoint is set on the stage
+			stage = "URL = " + snowflakeLiteral("s3compat://"+typedStore.bucket+"/"+folder) + " ENDPOINT = " + snowflakeLiteral(typedStore.endpoint.host)
+		}
+		if integration == "" {
+			return stage + " CREDENTIALS = (AWS_KEY_ID = " + snowflakeLiteral(configString(configRecord, "aws_access_key_id")) +
+				" AWS_SECRET_KEY = " + snowflakeLiteral(configString(configRecord, "aws_secret_access_key")) + ")", nil
+		}
+
+	case *gcsStore:
+		stage = "URL = " + snowflakeLiteral("gcs://"+typedStore.bucket+"/"+folder)
+
+	case *azureStore:
+		stage = "URL = " + snowflakeLiteral("azure://"+typedStore.accountName+".blob.core.windows.net/"+strings.ToLower(typedStore.bucket)+"/"+folder)
+
+	default:
+		return "", errors.New("Snowflake cannot reach " + store.SourceType() + " file stores")
+	}
+
+	if integration == "" {
+		return "", errors.New("Snowflake reaches " + store.SourceType() + " file stores through a storage integration, snowflake_storage_integration is required")
+	}
+
+	return stage + " STORAGE_INTEGRATION = " + snowflakeIdentifier(integration), nil
+}
+
+//Snowflake type of a schema node, nested values are kept as VARIANT
+func snowflakeType(node *schemaNode) string {
+
+	switch node.dataType {
+	case "object", "list":
+		return "VARIANT"
+	case "boolean":
+		return "BOOLEAN"
+	case "int64":
+		return "NUMBER(38,0)"
+	case "double":
+		return "FLOAT"
+	case "timestamp_millis", "timestamp_micros":
+		return "TIMESTAMP_NTZ"
+	}
+
+	if precision, scale, ok := decimalPrecisionScale(node.dataType); ok {
+		return fmt.Sprintf("NUMBER(%d,%d)", precision, scale)
+	}
+
+	return "VARCHAR"
+}
+
+//expression reading the value of a Hive-style partition column from the path of a staged file
+func snowflakePartitionValue(column string) string {
+	return "nullif(split_part(regexp_substr(metadata$filename, " + snowflakeLiteral("(^|/)"+column+"=[^/]+") + "), '=', 2), " + snowflakeLiteral(defaultPartitionValue) + ")"
+}
+
+//columns of the native table of a message type: the fields of the schema and the partition columns
+func snowflakeColumns(schema *schemaNode, configRecord map[string]interface{}) ([]string, []string) {
+
+	names := make([]string, 0)
+	types := make([]string, 0)
+	seen := make(map[string]bool)
+
+	for _, column := range partitionColumns(configRecord) {
+		seen[column] = true
+	}
+
+	if schema != nil {
+		for _, name := range schema.sortedFieldNames() {
+			if !seen[name] {
+				names = append(names, name)
+				types = append(types, snowflakeType(schema.fields[name]))
+			}
+		}
+	}
+
+	for _, column := range partitionColumns(configRecord) {
+		names = append(names, column)
+		types = append(types, "VARCHAR")
+	}
+
+	return names, types
+}
+
+//Function to update Snowflake
+//creates the schema of the stream, the stage of the message type and its external or native table
+func UpdateSnowflake(store ObjectStore, file tableFile) error {
+
+	configRecord := file.configRecord
+	mode := snowflakeMode(configRecord)
+
+	conn, err := openSnowflake(configRecord)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	schemaName, tableName := snowflakeNames(file.messageType, configRecord)
+
+	if _, err = conn.ExecContext(ctx, "create schema if not exists "+schemaName); err != nil {
+		log.Println("Error creating Snowflake schema", err)
+		return err
+	}
+
+	stage, err := snowflakeStage(store, file.messageType, configRecord)
+	if err != nil {
+		return err
+	}
+	if _, err = conn.ExecContext(ctx, "create stage if not exists "+tableName+" "+stage+" file_format = (type = PARQUET)"); err != nil {
+		log.Println("Error creating Snowflake stage", err)
+		return err
+	}
+
+	if mode == snowflakeModeCopy {
+
+		names, types := snowflakeColumns(file.schema, configRecord)
+		definitions := make([]string, len(names))
+		for index, name := range names {
+			definitions[index] = snowflakeIdentifier(name) + " " + types[index]
+		}
+
+		if _, err = conn.ExecContext(ctx, "create table if not exists "+tableName+" ("+strings.Join(definitions, ", ")+")"); err != nil {
+			log.Println("Error creating Snowflake table", err)
+			return err
+		}
+
+		loadedFiles := schemaName + "." + snowflakeIdentifier(snowflakeLoadedFilesTable)
+		if _, err = conn.ExecContext(ctx, "create table if not exists "+loadedFiles+" (TABLE_NAME varchar, FILE_NAME varchar, ROWS_LOADED number, LOADED_AT timestamp_ltz)"); err != nil {
+			log.Println("Error creating Snowflake loaded files table", err)
+			return err
+		}
+
+		log.Println("Snowflake table created if not already existing")
+		return nil
+	}
+
+	tableCreationQuery := "create external table if not exists " + tableName //table=stage
+
+	//Hive-style partition directories become partition columns, taken from the file path
+	columns := partitionColumns(configRecord)
+	if len(columns) > 0 {
+		definitions := make([]string, len(columns))
+		quoted := make([]string, len(columns))
+		for index, column := range columns {
+			quoted[index] = snowflakeIdentifier(strings.ToUpper(column)) //as unquoted before
+			definitions[index] = quoted[index] + " varchar as (" + snowflakePartitionValue(column) + ")"
+		}
+		tableCreationQuery += " (" + strings.Join(definitions, ", ") + ") partition by (" + strings.Join(quoted, ", ") + ")"
+	}
+
+	tableCreationQuery += " location = @" + tableName
+
+	//Delta external tables cannot be refreshed automatically, they are refreshed from the log after every file
+	delta := streamTableFormat(configRecord) == "table_format_delta"
+	if delta || mode == snowflakeModeExternalRefresh {
+		tableCreationQuery += " refresh_on_create = false auto_refresh = false"
+	}
+	tableCreationQuery += " file_format = (type = PARQUET)"
+	if delta {
+		tableCreationQuery += " table_format = delta"
+	}
+	//the data files of Iceberg tables are read as Parquet, without the metadata folder
+	if streamTableFormat(configRecord) == "table_format_iceberg" {
+		tableCreationQuery += " pattern = '.*[.]parquet'"
+	}
+
+	if _, err = conn.ExecContext(ctx, tableCreationQuery); err != nil {
+		log.Println("Error creating Snowflake external table", err)
+		return err
+	}
+
+	log.Println("Snowflake external table created if not already existing")
+	return nil
+}
+
+//makes a written file visible in Snowflake: refreshes the external table for the partition of the file, or
+//loads the file into the native table - with copy, new columns of the schema are added to the table first
+func RefreshSnowflake(store ObjectStore, file tableFile) error {
+
+	mode := snowflakeMode(file.configRecord)
+	delta := streamTableFormat(file.configRecord) == "table_format_delta"
+	if mode == snowflakeModeExternal && !delta {
+		return nil
+	}
+
+	conn, err := openSnowflake(file.configRecord)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	ctx := context.Background()
+	_, tableName := snowflakeNames(file.messageType, file.configRecord)
+
+	//path of the file below the stage
+	path := strings.TrimPrefix(file.key, file.tableKey()+"/")
+
+	if mode != snowflakeModeCopy {
+		refreshQuery := "alter external table " + tableName + " refresh"
+		if !delta {
+			refreshQuery += " " + snowflakeLiteral(path[:strings.LastIndex(path, "/")+1])
+		}
+		if _, err = conn.ExecContext(ctx, refreshQuery); err != nil {
+			log.Println("Error refreshing Snowflake external table", err)
+			return err
+		}
+		return nil
+	}
+
+	if err = evolveSnowflakeTable(ctx, conn, file); err != nil {
+		return err
+	}
+
+	return copySnowflakeFile(ctx, conn, file, path)
+}
+
+//adds the columns of the file's schema the native table does not have yet
+func evolveSnowflakeTable(ctx context.Context, conn *sql.DB, file tableFile) error {
+
+	fingerprint := ""
+	if file.schema != nil {
+		var err error
+		if fingerprint, err = schemaFingerprint(file.schema); err != nil {
+			return err
+		}
+	}
+
+	key := configString(file.configRecord, "stream_id") + "|" + file.tableKey()
+
+	snowflakeSchemas.Lock()
+	changed := snowflakeSchemas.entries[key] != fingerprint
+	snowflakeSchemas.Unlock()
+
+	if !changed {
+		return nil
+	}
+
+	_, tableName := snowflakeNames(file.messageType, file.configRecord)
+	names, types := snowflakeColumns(file.schema, file.configRecord)
+	for index, name := range names {
+		if _, err := conn.ExecContext(ctx, "alter table "+tableName+" add column if not exists "+snowflakeIdentifier(name)+" "+types[index]); err != nil {
+			log.Println("Error adding column to Snowflake table", err)
+			return err
+		}
+	}
+
+	snowflakeSchemas.Lock()
+	snowflakeSchemas.entries[key] = fingerprint
+	snowflakeSchemas.Unlock()
+
+	return nil
+}
+
+//loads a file into the native table unless RTDL_LOADED_FILES says it was loaded before
+//the file is loaded and recorded in a single transaction
+func copySnowflakeFile(ctx context.Context, conn *sql.DB, file tableFile, path string) error {
+
+	schemaName, tableName := snowflakeNames(file.messageType, file.configRecord)
+	loadedFiles := schemaName + "." + snowflakeIdentifier(snowflakeLoadedFilesTable)
+
+	var loaded int
+	err := conn.QueryRowContext(ctx, "select count(*) from "+loadedFiles+" where TABLE_NAME = ? and FILE_NAME = ?", tableName, path).Scan(&loaded)
+	if err != nil {
+		return err
+	}
+	if loaded > 0 {
+		return nil
+	}
+
+	//columns of the file only, columns the file does not have are left null
+	names, _ := snowflakeColumns(file.schema, file.configRecord)
+	columns := make([]string, len(names))
+	values := make([]string, len(names))
+	partitions := make(map[string]bool)
+	for _, column := range partitionColumns(file.configRecord) {
+		partitions[column] = true
+	}
+	for index, name := range names {
+		columns[index] = snowflakeIdentifier(name)
+		if partitions[name] {
+			values[index] = snowflakePartitionValue(name)
+		} else {
+			values[index] = "$1:" + snowflakeIdentifier(name) + "::" + snowflakeType(file.schema.fields[name])
+		}
+	}
+
+	//FORCE as a file written again under the same name replaces its earlier version, which was not loaded
+	copyQuery := "copy into " + tableName + " (" + strings.Join(columns, ", ") + ")" +
+		" from (select " + strings.Join(values, ", ") + " from @" + tableName + ")" +
+		" files = (" + snowflakeLiteral(path) + ") file_format = (type = PARQUET use_logical_type = true) force = true"
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, copyQuery)
+	if err != nil {
+		log.Println("Error copying file into Snowflake table", err)
+		return err
+	}
+	rows, _ := result.RowsAffected()
+
+	_, err = tx.ExecContext(ctx, "insert into "+loadedFiles+" (TABLE_NAME, FILE_NAME, ROWS_LOADED, LOADED_AT) values (?, ?, ?, current_timestamp())", tableName, path, rows)
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	addToCounter("snowflake_rows_loaded", configString(file.configRecord, "stream_id"), rows)
+	return nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//rows of a buffer are not kept in function state but appended as JSON lines to a spill file below BUFFER_SPILL_DIR
+//(spill), the state of the buffer only records the file and how many of its bytes belong to the buffer - the
+//directory has to survive restarts and be shared by all ingester instances, StateFun may invoke a stream key on
+//any of them
+//an append first cuts the file back to the length in state, rows appended by an invocation that failed, or after
+//the checkpoint Flink restored, are dropped before they are appended again
+//full buffers are written by a background job, not by the invocation: the job claims the buffer with a claim file
+//next to the spill, writes the rows and leaves the rows that could neither be written nor dead-lettered in a result
+//file, which the delayed flush message of the stream key (rtdl_207) picks up
+//spill, claim and result files are deleted once they are BUFFER_SPILL_RETENTION_HOURS (24) old, so that a
+//checkpoint Flink restores still finds the rows of its buffers
+func bufferSpillDir() string {
+	return GetEnv("BUFFER_SPILL_DIR", "spill")
+}
+
+//claims of the jobs running in this instance, released on shutdown so that another instance can take over
+var bufferWrites = struct {
+	sync.Mutex
+	claims map[string]bool
+}{claims: make(map[string]bool)}
+
+//spill file of a new buffer, relative to the spill directory
+//numbered buffers always get the same file, so that their rows are appended to it again when they are replayed
+func spillName(streamKey string, bufferKey string, sequence messageSequence) string {
+
+	if sequence.number == 0 {
+		return url.PathEscape(streamKey) + "/" + fmt.Sprintf("%016x.jsonl", randomInt63())
+	}
+
+	hash := fnv.New64a()
+	hash.Write([]byte(bufferKey))
+
+	return url.PathEscape(streamKey) + "/" + fmt.Sprintf("%d_%d_%016x.jsonl", sequence.epoch, sequence.number, hash.Sum64())
+}
+
+func (buffer *rowBuffer) spillPath() string {
+	return filepath.Join(bufferSpillDir(), filepath.FromSlash(buffer.Spill))
+}
+
+//claim and result files are named by the length of the spill they were made for
+func (buffer *rowBuffer) jobPath(suffix string) string {
+	return buffer.spillPath() + "." + strconv.FormatInt(buffer.SpillBytes, 10) + suffix
+}
+
+//appends rows to the spill of a buffer and moves its length in state on, the rows are on disk once it returns
+func appendSpill(buffer *rowBuffer, requests ...IncomingMessage) error {
+
+	var lines bytes.Buffer
+	for _, request := range requests {
+		line, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		lines.Write(line)
+		lines.WriteByte('\n')
+	}
+
+	path := buffer.spillPath()
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := buffer.SpillBytes
+	if info.Size() < offset {
+		log.Println("Spill " + buffer.Spill + " is shorter than its buffer, rows of the buffer are lost")
+		incrementCounter("buffer_spills_truncated", fmt.Sprint(buffer.ConfigRecord["stream_id"]))
+		offset = info.Size()
+	}
+
+	if err = file.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err = file.WriteAt(lines.Bytes(), offset); err != nil {
+		return err
+	}
+	if err = file.Sync(); err != nil {
+		return err
+	}
+
+	buffer.SpillBytes = offset + int64(lines.Len())
+	return nil
+}
+
+//reads the rows of a buffer from its spill
+func readSpill(buffer *rowBuffer) ([]IncomingMessage, error) {
+
+	file, err := os.Open(buffer.spillPath())
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	requests := make([]IncomingMessage, 0, buffer.Rows)
+	reader := bufio.NewReader(io.NewSectionReader(file, 0, buffer.SpillBytes))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var request IncomingMessage
+		if err = json.Unmarshal(line, &request); err != nil {
+			return nil, err
+		}
+		requests = append(requests, request)
+	}
+
+	if len(requests) < buffer.Rows {
+		log.Println("Spill " + buffer.Spill + " holds " + strconv.Itoa(len(requests)) + " of the " + strconv.Itoa(buffer.Rows) + " rows of its buffer")
+	}
+
+	return requests, nil
+}
+
+//follows up on the write of a sealed buffer, done once its result is there, along with the rows that are left
+//the job is started if no instance is writing the buffer, e.g. because the one that did went down
+func collectBuffer(buffer *rowBuffer) ([]IncomingMessage, bool, error) {
+
+	content, err := ioutil.ReadFile(buffer.jobPath(".result"))
+	if os.IsNotExist(err) {
+		startBufferWrite(buffer)
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	pending := make([]IncomingMessage, 0)
+	for _, line := range bytes.Split(content, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var request IncomingMessage
+		if err = json.Unmarshal(line, &request); err != nil {
+			return nil, false, err
+		}
+		pending = append(pending, request)
+	}
+
+	return pending, true, nil
+}
+
+//claims a sealed buffer and writes it in the background, unless it is claimed already
+//a claim older than BUFFER_WRITE_TIMEOUT_SECONDS (900) is taken to be left behind by an instance that went down
+func startBufferWrite(buffer *rowBuffer) {
+
+	claim := buffer.jobPath(".claim")
+	file, err := os.OpenFile(claim, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if os.IsExist(err) {
+		info, statErr := os.Stat(claim)
+		if statErr != nil || time.Since(info.ModTime()) < time.Duration(GetEnvInt("BUFFER_WRITE_TIMEOUT_SECONDS", 900))*time.Second {
+			return
+		}
+		log.Println("Taking over the write of " + buffer.Spill + ", its claim is stale")
+		os.Remove(claim)
+		file, err = os.OpenFile(claim, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	}
+	if err != nil {
+		log.Println("Unable to claim "+buffer.Spill, err)
+		return
+	}
+	file.WriteString(writerId())
+	file.Close()
+
+	bufferWrites.Lock()
+	bufferWrites.claims[claim] = true
+	bufferWrites.Unlock()
+
+	job := *buffer
+	go func() {
+		defer func() {
+			bufferWrites.Lock()
+			delete(bufferWrites.claims, claim)
+			bufferWrites.Unlock()
+			os.Remove(claim)
+		}()
+
+		requests, err := readSpill(&job)
+		if os.IsNotExist(err) {
+			//nothing left to write, the buffer is dropped with the result
+			log.Println("Spill " + job.Spill + " is gone, " + strconv.Itoa(job.Rows) + " rows of its buffer are lost")
+			incrementCounter("buffer_spills_truncated", fmt.Sprint(job.ConfigRecord["stream_id"]))
+		} else if err != nil {
+			log.Println("Unable to read spill "+job.Spill, err)
+			return
+		}
+
+		var result bytes.Buffer
+		if len(requests) > 0 {
+			for _, request := range flushBuffer(&job, requests) {
+				line, _ := json.Marshal(request)
+				result.Write(line)
+				result.WriteByte('\n')
+			}
+		}
+
+		//the result appears as a whole or not at all
+		tempPath := job.jobPath(".result.tmp")
+		if err = ioutil.WriteFile(tempPath, result.Bytes(), 0644); err == nil {
+			err = os.Rename(tempPath, job.jobPath(".result"))
+		}
+		if err != nil {
+			log.Println("Unable to save the result of "+job.Spill, err)
+		}
+	}()
+}
+
+//releases the claims of the jobs still running, called on shutdown
+func releaseBufferClaims() {
+
+	bufferWrites.Lock()
+	defer bufferWrites.Unlock()
+
+	for claim := range bufferWrites.claims {
+		os.Remove(claim)
+	}
+}
+
+//deletes spill, claim and result files past BUFFER_SPILL_RETENTION_HOURS every hour
+func sweepSpillOnInterval() {
+
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for range ticker.C {
+
+		retention := time.Duration(GetEnvInt("BUFFER_SPILL_RETENTION_HOURS", 24)) * time.Hour
+		folders := make([]string, 0)
+		err := filepath.Walk(bufferSpillDir(), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				folders = append(folders, path)
+			} else if time.Since(info.ModTime()) > retention {
+				os.Remove(path)
+			}
+			return nil
+		})
+		if err != nil {
+			log.Println("Error deleting old spill files", err)
+		}
+
+		//folders of stream keys without buffers, removing folders that are not empty fails
+		for index := len(folders) - 1; index > 0; index-- {
+			os.Remove(folders[index])
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	kafka "github.com/segmentio/kafka-go"
+	"rtdl/spool"
+)
+
+//disk-backed spool of the dead letters Kafka couldn't take, replayed in order once the broker is back (see the spool
+//module) - rows whose file could not be written end up here rather than being discarded when both the store and
+//Kafka are down
+var deadLetterSpool *spool.Spool
+
+//opens (or creates) the spool in dir and recovers whatever was left from a previous run
+func OpenSpool(dir string, maxBytes int64) (*spool.Spool, error) {
+	return spool.Open(spool.Config{
+		Dir:           dir,
+		MaxBytes:      maxBytes,
+		SegmentBytes:  int64(GetEnvInt("SPOOL_SEGMENT_BYTES", 67108864)),
+		RetryInterval: time.Duration(GetEnvInt("SPOOL_RETRY_MS", 1000)) * time.Millisecond,
+		ReplayBatch:   GetEnvInt("SPOOL_REPLAY_BATCH", 500),
+		Name:          "dead letters",
+		Write:         writeSpoolMessages,
+	})
+}
+
+//writes messages to Kafka, only those that didn't make it are spooled
+func writeSpoolMessages(messages []spool.Message) ([]spool.Message, error) {
+
+	kafkaMessages := make([]kafka.Message, len(messages))
+	for index, message := range messages {
+		kafkaMessages[index] = kafka.Message{Topic: message.Topic, Key: message.Key, Value: message.Value}
+	}
+
+	err := WriteKafkaMessage(kafkaMessages...)
+	if writeErrors, partial := err.(kafka.WriteErrors); partial {
+		failed := make([]spool.Message, 0, len(messages))
+		for index, messageErr := range writeErrors {
+			if messageErr != nil {
+				failed = append(failed, messages[index])
+			}
+		}
+		return failed, err
+	}
+	if err != nil {
+		return messages, err
+	}
+
+	return nil, nil
+}
+
+//hands dead letters to Kafka, or to the spool while Kafka is unavailable or older dead letters are still spooled
+//an error is only returned if the messages could neither be written nor spooled
+func DeliverMessages(messages ...kafka.Message) error {
+
+	if deadLetterSpool == nil {
+		return WriteKafkaMessage(messages...)
+	}
+
+	spoolMessages := make([]spool.Message, len(messages))
+	for index, message := range messages {
+		spoolMessages[index] = spool.Message{Topic: message.Topic, Key: message.Key, Value: message.Value}
+	}
+
+	err := deadLetterSpool.Deliver(spoolMessages...)
+	if err != nil {
+		log.Println("Unable to spool messages", err)
+		incrementCounter("dead_letters_spool_rejected", "")
+	}
+
+	return err
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+//table format of a stream, selected by its table_format_id
+//streams without one (or table_format_parquet) write plain Parquet files that the catalogs read as a folder,
+//other formats additionally commit every written file to the metadata of the table
+//adding a format means implementing the commit and registering it under a new table_formats.json literal
+var tableFormats = map[string]tableFormat{
+	"table_format_delta":   {commit: commitDeltaFile, files: deltaTableFiles, replace: replaceDeltaFiles},
+	"table_format_iceberg": {fieldIds: icebergFieldIds, commit: commitIcebergFile},
+}
+
+type tableFormat struct {
+	//field ids the columns of a new file are written with, for formats that map columns by id
+	fieldIds func(store ObjectStore, file tableFile) (map[string]int, error)
+	commit   func(store ObjectStore, file tableFile) error
+	//keys of the data files that are part of the table of the file, files that failed to commit are not
+	files func(store ObjectStore, file tableFile) (map[string]bool, error)
+	//commits a file merging the originals in their place, tables of formats without it are not compacted
+	replace func(store ObjectStore, merged tableFile, originals []tableFile) error
+}
+
+//a data file written to a table, the table of a message type is its folder below folder_name
+type tableFile struct {
+	messageType   string
+	subFolderName string //message type and partition directories
+	key           string //key of the file in the store
+	size          int64
+	rows          int
+	schema        *schemaNode
+	fieldIds      map[string]int //field ids of the columns by path, nil if the format has none
+	configRecord  map[string]interface{}
+}
+
+//table_formats.json literal of a stream, blank for plain Parquet
+func streamTableFormat(configRecord map[string]interface{}) string {
+
+	for literal := range tableFormats {
+		if configRecord["table_format_id"] == GetTableFormatId(literal) {
+			return literal
+		}
+	}
+
+	return ""
+}
+
+//field ids to write a file to the table of its message type with, nil if the format does not use them
+func tableFieldIds(store ObjectStore, file tableFile) (map[string]int, error) {
+
+	if fieldIds := tableFormats[streamTableFormat(file.configRecord)].fieldIds; fieldIds != nil {
+		return fieldIds(store, file)
+	}
+
+	return nil, nil
+}
+
+//commits a written file to the table of its message type, nothing to do for plain Parquet
+func commitTableFile(store ObjectStore, file tableFile) error {
+
+	if commit := tableFormats[streamTableFormat(file.configRecord)].commit; commit != nil {
+		return commit(store, file)
+	}
+
+	return nil
+}
+
+//true if compaction can merge the files of the stream's tables
+func tableFormatCompactable(configRecord map[string]interface{}) bool {
+	format := tableFormats[streamTableFormat(configRecord)]
+	return format.commit == nil || format.replace != nil
+}
+
+//keys of the data files that are part of the table of the file, nil for plain Parquet where every file is
+func tableFiles(store ObjectStore, file tableFile) (map[string]bool, error) {
+
+	if files := tableFormats[streamTableFormat(file.configRecord)].files; files != nil {
+		return files(store, file)
+	}
+
+	return nil, nil
+}
+
+//commits a file merging the originals in their place, nothing to do for plain Parquet
+func replaceTableFiles(store ObjectStore, merged tableFile, originals []tableFile) error {
+
+	if replace := tableFormats[streamTableFormat(merged.configRecord)].replace; replace != nil {
+		return replace(store, merged, originals)
+	}
+
+	return nil
+}
+
+//key of the folder of the table
+func (file tableFile) tableKey() string {
+	return strings.TrimSuffix(objectKey(file.configRecord, file.messageType, ""), "/")
+}
+
+//path of the file relative to the table folder, URL-encoded as table formats expect
+func (file tableFile) relativePath() string {
+	return (&url.URL{Path: strings.TrimPrefix(file.key, file.tableKey()+"/")}).EscapedPath()
+}
+
+//values of the partition directories of the file in the order of the partition spec, nil for the default partition
+func (file tableFile) partitionDirectoryValues() []*string {
+
+	directories := strings.Split(file.subFolderName, "/")[1:]
+	hiveStyle := partitionColumns(file.configRecord) != nil
+
+	values := make([]*string, len(directories))
+	for index, directory := range directories {
+		value := directory
+		if hiveStyle {
+			value = directory[strings.Index(directory, "=")+1:]
+		}
+		if value == defaultPartitionValue {
+			continue
+		}
+		if unescaped, err := url.PathUnescape(value); err == nil {
+			value = unescaped
+		}
+		values[index] = &value
+	}
+
+	return values
+}
+
+//values of the partition columns of the file, nil for the default partition
+//only Hive-style directories can be read back as columns
+func (file tableFile) partitionValues() map[string]*string {
+
+	values := make(map[string]*string)
+
+	directoryValues := file.partitionDirectoryValues()
+	for index, column := range partitionColumns(file.configRecord) {
+		if index < len(directoryValues) {
+			values[column] = directoryValues[index]
+		}
+	}
+
+	return values
+}
+
+//random (version 4) UUID identifying a new table
+func newTableId() string {
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", id[0:4], id[4:6], id[6:8], id[8:10], id[10:16])
+}
@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"math/big"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//data types of schema nodes and how they are written to Parquet
+//	boolean, int64, double   - JSON booleans and numbers, numbers without fraction are int64
+//	string                   - UTF8 annotated byte array
+//	timestamp_millis/_micros - INT64 timestamps, inferred for RFC3339 strings (_micros if the fraction has more than
+//	                           3 digits), epoch numbers need a type hint
+//	decimal(p,s)             - exact decimals, only through type hints, e.g. for money fields
+//type hints (`type_hints` of a stream) map field paths to one of these types and take precedence over inference
+//paths are dotted for nested objects and use [] for list elements, e.g. `order.items[].price`
+
+var decimalPattern = regexp.MustCompile(`^decimal\(\s*(\d+)\s*,\s*(\d+)\s*\)$`)
+
+//largest integer a JSON number (float64) holds exactly
+const maxExactInteger = 1 << 53
+
+//lossless promotions between types, any other conflict widens to string
+var typePromotions = map[string]string{
+	"int64|double":                      "double",
+	"timestamp_millis|timestamp_micros": "timestamp_micros",
+}
+
+//promoted type of two types, blank if there is no lossless promotion
+func promoteType(dataType string, otherDataType string) string {
+	if promoted, found := typePromotions[dataType+"|"+otherDataType]; found {
+		return promoted
+	}
+	return typePromotions[otherDataType+"|"+dataType]
+}
+
+//normalizes a type hint (or a type name) to the name used by schema nodes, blank if it is not a valid type
+func normalizeType(dataType string) string {
+
+	dataType = strings.ToLower(strings.TrimSpace(dataType))
+
+	switch dataType {
+	case "boolean", "bool":
+		return "boolean"
+	case "int64", "int", "integer", "long":
+		return "int64"
+	case "double", "float64", "float", "number":
+		return "double"
+	case "string", "utf8":
+		return "string"
+	case "timestamp", "timestamp_millis":
+		return "timestamp_millis"
+	case "timestamp_micros":
+		return "timestamp_micros"
+	}
+
+	if precision, scale, ok := decimalPrecisionScale(dataType); ok {
+		return "decimal(" + strconv.Itoa(precision) + "," + strconv.Itoa(scale) + ")"
+	}
+
+	return ""
+}
+
+//precision and scale of a decimal type, up to 18 digits which are converted exactly
+func decimalPrecisionScale(dataType string) (int, int, bool) {
+
+	match := decimalPattern.FindStringSubmatch(dataType)
+	if match == nil {
+		return 0, 0, false
+	}
+
+	precision, _ := strconv.Atoi(match[1])
+	scale, _ := strconv.Atoi(match[2])
+	if precision < 1 || precision > 18 || scale > precision {
+		return 0, 0, false
+	}
+
+	return precision, scale, true
+}
+
+//type hints of a stream, invalid hints are logged and ignored
+func streamTypeHints(configRecord map[string]interface{}) map[string]string {
+
+	typeHints := make(map[string]string)
+	entries, _ := configRecord["type_hints"].(map[string]interface{})
+	for path, entry := range entries {
+		hint, _ := entry.(string)
+		dataType := normalizeType(hint)
+		if dataType == "" {
+			log.Println("Ignoring invalid type hint `" + hint + "` for `" + path + "`")
+			continue
+		}
+		typeHints[path] = dataType
+	}
+
+	return typeHints
+}
+
+//strings that are RFC3339 timestamps
+func isTimestamp(value string) bool {
+
+	if len(value) < 20 || value[4] != '-' || (value[10] != 'T' && value[10] != 't') {
+		return false
+	}
+
+	_, err := time.Parse(time.RFC3339Nano, value)
+	return err == nil
+}
+
+//timestamp type of an RFC3339 string, fractions finer than milliseconds need microseconds to be kept
+//nanoseconds are not kept by either type and are truncated to microseconds
+func timestampType(value string) string {
+
+	if fraction := strings.IndexByte(value, '.'); fraction >= 0 {
+		digits := 0
+		for _, char := range value[fraction+1:] {
+			if char < '0' || char > '9' {
+				break
+			}
+			digits++
+		}
+		if digits > 3 {
+			return "timestamp_micros"
+		}
+	}
+
+	return "timestamp_millis"
+}
+
+//type inferred for a scalar JSON value
+func inferType(value interface{}) string {
+
+	switch typedValue := value.(type) {
+	case bool:
+		return "boolean"
+	case float64:
+		if typedValue == math.Trunc(typedValue) && math.Abs(typedValue) < maxExactInteger {
+			return "int64"
+		}
+		return "double"
+	case string:
+		if isTimestamp(typedValue) {
+			return timestampType(typedValue)
+		}
+		return "string"
+	}
+
+	return ""
+}
+
+//parquet-go tag of a scalar type, blank if it cannot be written
+func parquetTypeTag(dataType string) string {
+
+	switch dataType {
+	case "boolean":
+		return "type=BOOLEAN"
+	case "int64":
+		return "type=INT64"
+	case "double":
+		return "type=DOUBLE"
+	case "string":
+		return "type=BYTE_ARRAY, convertedtype=UTF8"
+	case "timestamp_millis":
+		return "type=INT64, convertedtype=TIMESTAMP_MILLIS"
+	case "timestamp_micros":
+		return "type=INT64, convertedtype=TIMESTAMP_MICROS"
+	}
+
+	if precision, scale, ok := decimalPrecisionScale(dataType); ok {
+		//smallest number of bytes holding the unscaled value as two's complement
+		length := 1
+		for math.Pow(2, float64(8*length-1)) < math.Pow(10, float64(precision)) {
+			length++
+		}
+		return fmt.Sprintf("type=FIXED_LEN_BYTE_ARRAY, convertedtype=DECIMAL, precision=%d, scale=%d, length=%d", precision, scale, length)
+	}
+
+	return ""
+}
+
+//converts epoch seconds, milliseconds, microseconds or nanoseconds to a timestamp
+//the unit is told apart by magnitude, which holds for dates between 1973 and 5138
+func epochToTime(epoch float64) time.Time {
+
+	magnitude := math.Abs(epoch)
+	switch {
+	case magnitude < 1e11:
+		return time.Unix(0, int64(epoch*1e9))
+	case magnitude < 1e14:
+		return time.Unix(0, int64(epoch*1e6))
+	case magnitude < 1e17:
+		return time.Unix(0, int64(epoch*1e3))
+	}
+	return time.Unix(0, int64(epoch))
+}
+
+//converts a timestamp, RFC3339 or epoch, to the number of units since the epoch
+func toTimestamp(value interface{}, unit time.Duration) (int64, error) {
+
+	switch typedValue := value.(type) {
+	case string:
+		timestamp, err := time.Parse(time.RFC3339Nano, typedValue)
+		if err == nil {
+			return timestamp.UnixNano() / int64(unit), nil
+		}
+		epoch, err := strconv.ParseFloat(typedValue, 64)
+		if err != nil {
+			return 0, errors.New("`" + typedValue + "` is not an RFC3339 timestamp")
+		}
+		return epochToTime(epoch).UnixNano() / int64(unit), nil
+	case float64:
+		return epochToTime(typedValue).UnixNano() / int64(unit), nil
+	}
+
+	return 0, fmt.Errorf("%v is not a timestamp", value)
+}
+
+//converts a number to a decimal string with exactly scale digits, rounded half away from zero
+func toDecimal(value interface{}, precision int, scale int) (string, error) {
+
+	number := new(big.Rat)
+	switch typedValue := value.(type) {
+	case string:
+		if _, ok := number.SetString(strings.TrimSpace(typedValue)); !ok {
+			return "", errors.New("`" + typedValue + "` is not a decimal")
+		}
+	case float64:
+		number.SetString(strconv.FormatFloat(typedValue, 'f', -1, 64))
+	default:
+		return "", fmt.Errorf("%v is not a decimal", value)
+	}
+
+	decimal := number.FloatString(scale)
+	if digits := len(strings.TrimLeft(strings.NewReplacer("-", "", ".", "").Replace(decimal), "0")); digits > precision {
+		return "", errors.New(decimal + " exceeds the precision of " + strconv.Itoa(precision) + " digits")
+	}
+
+	return decimal, nil
+}
+
+//converts a scalar value to the representation the parquet-go JSON writer expects for the type
+func convertValue(dataType string, value interface{}) (interface{}, error) {
+
+	switch dataType {
+
+	case "boolean":
+		switch typedValue := value.(type) {
+		case bool:
+			return typedValue, nil
+		case string:
+			return strconv.ParseBool(typedValue)
+		}
+
+	case "int64":
+		switch typedValue := value.(type) {
+		case float64:
+			if typedValue != math.Trunc(typedValue) || math.Abs(typedValue) >= maxExactInteger {
+				return nil, fmt.Errorf("%v is not an integer", typedValue)
+			}
+			return int64(typedValue), nil
+		case string:
+			return strconv.ParseInt(strings.TrimSpace(typedValue), 10, 64)
+		}
+
+	case "double":
+		switch typedValue := value.(type) {
+		case float64:
+			return typedValue, nil
+		case string:
+			return strconv.ParseFloat(strings.TrimSpace(typedValue), 64)
+		}
+
+	case "string":
+		if stringValue, ok := value.(string); ok {
+			return stringValue, nil
+		}
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+
+	case "timestamp_millis":
+		return toTimestamp(value, time.Millisecond)
+
+	case "timestamp_micros":
+		return toTimestamp(value, time.Microsecond)
+
+	default:
+		if precision, scale, ok := decimalPrecisionScale(dataType); ok {
+			return toDecimal(value, precision, scale)
+		}
+	}
+
+	return nil, fmt.Errorf("%v cannot be converted to %s", value, dataType)
+}
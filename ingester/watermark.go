@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/apache/flink-statefun/statefun-sdk-go/v3/pkg/statefun"
+	kafka "github.com/segmentio/kafka-go"
+)
+
+//watermarks of streams partitioned by event time (`event_time_field` of the partition spec)
+//the ingester function is addressed by stream, so the latest event time seen is kept per stream in StateFun state
+//the watermark trails it by allowed_lateness_seconds, events older than the watermark are late and handled
+//according to late_data_policy of the stream:
+//	notify     - written to their partition, a notification is put on the late data topic once the file is written
+//	late_table - written to the `<message type>_late` table instead, partitioned the same way
+//	drop       - dropped and counted
+var MaxEventTimeSpec = statefun.ValueSpec{
+	Name:      "max_event_time",
+	ValueType: statefun.Int64Type,
+}
+
+//message type suffix of the tables late events are written to
+const lateTableSuffix = "_late"
+
+//notification put on the late data topic for every file with late rows
+//downstream jobs that have already processed the partition can pick it up again
+type LateDataNotification struct {
+	StreamId    string `json:"stream_id"`
+	MessageType string `json:"message_type"`
+	Partition   string `json:"partition"`
+	Rows        int    `json:"rows"`
+	Timestamp   string `json:"timestamp"`
+}
+
+func lateDataTopic() string {
+	return GetEnv("LATE_DATA_TOPIC", "rtdl-late-data")
+}
+
+func lateDataPolicy(configRecord map[string]interface{}) string {
+	if policy, ok := configRecord["late_data_policy"].(string); ok && policy != "" {
+		return policy
+	}
+	return GetEnv("LATE_DATA_POLICY", "notify")
+}
+
+func allowedLateness(configRecord map[string]interface{}) time.Duration {
+	if seconds, ok := configRecord["allowed_lateness_seconds"].(float64); ok && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return time.Duration(GetEnvInt("ALLOWED_LATENESS_SECONDS", 3600)) * time.Second
+}
+
+//advances the watermark of the stream with the event time of the request and tells whether the request is late
+//event times ahead of the processing time only advance the watermark up to the processing time,
+//so that a single producer with a wrong clock cannot make all other events late
+func trackWatermark(storage statefun.AddressScopedStorage, request IncomingMessage, configRecord map[string]interface{}) bool {
+
+	spec, err := streamPartitionSpec(configRecord)
+	if err != nil {
+		return false
+	}
+
+	eventTime, ok := spec.payloadEventTime(request.Payload)
+	if !ok {
+		return false
+	}
+
+	var maxEventTime int64
+	storage.Get(MaxEventTimeSpec, &maxEventTime)
+
+	eventTimeMillis := eventTime.UnixNano() / int64(time.Millisecond)
+	if now := time.Now().UnixNano() / int64(time.Millisecond); eventTimeMillis > now {
+		eventTimeMillis = now
+	}
+
+	if eventTimeMillis > maxEventTime {
+		storage.Set(MaxEventTimeSpec, eventTimeMillis)
+		return false
+	}
+
+	watermark := maxEventTime - allowedLateness(configRecord).Milliseconds()
+	return eventTimeMillis < watermark
+}
+
+//tells downstream jobs that late rows were written to a partition
+func notifyLateData(streamId string, messageType string, partition string, rows int) {
+
+	body, err := json.Marshal(LateDataNotification{
+		StreamId:    streamId,
+		MessageType: messageType,
+		Partition:   partition,
+		Rows:        rows,
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err == nil {
+		err = WriteKafkaMessage(kafka.Message{Topic: lateDataTopic(), Key: []byte(streamId), Value: body})
+	}
+	if err != nil {
+		log.Println("Unable to write late data notification", err)
+		return
+	}
+
+	incrementCounter("late_data_notifications", streamId)
+}
+
+//routes a late request according to the late data policy of its stream
+//returns the message type to write it with, blank if it is dropped, and whether a notification is due
+func routeLateRequest(messageType string, configRecord map[string]interface{}) (string, bool) {
+
+	streamId := fmt.Sprint(configRecord["stream_id"])
+	incrementCounter("events_late", streamId)
+
+	switch lateDataPolicy(configRecord) {
+	case "drop":
+		incrementCounter("events_dropped_late", streamId)
+		return "", false
+	case "late_table":
+		return messageType + lateTableSuffix, false
+	}
+
+	return messageType, true
+}
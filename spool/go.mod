@@ -0,0 +1,3 @@
+module rtdl/spool
+
+go 1.16
@@ -0,0 +1,417 @@
+//disk-backed write-ahead spool shared by the ingest service and the ingester for messages Kafka couldn't take
+//messages are appended as JSON lines to segment files (spool-<number>.log) and replayed in order once the broker
+//is back, spool.offset keeps track of how far the replay got (segment and offset) so that a restart carries on from
+//there - a new segment is started once the current one reaches the segment size and replayed segments are deleted,
+//so the spool never takes much more disk space than the messages still waiting
+//delivery is at-least-once: the offset is committed after a batch was written, messages of a batch that was cut
+//short by a crash are sent again after the restart
+package spool
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Spool struct {
+	config     Config
+	mu         sync.Mutex
+	deliver    sync.RWMutex //shared by direct writes to Kafka, exclusive to spool messages, see Deliver
+	offsetPath string
+	segments   []*segment //oldest first, messages are appended to the last one
+	readOffset int64      //start of the first message not yet replayed, in the first segment
+	records    int64      //messages waiting to be replayed
+	wake       chan struct{}
+}
+
+//settings of a spool
+type Config struct {
+	Dir           string
+	MaxBytes      int64         //messages beyond are rejected with ErrFull
+	SegmentBytes  int64         //64 MB if zero
+	RetryInterval time.Duration //wait after a failed replay, a second if zero
+	ReplayBatch   int           //messages replayed at once, 500 if zero
+	Name          string        //what the messages are called in the log, "messages" if blank
+	Write         Writer
+}
+
+//writes messages to Kafka, on failure returns the messages that were not written together with the error
+type Writer func(messages []Message) ([]Message, error)
+
+//message of a Kafka topic, as it is kept in the spool
+type Message struct {
+	Topic string `json:"topic"`
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+type segment struct {
+	number int64
+	file   *os.File
+	size   int64 //end of the last complete message
+}
+
+type Stats struct {
+	Records  int64 `json:"records"`
+	Bytes    int64 `json:"bytes"`
+	MaxBytes int64 `json:"max_bytes"`
+	Segments int   `json:"segments"`
+}
+
+var ErrFull = errors.New("spool is full")
+
+func segmentPath(dir string, number int64) string {
+	return filepath.Join(dir, fmt.Sprintf("spool-%020d.log", number))
+}
+
+//opens a segment and cuts off a partially written last line, counting the messages from offset on
+func openSegment(dir string, number int64, offset int64) (*segment, int64, error) {
+
+	file, err := os.OpenFile(segmentPath(dir, number), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	if offset > info.Size() {
+		offset = 0
+	}
+
+	opened := &segment{number: number, file: file, size: offset}
+	records := int64(0)
+	reader := bufio.NewReader(io.NewSectionReader(file, offset, info.Size()-offset))
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		opened.size += int64(len(line))
+		records++
+	}
+	if opened.size < info.Size() {
+		if err = file.Truncate(opened.size); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+	}
+
+	return opened, records, nil
+}
+
+//opens (or creates) the spool in the directory of the config and recovers whatever was left from a previous run
+func Open(config Config) (*Spool, error) {
+
+	if config.SegmentBytes <= 0 {
+		config.SegmentBytes = 64 << 20
+	}
+	if config.RetryInterval <= 0 {
+		config.RetryInterval = time.Second
+	}
+	if config.ReplayBatch <= 0 {
+		config.ReplayBatch = 500
+	}
+	if config.Name == "" {
+		config.Name = "messages"
+	}
+	dir := config.Dir
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	spool := &Spool{
+		config:     config,
+		offsetPath: filepath.Join(dir, "spool.offset"),
+		wake:       make(chan struct{}, 1),
+	}
+
+	//spools of earlier versions are a single spool.log with its offset on its own
+	if _, err = os.Stat(filepath.Join(dir, "spool.log")); err == nil {
+		if err = os.Rename(filepath.Join(dir, "spool.log"), segmentPath(dir, 0)); err != nil {
+			return nil, err
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "spool-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	numbers := make([]int64, 0, len(paths))
+	for _, path := range paths {
+		number, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(path), "spool-"), ".log"), 10, 64)
+		if err == nil {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(index int, otherIndex int) bool { return numbers[index] < numbers[otherIndex] })
+	if len(numbers) == 0 {
+		numbers = append(numbers, 0)
+	}
+
+	readSegment, readOffset := numbers[0], int64(0)
+	if offset, err := ioutil.ReadFile(spool.offsetPath); err == nil {
+		fields := strings.Fields(string(offset))
+		if len(fields) == 1 {
+			readOffset, _ = strconv.ParseInt(fields[0], 10, 64)
+		} else if len(fields) == 2 {
+			readSegment, _ = strconv.ParseInt(fields[0], 10, 64)
+			readOffset, _ = strconv.ParseInt(fields[1], 10, 64)
+		}
+	}
+
+	for _, number := range numbers {
+
+		//segments before the one the replay got to have been replayed
+		if number < readSegment && number != numbers[len(numbers)-1] {
+			os.Remove(segmentPath(dir, number))
+			continue
+		}
+
+		offset := int64(0)
+		if number == readSegment {
+			offset = readOffset
+		}
+
+		opened, records, err := openSegment(dir, number, offset)
+		if err != nil {
+			return nil, err
+		}
+		if len(spool.segments) == 0 && offset <= opened.size {
+			spool.readOffset = offset
+		}
+		spool.segments = append(spool.segments, opened)
+		spool.records += records
+	}
+
+	if spool.records > 0 {
+		log.Println("Spool has " + strconv.FormatInt(spool.records, 10) + " " + config.Name + " to replay")
+	}
+
+	return spool, nil
+}
+
+//bytes waiting to be replayed, the caller holds the lock
+func (spool *Spool) pendingBytes() int64 {
+
+	pending := -spool.readOffset
+	for _, segment := range spool.segments {
+		pending += segment.size
+	}
+
+	return pending
+}
+
+func (spool *Spool) Stats() Stats {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	return Stats{Records: spool.records, Bytes: spool.pendingBytes(), MaxBytes: spool.config.MaxBytes, Segments: len(spool.segments)}
+}
+
+//true as long as there are messages waiting, new messages have to queue up behind them to keep the order
+func (spool *Spool) Pending() bool {
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	return spool.records > 0
+}
+
+//appends messages to the spool, all or nothing
+func (spool *Spool) Append(messages ...Message) error {
+
+	var buffer bytes.Buffer
+	for _, message := range messages {
+		line, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		buffer.Write(line)
+		buffer.WriteByte('\n')
+	}
+
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	if spool.pendingBytes()+int64(buffer.Len()) > spool.config.MaxBytes {
+		return ErrFull
+	}
+
+	last := spool.segments[len(spool.segments)-1]
+	if last.size >= spool.config.SegmentBytes {
+		next, _, err := openSegment(spool.config.Dir, last.number+1, 0)
+		if err != nil {
+			return err
+		}
+		spool.segments = append(spool.segments, next)
+		last = next
+	}
+
+	if _, err := last.file.Write(buffer.Bytes()); err != nil {
+		last.file.Truncate(last.size) //drop whatever made it to disk
+		return err
+	}
+	if err := last.file.Sync(); err != nil {
+		return err
+	}
+
+	last.size += int64(buffer.Len())
+	spool.records += int64(len(messages))
+
+	select {
+	case spool.wake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+//reads up to limit messages from the head of the first segment
+//returns the messages, the offset right after the last one and the number of lines read, unreadable ones included
+func (spool *Spool) peek(limit int) ([]Message, int64, int, error) {
+
+	spool.mu.Lock()
+	first, start := spool.segments[0], spool.readOffset
+	end := first.size
+	spool.mu.Unlock()
+
+	messages := make([]Message, 0, limit)
+	reader := bufio.NewReader(io.NewSectionReader(first.file, start, end-start))
+	offset, lines := start, 0
+	for len(messages) < limit {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			break
+		}
+		offset += int64(len(line))
+		lines++
+
+		var message Message
+		if err := json.Unmarshal(line, &message); err != nil {
+			log.Println("Skipping unreadable spool record", err)
+			continue
+		}
+		messages = append(messages, message)
+	}
+
+	return messages, offset, lines, nil
+}
+
+//marks everything up to offset of the first segment as replayed
+//replayed segments are deleted, the last one is emptied instead once fully replayed
+func (spool *Spool) commit(offset int64, lines int) error {
+
+	spool.mu.Lock()
+	defer spool.mu.Unlock()
+
+	spool.readOffset = offset
+	spool.records -= int64(lines)
+
+	for len(spool.segments) > 1 && spool.readOffset >= spool.segments[0].size {
+		first := spool.segments[0]
+		first.file.Close()
+		if err := os.Remove(first.file.Name()); err != nil {
+			log.Println("Unable to delete replayed spool segment", err)
+		}
+		spool.segments = spool.segments[1:]
+		spool.readOffset = 0
+	}
+
+	if first := spool.segments[0]; len(spool.segments) == 1 && spool.readOffset >= first.size && first.size > 0 {
+		if err := first.file.Truncate(0); err != nil {
+			return err
+		}
+		first.size = 0
+		spool.readOffset = 0
+		spool.records = 0
+	}
+
+	//write the offset atomically so that a crash never leaves a torn offset behind
+	tempPath := spool.offsetPath + ".tmp"
+	err := ioutil.WriteFile(tempPath, []byte(strconv.FormatInt(spool.segments[0].number, 10)+" "+strconv.FormatInt(spool.readOffset, 10)), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempPath, spool.offsetPath)
+}
+
+//replays spooled messages in order for as long as the service runs
+//failed attempts are retried after the retry interval, only with the messages of the batch that were not written
+func (spool *Spool) Replay() {
+
+	for {
+		if !spool.Pending() {
+			<-spool.wake
+			continue
+		}
+
+		messages, offset, lines, err := spool.peek(spool.config.ReplayBatch)
+		if err != nil {
+			time.Sleep(spool.config.RetryInterval)
+			continue
+		}
+
+		replayed := len(messages)
+		for len(messages) > 0 {
+			failed, err := spool.config.Write(messages)
+			if err == nil {
+				break
+			}
+			if failed != nil {
+				messages = failed
+			}
+			time.Sleep(spool.config.RetryInterval)
+		}
+
+		if err = spool.commit(offset, lines); err != nil {
+			log.Println("Unable to commit spool offset", err)
+			time.Sleep(spool.config.RetryInterval)
+			continue
+		}
+
+		if replayed > 0 {
+			log.Println("Replayed " + strconv.Itoa(replayed) + " spooled " + spool.config.Name)
+		}
+	}
+}
+
+//hands messages to Kafka, or to the spool while Kafka is unavailable or older messages are still spooled
+//checking the spool and writing to Kafka happen under the shared deliver lock, spooling takes it exclusively -
+//once a message is spooled, no message delivered after it can reach Kafka before it is replayed
+//an error is only returned if the messages could neither be written nor spooled
+func (spool *Spool) Deliver(messages ...Message) error {
+
+	spool.deliver.RLock()
+	if !spool.Pending() {
+		failed, err := spool.config.Write(messages)
+		if err == nil {
+			spool.deliver.RUnlock()
+			return nil
+		}
+
+		//only spool what didn't make it
+		messages = failed
+	}
+	spool.deliver.RUnlock()
+
+	spool.deliver.Lock()
+	defer spool.deliver.Unlock()
+
+	return spool.Append(messages...)
+}